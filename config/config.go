@@ -1,35 +1,273 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/pmezard/adblock/adblock"
 )
 
+const (
+	// UpstreamBalancingRoundRobin makes requests to be spread over
+	// upstreams one by one.
+	UpstreamBalancingRoundRobin = "round-robin"
+
+	// UpstreamBalancingLeastConnections makes requests to be sent to
+	// the upstream with the least number of active connections.
+	UpstreamBalancingLeastConnections = "least-connections"
+
+	// SessionBalancingRoundRobin makes requests of a client to be spread
+	// over its sessions one by one.
+	SessionBalancingRoundRobin = "round-robin"
+
+	// SessionBalancingHost makes requests of a client to the same host
+	// to be sent within the same session.
+	SessionBalancingHost = "host"
+
+	// SessionAffinityClient makes all requests of a client to share
+	// its sessions.
+	SessionAffinityClient = "client"
+
+	// SessionAffinityDomain makes each registrable domain (like
+	// example.co.uk) visited by a client to have its own sessions.
+	SessionAffinityDomain = "domain"
+
+	// ClientIDIPUserAgent identifies clients by a hash of their IP
+	// address and User-Agent.
+	ClientIDIPUserAgent = "ip-user-agent"
+
+	// ClientIDHeader identifies clients by X-Headless-Client-Id header
+	// they send.
+	ClientIDHeader = "header"
+
+	// ClientIDProxyUser identifies clients by a name of proxy user they
+	// authenticate with.
+	ClientIDProxyUser = "proxy-user"
+
+	// ClientIDSourcePort identifies clients by their IP address and
+	// a range their source port belongs to.
+	ClientIDSourcePort = "source-port"
+
+	// ClientIDBindPort identifies clients by a port they have connected
+	// to.
+	ClientIDBindPort = "bind-port"
+
+	// RetryAnyError is an error of retry policy which matches all
+	// Crawlera errors without own policy.
+	RetryAnyError = "*"
+
+	// RefererPolicyOrigin makes automatic referers to contain only an
+	// origin of the page: scheme, host and port.
+	RefererPolicyOrigin = "origin"
+
+	// RefererPolicyStripQuery makes automatic referers to contain an URL
+	// of the page without query string.
+	RefererPolicyStripQuery = "strip-query"
+
+	// RefererPolicyFull makes automatic referers to contain a full URL
+	// of the page.
+	RefererPolicyFull = "full"
+
+	// ErrorPagesOff returns responses with Crawlera errors to clients
+	// as is.
+	ErrorPagesOff = "off"
+
+	// ErrorPagesHTML replaces bodies of responses with Crawlera errors
+	// with HTML pages.
+	ErrorPagesHTML = "html"
+
+	// ErrorPagesJSON replaces bodies of responses with Crawlera errors
+	// with JSON documents.
+	ErrorPagesJSON = "json"
+
+	// AdblockResponseForbidden responds to adblocked requests with 403.
+	AdblockResponseForbidden = "403"
+
+	// AdblockResponseNoContent responds to adblocked requests with 204.
+	AdblockResponseNoContent = "204"
+
+	// AdblockResponseEmpty responds to adblocked requests with an empty
+	// resource of their type: empty script, stylesheet or 1x1 GIF.
+	AdblockResponseEmpty = "empty"
+
+	// AdblockResponseRedirect redirects adblocked requests to an empty
+	// resource of their type served by headless proxy itself.
+	AdblockResponseRedirect = "redirect"
+
+	// AdblockResponseReset closes connections of adblocked requests
+	// without any response. Connections are closed as usual, not with
+	// TCP RST.
+	AdblockResponseReset = "reset"
+)
+
+// Duration is a wrapper for time.Duration which can be parsed from
+// strings like "10s" or "5m" in configuration file.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText conforms encoding.TextUnmarshaler interface.
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("incorrect duration %s: %w", string(text), err)
+	}
+
+	d.Duration = duration
+
+	return nil
+}
+
+// Upstream defines a single Crawlera endpoint.
+type Upstream struct {
+	Host string `toml:"host"`
+	Port int    `toml:"port"`
+	TLS  bool   `toml:"tls"`
+}
+
+// Address returns host:port of the upstream.
+func (u Upstream) Address() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// URL builds and returns URL to the upstream with embedded credentials.
+func (u Upstream) URL(apiKey string) string {
+	scheme := "http"
+	if u.TLS {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s:@%s", scheme, apiKey, u.Address())
+}
+
+// Tenant defines a project which shares the proxy with others but has
+// its own API key. Requests are routed to the tenant by the name of proxy
+// user, by the port proxy is listening on or by source IP of the client.
+type Tenant struct {
+	Name                  string   `toml:"name"`
+	APIKey                string   `toml:"api_key"`
+	ConcurrentConnections int      `toml:"concurrent_connections"`
+	ProxyUsers            []string `toml:"proxy_users"`
+	BindPorts             []int    `toml:"bind_ports"`
+	SourceCIDRs           []string `toml:"source_cidrs"`
+}
+
+// RetryPolicy defines how requests failed with the error are retried.
+// Error is a value of X-Crawlera-Error header (like banned), a status
+// code of the response (like 503) or RetryAnyError. A delay before each
+// retry grows exponentially from Backoff up to MaxBackoff, with jitter.
+// Retries stop after Attempts or when Deadline is reached.
+type RetryPolicy struct {
+	Error         string   `toml:"error"`
+	Attempts      int      `toml:"attempts"`
+	Backoff       Duration `toml:"backoff"`
+	MaxBackoff    Duration `toml:"max_backoff"`
+	Deadline      Duration `toml:"deadline"`
+	RotateSession bool     `toml:"rotate_session"`
+}
+
+// AdblockResponse defines how to respond to requests blocked by the
+// adblock rule or by any rule of the list. Exactly one of Rule (a text
+// of the rule as is) and List (an URL or a path of the list, or
+// adblock_rules for inline rules) has to be set.
+type AdblockResponse struct {
+	List     string `toml:"list"`
+	Rule     string `toml:"rule"`
+	Response string `toml:"response"`
+}
+
+// Listener is an additional address headless proxy listens on. Requests
+// accepted by the listener are handled with its own profile: settings
+// which are not set here are inherited from the global configuration.
+type Listener struct {
+	Name                              string            `toml:"name"`
+	BindIP                            string            `toml:"bind_ip"`
+	BindPort                          int               `toml:"bind_port"`
+	NoAutoSessions                    *bool             `toml:"no_auto_sessions"`
+	SessionsPerClient                 int               `toml:"sessions_per_client"`
+	SessionAffinity                   string            `toml:"session_affinity"`
+	ConcurrentConnections             int               `toml:"concurrent_connections"`
+	DirectAccessHostPathRegexps       []string          `toml:"direct_access_hostpath_regexps"`
+	DirectAccessExceptHostPathRegexps []string          `toml:"direct_access_except_hostpath_regexps"`
+	XHeaders                          map[string]string `toml:"xheaders"`
+}
+
 // Config stores global configuration data of the application.
 type Config struct {
-	Debug                             bool     `toml:"debug"`
-	DoNotVerifyCrawleraCert           bool     `toml:"dont_verify_crawlera_cert"`
-	NoAutoSessions                    bool     `toml:"no_auto_sessions"`
-	ConcurrentConnections             int      `toml:"concurrent_connections"`
-	BindPort                          int      `toml:"bind_port"`
-	CrawleraPort                      int      `toml:"crawlera_port"`
-	ProxyAPIPort                      int      `toml:"proxy_api_port"`
-	BindIP                            string   `toml:"bind_ip"`
-	ProxyAPIIP                        string   `toml:"proxy_api_ip"`
-	APIKey                            string   `toml:"api_key"`
-	CrawleraHost                      string   `toml:"crawlera_host"`
-	TLSCaCertificate                  string   `toml:"tls_ca_certificate"`
-	TLSPrivateKey                     string   `toml:"tls_private_key"`
-	AdblockLists                      []string `toml:"adblock_lists"`
-	DirectAccessHostPathRegexps       []string `toml:"direct_access_hostpath_regexps"`
-	DirectAccessExceptHostPathRegexps []string `toml:"direct_access_except_hostpath_regexps"`
+	Debug                             bool              `toml:"debug"`
+	DoNotVerifyCrawleraCert           bool              `toml:"dont_verify_crawlera_cert"`
+	CrawleraTLS                       bool              `toml:"crawlera_tls"`
+	NoAutoSessions                    bool              `toml:"no_auto_sessions"`
+	AutoReferer                       bool              `toml:"auto_referer"`
+	ConcurrentConnections             int               `toml:"concurrent_connections"`
+	BindPort                          int               `toml:"bind_port"`
+	CrawleraPort                      int               `toml:"crawlera_port"`
+	ProxyAPIPort                      int               `toml:"proxy_api_port"`
+	BindIP                            string            `toml:"bind_ip"`
+	ProxyAPIIP                        string            `toml:"proxy_api_ip"`
+	APIKey                            string            `toml:"api_key"`
+	CrawleraHost                      string            `toml:"crawlera_host"`
+	CrawleraCABundle                  string            `toml:"crawlera_ca_bundle"`
+	TLSCaCertificate                  string            `toml:"tls_ca_certificate"`
+	TLSPrivateKey                     string            `toml:"tls_private_key"`
+	InboundAuthHtpasswd               string            `toml:"inbound_auth_htpasswd"`
+	InboundAuthTokens                 []string          `toml:"inbound_auth_tokens"`
+	InboundAuthCIDRs                  []string          `toml:"inbound_auth_cidrs"`
+	ProxyAPITokens                    []string          `toml:"proxy_api_tokens"`
+	ProxyAPICIDRs                     []string          `toml:"proxy_api_cidrs"`
+	AdblockLists                      []string          `toml:"adblock_lists"`
+	AdblockRefreshInterval            Duration          `toml:"adblock_refresh_interval"`
+	AdblockStartupTimeout             Duration          `toml:"adblock_startup_timeout"`
+	AdblockRules                      []string          `toml:"adblock_rules"`
+	AdblockAllowlist                  []string          `toml:"adblock_allowlist"`
+	AdblockResponse                   string            `toml:"adblock_response"`
+	AdblockResponses                  []AdblockResponse `toml:"adblock_responses"`
+	DirectAccessHostPathRegexps       []string          `toml:"direct_access_hostpath_regexps"`
+	DirectAccessExceptHostPathRegexps []string          `toml:"direct_access_except_hostpath_regexps"`
+	UpstreamBalancing                 string            `toml:"upstream_balancing"`
+	UpstreamMaxFailures               int               `toml:"upstream_max_failures"`
+	UpstreamHealthCheckInterval       Duration          `toml:"upstream_health_check_interval"`
+	UpstreamHealthCheckTarget         string            `toml:"upstream_health_check_target"`
+	Upstreams                         []Upstream        `toml:"upstreams"`
+	RefererPolicy                     string            `toml:"referer_policy"`
+	RefererTTL                        Duration          `toml:"referer_ttl"`
+	SessionsPerClient                 int               `toml:"sessions_per_client"`
+	SessionBalancing                  string            `toml:"session_balancing"`
+	SessionAffinity                   string            `toml:"session_affinity"`
+	SessionCreateTimeout              Duration          `toml:"session_create_timeout"`
+	SessionCreateRetryTimeout         Duration          `toml:"session_create_retry_timeout"`
+	SessionAPITimeout                 Duration          `toml:"session_api_timeout"`
+	SessionTTL                        Duration          `toml:"session_ttl"`
+	SessionMaxAge                     Duration          `toml:"session_max_age"`
+	SessionMaxRequests                int               `toml:"session_max_requests"`
+	StateDir                          string            `toml:"state_dir"`
+	ShutdownTimeout                   Duration          `toml:"shutdown_timeout"`
+	ClientID                          string            `toml:"client_id"`
+	ClientIDPortRange                 int               `toml:"client_id_port_range"`
+	ClientConcurrentConnections       int               `toml:"client_concurrent_connections"`
+	ErrorPages                        string            `toml:"error_pages"`
+	Tenants                           []Tenant          `toml:"tenants"`
+	Listeners                         []Listener        `toml:"listeners"`
+	Retries                           []RetryPolicy     `toml:"retries"`
 	XHeaders                          map[string]string
+
+	// ListenerName is a name of the listener this configuration is
+	// built for by ForListener. It is empty for the global one.
+	ListenerName string `toml:"-"`
+
+	// CrawleraCA is a PEM certificate of Crawlera CA embedded into the
+	// binary. Crawlera certificates are always verified against it,
+	// crawlera_ca_bundle only adds more certificates.
+	CrawleraCA string `toml:"-"`
 }
 
 // Bind returns a string for the http.ListenAndServe based on config
@@ -38,12 +276,81 @@ func (c *Config) Bind() string {
 	return net.JoinHostPort(c.BindIP, strconv.Itoa(c.BindPort))
 }
 
+// ForListener returns a copy of the configuration with settings of the
+// listener applied. X-Headers of the listener are added to global ones.
+func (c *Config) ForListener(listener Listener) *Config {
+	rv := *c
+	rv.Listeners = nil
+	rv.ListenerName = listener.Name
+	rv.BindIP, rv.BindPort = listener.BindIP, listener.BindPort
+
+	if rv.BindIP == "" {
+		rv.BindIP = c.BindIP
+	}
+
+	if listener.NoAutoSessions != nil {
+		rv.NoAutoSessions = *listener.NoAutoSessions
+	}
+
+	if listener.SessionsPerClient > 0 {
+		rv.SessionsPerClient = listener.SessionsPerClient
+	}
+
+	if listener.SessionAffinity != "" {
+		rv.SessionAffinity = listener.SessionAffinity
+	}
+
+	if listener.ConcurrentConnections > 0 {
+		rv.ConcurrentConnections = listener.ConcurrentConnections
+	}
+
+	if listener.DirectAccessHostPathRegexps != nil {
+		rv.DirectAccessHostPathRegexps = listener.DirectAccessHostPathRegexps
+	}
+
+	if listener.DirectAccessExceptHostPathRegexps != nil {
+		rv.DirectAccessExceptHostPathRegexps = listener.DirectAccessExceptHostPathRegexps
+	}
+
+	rv.XHeaders = make(map[string]string, len(c.XHeaders)+len(listener.XHeaders))
+
+	for k, v := range c.XHeaders {
+		rv.XHeaders[k] = v
+	}
+
+	for k, v := range listener.XHeaders {
+		rv.SetXHeader(k, v)
+	}
+
+	return &rv
+}
+
 // CrawleraURL builds and returns URL to crawlera. Basically, this is required
-// for http.ProxyURL to have embedded credentials etc.
+// for http.ProxyURL to have embedded credentials etc. Scheme of this URL is
+// https if Crawlera has to be accessed over TLS.
 func (c *Config) CrawleraURL() string {
-	return fmt.Sprintf("http://%s:@%s",
-		c.APIKey,
-		net.JoinHostPort(c.CrawleraHost, strconv.Itoa(c.CrawleraPort)))
+	return c.CrawleraUpstream().URL(c.APIKey)
+}
+
+// CrawleraUpstream returns an upstream defined by crawlera_host,
+// crawlera_port and crawlera_tls options.
+func (c *Config) CrawleraUpstream() Upstream {
+	return Upstream{
+		Host: c.CrawleraHost,
+		Port: c.CrawleraPort,
+		TLS:  c.CrawleraTLS,
+	}
+}
+
+// CrawleraUpstreams returns a list of all Crawlera endpoints proxy should
+// use. If no upstreams are set explicitly, it returns the only one defined
+// by crawlera_host, crawlera_port and crawlera_tls.
+func (c *Config) CrawleraUpstreams() []Upstream {
+	if len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+
+	return []Upstream{c.CrawleraUpstream()}
 }
 
 // MaybeSetNoAutoSessions defines is it is required to enable automatic
@@ -52,6 +359,30 @@ func (c *Config) MaybeSetNoAutoSessions(value bool) {
 	c.NoAutoSessions = c.NoAutoSessions || value
 }
 
+// MaybeSetAutoReferer defines if it is required to set Referer headers
+// for requests which do not have them. If given value is not defined
+// (false) then changes nothing.
+func (c *Config) MaybeSetAutoReferer(value bool) {
+	c.AutoReferer = c.AutoReferer || value
+}
+
+// MaybeSetRefererPolicy sets which part of the page URL is used as
+// automatic referer. If given value is not defined ("") then changes
+// nothing.
+func (c *Config) MaybeSetRefererPolicy(value string) {
+	if value != "" {
+		c.RefererPolicy = value
+	}
+}
+
+// MaybeSetRefererTTL sets for how long automatic referers are
+// remembered. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetRefererTTL(value time.Duration) {
+	if value > 0 {
+		c.RefererTTL.Duration = value
+	}
+}
+
 // MaybeSetDebug enabled debug mode of crawlera-headless-proxy (verbosity
 // mostly). If given value is not defined (false) then changes nothing.
 func (c *Config) MaybeSetDebug(value bool) {
@@ -72,6 +403,22 @@ func (c *Config) MaybeDoNotVerifyCrawleraCert(value bool) {
 	c.DoNotVerifyCrawleraCert = c.DoNotVerifyCrawleraCert || value
 }
 
+// MaybeSetCrawleraTLS defines if crawlera-headless-proxy should connect
+// to Crawlera using TLS. If given value is not defined (false) then changes
+// nothing.
+func (c *Config) MaybeSetCrawleraTLS(value bool) {
+	c.CrawleraTLS = c.CrawleraTLS || value
+}
+
+// MaybeSetCrawleraCABundle sets a path to the file with additional
+// certificate authorities which are used to verify Crawlera TLS
+// certificates. If given value is not defined ("") then changes nothing.
+func (c *Config) MaybeSetCrawleraCABundle(value string) {
+	if value != "" {
+		c.CrawleraCABundle = value
+	}
+}
+
 // MaybeSetBindIP sets an IP crawlera-headless-proxy should listen on.
 // If given value is not defined (0) then changes nothing.
 //
@@ -155,6 +502,47 @@ func (c *Config) MaybeSetAdblockLists(value []string) {
 	}
 }
 
+// MaybeSetAdblockRefreshInterval sets how often adblock lists are
+// refreshed. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetAdblockRefreshInterval(value time.Duration) {
+	if value > 0 {
+		c.AdblockRefreshInterval.Duration = value
+	}
+}
+
+// MaybeSetAdblockStartupTimeout sets for how long requests wait until
+// adblock lists are loaded on start. If given value is not defined (0)
+// then changes nothing.
+func (c *Config) MaybeSetAdblockStartupTimeout(value time.Duration) {
+	if value > 0 {
+		c.AdblockStartupTimeout.Duration = value
+	}
+}
+
+// MaybeSetAdblockRules sets a list of adblock rules which are used
+// in addition to adblock lists.
+func (c *Config) MaybeSetAdblockRules(value []string) {
+	if len(value) > 0 {
+		c.AdblockRules = value
+	}
+}
+
+// MaybeSetAdblockAllowlist sets a list of hosts and regular expressions
+// of URLs which are never blocked by adblock lists.
+func (c *Config) MaybeSetAdblockAllowlist(value []string) {
+	if len(value) > 0 {
+		c.AdblockAllowlist = value
+	}
+}
+
+// MaybeSetAdblockResponse sets how to respond to adblocked requests by
+// default. If given value is empty then changes nothing.
+func (c *Config) MaybeSetAdblockResponse(value string) {
+	if value != "" {
+		c.AdblockResponse = value
+	}
+}
+
 // MaybeSetDirectAccessHostPathRegexps sets a list of regular
 // expressions for direct access.
 func (c *Config) MaybeSetDirectAccessHostPathRegexps(value []string) {
@@ -171,6 +559,257 @@ func (c *Config) MaybeSetDirectAccessExceptHostPathRegexps(value []string) {
 	}
 }
 
+// MaybeSetInboundAuthHtpasswd sets a path to htpasswd file with bcrypt
+// hashed credentials of clients. If given value is not defined ("") then
+// changes nothing.
+func (c *Config) MaybeSetInboundAuthHtpasswd(value string) {
+	if value != "" {
+		c.InboundAuthHtpasswd = value
+	}
+}
+
+// MaybeSetInboundAuthTokens sets a list of static tokens clients can use
+// to authenticate. If given value is not defined (empty) then changes
+// nothing.
+func (c *Config) MaybeSetInboundAuthTokens(value []string) {
+	if len(value) > 0 {
+		c.InboundAuthTokens = value
+	}
+}
+
+// MaybeSetInboundAuthCIDRs sets a list of subnets clients from which do
+// not need to authenticate. If given value is not defined (empty) then
+// changes nothing.
+func (c *Config) MaybeSetInboundAuthCIDRs(value []string) {
+	if len(value) > 0 {
+		c.InboundAuthCIDRs = value
+	}
+}
+
+// MaybeSetProxyAPITokens sets a list of static tokens clients of own API
+// of crawlera-headless-proxy can use to authenticate. If given value is
+// not defined (empty) then changes nothing.
+func (c *Config) MaybeSetProxyAPITokens(value []string) {
+	if len(value) > 0 {
+		c.ProxyAPITokens = value
+	}
+}
+
+// MaybeSetProxyAPICIDRs sets a list of subnets clients from which can
+// use own API of crawlera-headless-proxy without authentication. If
+// given value is not defined (empty) then changes nothing.
+func (c *Config) MaybeSetProxyAPICIDRs(value []string) {
+	if len(value) > 0 {
+		c.ProxyAPICIDRs = value
+	}
+}
+
+// MaybeSetUpstreams sets a list of Crawlera endpoints. Each value is
+// host:port, optionally prefixed by http:// or https:// scheme. If given
+// value is not defined (empty) then changes nothing.
+func (c *Config) MaybeSetUpstreams(values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	upstreams := make([]Upstream, 0, len(values))
+
+	for _, value := range values {
+		if !strings.Contains(value, "://") {
+			value = "http://" + value
+		}
+
+		parsed, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("incorrect upstream %s: %w", value, err)
+		}
+
+		port, err := strconv.Atoi(parsed.Port())
+		if err != nil {
+			return fmt.Errorf("incorrect port of upstream %s: %w", value, err)
+		}
+
+		switch parsed.Scheme {
+		case "http", "https":
+		default:
+			return fmt.Errorf("unknown scheme of upstream %s", value)
+		}
+
+		upstreams = append(upstreams, Upstream{
+			Host: parsed.Hostname(),
+			Port: port,
+			TLS:  parsed.Scheme == "https",
+		})
+	}
+
+	c.Upstreams = upstreams
+
+	return nil
+}
+
+// MaybeSetUpstreamBalancing sets a strategy of choosing an upstream
+// for the request. If given value is not defined ("") then changes
+// nothing.
+func (c *Config) MaybeSetUpstreamBalancing(value string) {
+	if value != "" {
+		c.UpstreamBalancing = value
+	}
+}
+
+// MaybeSetSessionsPerClient sets a number of Crawlera sessions each
+// client has. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetSessionsPerClient(value int) {
+	if value > 0 {
+		c.SessionsPerClient = value
+	}
+}
+
+// MaybeSetSessionBalancing sets a strategy of choosing a session of the
+// client for the request. If given value is not defined ("") then
+// changes nothing.
+func (c *Config) MaybeSetSessionBalancing(value string) {
+	if value != "" {
+		c.SessionBalancing = value
+	}
+}
+
+// MaybeSetSessionAffinity sets what sessions are bound to: a client or
+// a client and a registrable domain. If given value is not defined ("")
+// then changes nothing.
+func (c *Config) MaybeSetSessionAffinity(value string) {
+	if value != "" {
+		c.SessionAffinity = value
+	}
+}
+
+// MaybeSetSessionCreateTimeout sets for how long requests wait for
+// a new session. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetSessionCreateTimeout(value time.Duration) {
+	if value > 0 {
+		c.SessionCreateTimeout.Duration = value
+	}
+}
+
+// MaybeSetSessionCreateRetryTimeout sets for how long retried requests
+// wait for a new session. If given value is not defined (0) then
+// changes nothing.
+func (c *Config) MaybeSetSessionCreateRetryTimeout(value time.Duration) {
+	if value > 0 {
+		c.SessionCreateRetryTimeout.Duration = value
+	}
+}
+
+// MaybeSetSessionAPITimeout sets a timeout of requests to Crawlera
+// sessions API. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetSessionAPITimeout(value time.Duration) {
+	if value > 0 {
+		c.SessionAPITimeout.Duration = value
+	}
+}
+
+// MaybeSetSessionTTL sets for how long unused sessions are kept. If
+// given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetSessionTTL(value time.Duration) {
+	if value > 0 {
+		c.SessionTTL.Duration = value
+	}
+}
+
+// MaybeSetSessionMaxAge sets an age after which sessions are rotated.
+// If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetSessionMaxAge(value time.Duration) {
+	if value > 0 {
+		c.SessionMaxAge.Duration = value
+	}
+}
+
+// MaybeSetSessionMaxRequests sets a number of requests after which
+// sessions are rotated. If given value is not defined (0) then changes
+// nothing.
+func (c *Config) MaybeSetSessionMaxRequests(value int) {
+	if value > 0 {
+		c.SessionMaxRequests = value
+	}
+}
+
+// MaybeSetStateDir sets a directory where headless proxy keeps its
+// state between restarts. If given value is not defined ("") then
+// changes nothing.
+func (c *Config) MaybeSetStateDir(value string) {
+	if value != "" {
+		c.StateDir = value
+	}
+}
+
+// MaybeSetShutdownTimeout sets for how long graceful shutdown waits for
+// requests in flight and session deletions. If given value is not
+// defined (0) then changes nothing.
+func (c *Config) MaybeSetShutdownTimeout(value time.Duration) {
+	if value > 0 {
+		c.ShutdownTimeout.Duration = value
+	}
+}
+
+// MaybeSetClientID sets a strategy how clients are identified. If given
+// value is not defined ("") then changes nothing.
+func (c *Config) MaybeSetClientID(value string) {
+	if value != "" {
+		c.ClientID = value
+	}
+}
+
+// MaybeSetClientIDPortRange sets a size of source port ranges clients
+// are identified by. If given value is not defined (0) then changes
+// nothing.
+func (c *Config) MaybeSetClientIDPortRange(value int) {
+	if value > 0 {
+		c.ClientIDPortRange = value
+	}
+}
+
+// MaybeSetClientConcurrentConnections sets a number of concurrent
+// connections of each client if necessary.
+func (c *Config) MaybeSetClientConcurrentConnections(value int) {
+	if value > 0 {
+		c.ClientConcurrentConnections = value
+	}
+}
+
+// MaybeSetErrorPages sets how responses with Crawlera errors are
+// returned to clients. If given value is not defined ("") then changes
+// nothing.
+func (c *Config) MaybeSetErrorPages(value string) {
+	if value != "" {
+		c.ErrorPages = value
+	}
+}
+
+// MaybeSetUpstreamMaxFailures sets a number of consecutive failures
+// after which upstream is considered unhealthy. If given value is not
+// defined (0) then changes nothing.
+func (c *Config) MaybeSetUpstreamMaxFailures(value int) {
+	if value > 0 {
+		c.UpstreamMaxFailures = value
+	}
+}
+
+// MaybeSetUpstreamHealthCheckInterval sets a periodicity of upstream
+// health checks. If given value is not defined (0) then changes nothing.
+func (c *Config) MaybeSetUpstreamHealthCheckInterval(value time.Duration) {
+	if value > 0 {
+		c.UpstreamHealthCheckInterval.Duration = value
+	}
+}
+
+// MaybeSetUpstreamHealthCheckTarget sets host:port health checks
+// establish tunnels to through upstreams. If given value is not defined
+// ("") then changes nothing.
+func (c *Config) MaybeSetUpstreamHealthCheckTarget(value string) {
+	if value != "" {
+		c.UpstreamHealthCheckTarget = value
+	}
+}
+
 // SetXHeader sets a header value of Crawlera X-Header. It is actually
 // allowed to pass values in both ways: with full name (x-crawlera-profile)
 // for example, and in the short form: just 'profile'. This effectively the
@@ -184,6 +823,238 @@ func (c *Config) SetXHeader(key, value string) {
 	c.XHeaders[key] = value
 }
 
+// Validate checks that values of the configuration are consistent.
+func (c *Config) Validate() error {
+	switch c.UpstreamBalancing {
+	case UpstreamBalancingRoundRobin, UpstreamBalancingLeastConnections:
+	default:
+		return fmt.Errorf("unknown upstream balancing %s", c.UpstreamBalancing)
+	}
+
+	if c.SessionsPerClient <= 0 {
+		return fmt.Errorf("incorrect number of sessions per client %d", c.SessionsPerClient)
+	}
+
+	switch c.SessionBalancing {
+	case SessionBalancingRoundRobin, SessionBalancingHost:
+	default:
+		return fmt.Errorf("unknown session balancing %s", c.SessionBalancing)
+	}
+
+	if c.SessionCreateTimeout.Duration <= 0 || c.SessionCreateRetryTimeout.Duration <= 0 ||
+		c.SessionAPITimeout.Duration <= 0 || c.SessionTTL.Duration <= 0 {
+		return errors.New("session timeouts have to be positive")
+	}
+
+	if c.SessionMaxAge.Duration < 0 || c.SessionMaxRequests < 0 {
+		return errors.New("session max age and max requests cannot be negative")
+	}
+
+	switch c.SessionAffinity {
+	case SessionAffinityClient, SessionAffinityDomain:
+	default:
+		return fmt.Errorf("unknown session affinity %s", c.SessionAffinity)
+	}
+
+	switch c.ClientID {
+	case ClientIDIPUserAgent, ClientIDHeader, ClientIDProxyUser, ClientIDSourcePort, ClientIDBindPort:
+	default:
+		return fmt.Errorf("unknown client id strategy %s", c.ClientID)
+	}
+
+	if c.ClientIDPortRange <= 0 {
+		return errors.New("client id port range has to be positive")
+	}
+
+	if c.AdblockRefreshInterval.Duration < 0 {
+		return errors.New("adblock refresh interval cannot be negative")
+	}
+
+	if c.AdblockStartupTimeout.Duration < 0 {
+		return errors.New("adblock startup timeout cannot be negative")
+	}
+
+	if err := c.validateAdblock(); err != nil {
+		return err
+	}
+
+	if c.ShutdownTimeout.Duration <= 0 {
+		return errors.New("shutdown timeout has to be positive")
+	}
+
+	switch c.RefererPolicy {
+	case RefererPolicyOrigin, RefererPolicyStripQuery, RefererPolicyFull:
+	default:
+		return fmt.Errorf("unknown referer policy %s", c.RefererPolicy)
+	}
+
+	switch c.ErrorPages {
+	case ErrorPagesOff, ErrorPagesHTML, ErrorPagesJSON:
+	default:
+		return fmt.Errorf("unknown error pages format %s", c.ErrorPages)
+	}
+
+	for _, v := range c.CrawleraUpstreams() {
+		if v.Host == "" || v.Port <= 0 {
+			return fmt.Errorf("incorrect upstream %s", v.Address())
+		}
+	}
+
+	if c.UpstreamHealthCheckTarget != "" {
+		if _, _, err := net.SplitHostPort(c.UpstreamHealthCheckTarget); err != nil {
+			return fmt.Errorf("incorrect upstream health check target: %w", err)
+		}
+	}
+
+	for _, v := range c.InboundAuthCIDRs {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("incorrect inbound auth CIDR: %w", err)
+		}
+	}
+
+	for _, v := range c.ProxyAPICIDRs {
+		if _, _, err := net.ParseCIDR(v); err != nil {
+			return fmt.Errorf("incorrect proxy API CIDR: %w", err)
+		}
+	}
+
+	for _, v := range append(c.DirectAccessHostPathRegexps, c.DirectAccessExceptHostPathRegexps...) {
+		if _, err := regexp.Compile(v); err != nil {
+			return fmt.Errorf("incorrect direct access regexp: %w", err)
+		}
+	}
+
+	if err := c.validateTenants(); err != nil {
+		return err
+	}
+
+	if err := c.validateRetries(); err != nil {
+		return err
+	}
+
+	return c.validateListeners()
+}
+
+func (c *Config) validateRetries() error {
+	errs := map[string]bool{}
+
+	for _, v := range c.Retries {
+		switch {
+		case v.Error == "":
+			return fmt.Errorf("error of retry policy is not set")
+		case errs[v.Error]:
+			return fmt.Errorf("retry policy for %s is defined several times", v.Error)
+		case v.Attempts <= 0:
+			return fmt.Errorf("attempts of retry policy for %s have to be positive", v.Error)
+		case v.Backoff.Duration < 0 || v.MaxBackoff.Duration < 0 || v.Deadline.Duration < 0:
+			return fmt.Errorf("timeouts of retry policy for %s cannot be negative", v.Error)
+		}
+
+		errs[v.Error] = true
+	}
+
+	return nil
+}
+
+func (c *Config) validateListeners() error {
+	names := map[string]bool{}
+	ports := map[int]bool{c.BindPort: true}
+
+	for _, v := range c.Listeners {
+		switch {
+		case v.Name == "":
+			return fmt.Errorf("name of listener is not set")
+		case names[v.Name]:
+			return fmt.Errorf("listener %s is defined several times", v.Name)
+		case v.BindPort <= 0:
+			return fmt.Errorf("bind port of listener %s is not set", v.Name)
+		case ports[v.BindPort]:
+			return fmt.Errorf("bind port %d of listener %s is already used", v.BindPort, v.Name)
+		}
+
+		names[v.Name] = true
+		ports[v.BindPort] = true
+
+		if err := c.ForListener(v).Validate(); err != nil {
+			return fmt.Errorf("incorrect listener %s: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validateAdblock() error {
+	for _, v := range c.AdblockRules {
+		if _, err := adblock.ParseRule(v); err != nil {
+			return fmt.Errorf("incorrect adblock rule %s: %w", v, err)
+		}
+	}
+
+	for _, v := range c.AdblockAllowlist {
+		if v == "" {
+			return errors.New("adblock allowlist entry cannot be empty")
+		}
+
+		if len(v) > 2 && strings.HasPrefix(v, "/") && strings.HasSuffix(v, "/") {
+			if _, err := regexp.Compile(v[1 : len(v)-1]); err != nil {
+				return fmt.Errorf("incorrect adblock allowlist regexp: %w", err)
+			}
+		}
+	}
+
+	if !isAdblockResponse(c.AdblockResponse) {
+		return fmt.Errorf("unknown adblock response %s", c.AdblockResponse)
+	}
+
+	for _, v := range c.AdblockResponses {
+		switch {
+		case (v.List == "") == (v.Rule == ""):
+			return errors.New("adblock response has to be set either for a list or for a rule")
+		case !isAdblockResponse(v.Response):
+			return fmt.Errorf("unknown adblock response %s", v.Response)
+		}
+	}
+
+	return nil
+}
+
+func isAdblockResponse(value string) bool {
+	switch value {
+	case AdblockResponseForbidden, AdblockResponseNoContent, AdblockResponseEmpty,
+		AdblockResponseRedirect, AdblockResponseReset:
+		return true
+	}
+
+	return false
+}
+
+func (c *Config) validateTenants() error {
+	names := map[string]bool{}
+
+	for _, v := range c.Tenants {
+		switch {
+		case v.Name == "":
+			return fmt.Errorf("name of tenant is not set")
+		case names[v.Name]:
+			return fmt.Errorf("tenant %s is defined several times", v.Name)
+		case v.APIKey == "":
+			return fmt.Errorf("API key of tenant %s is not set", v.Name)
+		case len(v.ProxyUsers) > 0 && c.InboundAuthHtpasswd == "":
+			return fmt.Errorf("proxy users of tenant %s require inbound_auth_htpasswd", v.Name)
+		}
+
+		names[v.Name] = true
+
+		for _, cidr := range v.SourceCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("incorrect source CIDR of tenant %s: %w", v.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 // Parse processes incoming file handler (usually, an instance of *os.File)
 // and returns an instance of Config with fields set.
 //
@@ -222,5 +1093,33 @@ func NewConfig() *Config {
 		CrawleraHost: "proxy.zyte.com",
 		CrawleraPort: 8011, // nolint: gomnd
 		XHeaders:     map[string]string{},
+
+		UpstreamBalancing:           UpstreamBalancingRoundRobin,
+		UpstreamMaxFailures:         3,                                    // nolint: gomnd
+		UpstreamHealthCheckInterval: Duration{Duration: 10 * time.Second}, // nolint: gomnd
+
+		SessionsPerClient: 1,
+		SessionBalancing:  SessionBalancingRoundRobin,
+		SessionAffinity:   SessionAffinityClient,
+
+		SessionCreateTimeout:      Duration{Duration: 180 * time.Second}, // nolint: gomnd
+		SessionCreateRetryTimeout: Duration{Duration: 30 * time.Second},  // nolint: gomnd
+		SessionAPITimeout:         Duration{Duration: 10 * time.Second},  // nolint: gomnd
+		SessionTTL:                Duration{Duration: 5 * time.Minute},   // nolint: gomnd
+
+		RefererPolicy: RefererPolicyStripQuery,
+		RefererTTL:    Duration{Duration: 10 * time.Second}, // nolint: gomnd
+
+		ShutdownTimeout: Duration{Duration: 30 * time.Second}, // nolint: gomnd
+
+		ClientID:          ClientIDIPUserAgent,
+		ClientIDPortRange: 100, // nolint: gomnd
+
+		ErrorPages: ErrorPagesOff,
+
+		AdblockResponse: AdblockResponseForbidden,
+
+		AdblockRefreshInterval: Duration{Duration: 24 * time.Hour},   // nolint: gomnd
+		AdblockStartupTimeout:  Duration{Duration: 30 * time.Second}, // nolint: gomnd
 	}
 }
@@ -1,63 +1,133 @@
 package layers
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1" // nolint: gosec
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/9seconds/httransform/v2/layers"
 	"github.com/pmezard/adblock/adblock"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
 var errAdblockedRequest = errors.New("request was adblocked")
 
-const adblockTimeout = 2 * time.Second
+const (
+	adblockTimeout         = 2 * time.Second
+	adblockFetchTimeout    = time.Minute
+	adblockRetryBackoff    = 30 * time.Second
+	adblockMaxRetryBackoff = time.Hour
+	adblockCacheDirName    = "adblock"
+)
 
 type adblockParsedResult struct {
-	rules []*adblock.Rule
-	err   error
+	item string
+	list *adblockList
+	err  error
+}
+
+// adblockList is the latest known version of the list. ETag and
+// LastModified are validators of the downloaded list, they are used
+// to make conditional requests on refresh.
+type adblockList struct {
+	rules        []*adblock.Rule
+	etag         string
+	lastModified string
+}
+
+// adblockCacheMeta is kept on disk next to the cached list.
+type adblockCacheMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
 }
 
+// AdblockLayer blocks requests matched by adblock lists and inline
+// rules of the configuration, unless they are allowlisted. Lists are
+// refreshed periodically, downloaded lists are cached on disk so
+// headless proxy can start without network access. A new matcher is
+// swapped in atomically, requests in flight keep using the old one.
+//
+// Lists which cannot be loaded are retried with backoff. Until lists
+// are loaded for the first time, requests wait for them up to startup
+// timeout and then pass unfiltered. A layer built on configuration
+// reload takes lists already loaded by the previous one, so requests
+// do not wait again.
+//
+// Blocked requests get a response chosen by the rule or the list which
+// has blocked them: an error, an empty resource, a redirect to an empty
+// resource served by the layer itself or a reset connection.
 type AdblockLayer struct {
-	loaded  bool
-	matcher *adblock.RuleMatcher
-	cond    *sync.Cond
+	matcher         atomic.Value
+	allowlist       []*adblockAllowEntry
+	responses       *adblockResponses
+	inline          *adblockList
+	ready           chan struct{}
+	startup         context.Context
+	stopStartup     context.CancelFunc
+	metrics         *stats.Stats
+	items           []string
+	lists           atomic.Value
+	cacheDir        string
+	refreshInterval time.Duration
 }
 
 func (a *AdblockLayer) OnRequest(ctx *layers.Context) error {
-	host := ctx.RequestHeaders.GetLast("host").Value()
-	contentType := ctx.RequestHeaders.GetLast("content-type").Value()
-	referer := ctx.RequestHeaders.GetLast("referer").Value()
-	adblockRequest := &adblock.Request{
-		URL:          string(ctx.Request().URI().FullURI()),
-		Domain:       host,
-		Timeout:      adblockTimeout,
-		ContentType:  contentType,
-		OriginDomain: referer,
-	}
+	rawURL := string(ctx.Request().URI().FullURI())
+	host := string(ctx.Request().URI().Host())
 	logger := getLogger(ctx)
 
-	if !a.loaded {
-		a.cond.L.Lock()
-		for !a.loaded {
-			a.cond.Wait()
-		}
-		a.cond.L.Unlock()
+	if getAdblockHost(host) == adblockStubHost {
+		return errAdblockStubRequest
 	}
 
-	matched, _, err := a.matcher.Match(adblockRequest)
+	if entry := a.getAllowEntry(rawURL, host); entry != nil {
+		logger.WithFields(log.Fields{"allowlist": entry.raw}).Debug("Request is allowlisted")
+
+		return nil
+	}
+
+	if !a.waitLoaded(ctx) {
+		getMetrics(ctx).NewAdblockUnfilteredRequest()
+		logger.Debug("Adblock lists are not loaded, request is not filtered")
+
+		return nil
+	}
+
+	resourceType := getAdblockResourceType(rawURL,
+		ctx.RequestHeaders.GetLast("sec-fetch-dest").Value(),
+		ctx.RequestHeaders.GetLast("accept").Value(),
+		ctx.RequestHeaders.GetLast("upgrade").Value())
+	query := newAdblockQuery(rawURL, host, ctx.RequestHeaders.GetLast("referer").Value(), resourceType)
+
+	matcher := a.matcher.Load().(*adblockMatcher)
+
+	matched, include, _, err := matcher.match(query)
 	if err != nil {
 		logger.WithFields(log.Fields{"err": err}).Debug("Cannot match request.")
 	}
 
 	if matched {
+		ctx.Set(adblockLayerContextType, &adblockBlock{
+			response:     a.responses.get(matcher.rules[include].Raw, matcher.lists[include]),
+			resourceType: resourceType,
+		})
+
 		return errAdblockedRequest
 	}
 
@@ -65,11 +135,25 @@ func (a *AdblockLayer) OnRequest(ctx *layers.Context) error {
 }
 
 func (a *AdblockLayer) OnResponse(ctx *layers.Context, err error) error {
-	if err == errAdblockedRequest {
-		getMetrics(ctx).NewAdblockedRequest()
-		ctx.Respond("Request was adblocked", http.StatusForbidden)
+	switch err {
+	case errAdblockedRequest:
+		block := &adblockBlock{response: config.AdblockResponseForbidden}
+		if blockUntyped := ctx.Get(adblockLayerContextType); blockUntyped != nil {
+			block = blockUntyped.(*adblockBlock)
+		}
+
+		metrics := getMetrics(ctx)
+		metrics.NewAdblockedRequest()
+		metrics.NewAdblockedTraffic(uint64(len(ctx.Request().Header.Header()) + len(ctx.Request().Body())))
+		ctx.Set(routeLayerContextType, stats.RouteAdblocked)
+		respondAdblocked(ctx, block)
 		logger := getLogger(ctx)
-		logger.WithFields(log.Fields{}).Debug("Request was adblocked")
+		logger.WithFields(log.Fields{"response": block.response}).Debug("Request was adblocked")
+
+		return nil
+	case errAdblockStubRequest:
+		ctx.Set(routeLayerContextType, stats.RouteAdblocked)
+		respondAdblockStub(ctx, getAdblockStubType(string(ctx.Request().URI().Path())))
 
 		return nil
 	}
@@ -77,69 +161,157 @@ func (a *AdblockLayer) OnResponse(ctx *layers.Context, err error) error {
 	return err
 }
 
-func (a *AdblockLayer) sync(lists []string) {
-	channel := make(chan *adblockParsedResult, len(lists))
+// waitLoaded waits until lists are loaded for the first time. It
+// returns false if lists are not loaded before startup timeout.
+func (a *AdblockLayer) waitLoaded(ctx *layers.Context) bool {
+	select {
+	case <-a.ready:
+	case <-a.startup.Done():
+	case <-ctx.Done():
+	}
+
+	return a.isLoaded()
+}
+
+func (a *AdblockLayer) isLoaded() bool {
+	select {
+	case <-a.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// run loads lists and refreshes them until context is closed. If some
+// lists have failed to load, they are retried with backoff instead.
+func (a *AdblockLayer) run(ctx context.Context) {
+	defer a.stopStartup()
+
+	for retries := 0; ; {
+		delay := a.refreshInterval
+
+		if failed := a.sync(ctx); failed {
+			delay = getAdblockRetryBackoff(retries, a.refreshInterval)
+			retries++
+		} else {
+			retries = 0
+		}
+
+		if delay <= 0 {
+			return
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// getAdblockRetryBackoff returns a delay before the next attempt to
+// load failed lists. It doubles with each attempt, but never exceeds
+// refresh interval.
+func getAdblockRetryBackoff(retries int, refreshInterval time.Duration) time.Duration {
+	backoff := adblockRetryBackoff
+
+	for i := 0; i < retries && backoff < adblockMaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > adblockMaxRetryBackoff {
+		backoff = adblockMaxRetryBackoff
+	}
+
+	if refreshInterval > 0 && backoff > refreshInterval {
+		backoff = refreshInterval
+	}
+
+	return backoff
+}
+
+// sync loads all lists and swaps in a new matcher. It returns true if
+// some lists have failed to load.
+func (a *AdblockLayer) sync(ctx context.Context) bool {
+	channel := make(chan *adblockParsedResult, len(a.items))
 	wg := &sync.WaitGroup{}
 
-	for _, v := range lists {
+	for _, v := range a.items {
 		wg.Add(1)
 
-		go func(channel chan<- *adblockParsedResult, item string) {
+		go func(channel chan<- *adblockParsedResult, item string, current *adblockList) {
 			defer wg.Done()
-			a.fetchList(channel, item)
-		}(channel, v)
+			a.fetchList(ctx, channel, item, current)
+		}(channel, v, a.getLists()[v])
 	}
 
 	wg.Wait()
 	close(channel)
 
-	a.consumeItems(channel)
+	return a.consumeItems(channel)
 }
 
-func (a *AdblockLayer) fetchList(channel chan<- *adblockParsedResult, item string) {
-	var reader io.ReadCloser
-
-	var err error
-
-	result := &adblockParsedResult{}
+func (a *AdblockLayer) fetchList(ctx context.Context, channel chan<- *adblockParsedResult, item string, current *adblockList) {
+	result := &adblockParsedResult{item: item}
 
 	if strings.HasPrefix(item, "http://") || strings.HasPrefix(item, "https://") {
-		reader, err = a.fetchURL(item)
+		result.list, result.err = a.fetchURL(ctx, item, current)
 	} else {
-		reader, err = a.readFileSystem(item)
+		result.list, result.err = a.readFileSystem(item)
 	}
 
-	if err != nil {
-		result.err = fmt.Errorf("cannot parse rules of item %s", item)
-		channel <- result
+	channel <- result
+}
 
-		return
+// fetchURL downloads the list with a conditional request. If the list
+// was not modified, the current version is kept. If it cannot be
+// downloaded, the current version or a cached one is returned with the
+// error.
+func (a *AdblockLayer) fetchURL(ctx context.Context, url string, current *adblockList) (*adblockList, error) {
+	if current == nil {
+		current = a.readCache(url)
 	}
 
-	defer reader.Close()                  // nolint: errcheck
-	defer io.Copy(ioutil.Discard, reader) // nolint: errcheck
+	list, err := a.downloadURL(ctx, url, current)
 
-	if rules, err := adblock.ParseRules(reader); err != nil {
-		result.err = fmt.Errorf("cannot parse rules of item %s", item)
-	} else {
-		for _, rule := range rules {
-			if !rule.HasUnsupportedOpts() {
-				result.rules = append(result.rules, rule)
-			} else {
-				log.WithFields(log.Fields{
-					"rule": rule.Raw,
-				}).Debug("Skip unsupported adblock rule")
-			}
-		}
+	switch {
+	case err == nil && list == nil:
+		return current, nil
+	case err == nil:
+		a.writeCache(url, list)
+		return list, nil
 	}
 
-	channel <- result
+	return current, err
 }
 
-func (a *AdblockLayer) fetchURL(url string) (io.ReadCloser, error) {
+// downloadURL returns nil if the list is not modified since the current
+// version.
+func (a *AdblockLayer) downloadURL(ctx context.Context, url string, current *adblockList) (*adblockList, error) {
 	log.WithFields(log.Fields{"url": url}).Debug("Fetch adblock list")
 
-	resp, err := http.Get(url) // nolint: gosec, bodyclose
+	ctx, cancel := context.WithTimeout(ctx, adblockFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build request to %s: %w", url, err)
+	}
+
+	if current != nil {
+		if current.etag != "" {
+			req.Header.Set("If-None-Match", current.etag)
+		}
+
+		if current.lastModified != "" {
+			req.Header.Set("If-Modified-Since", current.lastModified)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 
 	status := ""
 	if resp != nil {
@@ -156,10 +328,28 @@ func (a *AdblockLayer) fetchURL(url string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("cannot fetch url %s: %w", url, err)
 	}
 
-	return resp.Body, nil
+	defer resp.Body.Close()                  // nolint: errcheck
+	defer io.Copy(ioutil.Discard, resp.Body) // nolint: errcheck
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && current != nil:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("cannot fetch url %s: unexpected status %s", url, resp.Status)
+	}
+
+	list, err := parseAdblockList(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse rules of item %s: %w", url, err)
+	}
+
+	list.etag = resp.Header.Get("ETag")
+	list.lastModified = resp.Header.Get("Last-Modified")
+
+	return list, nil
 }
 
-func (a *AdblockLayer) readFileSystem(path string) (io.ReadCloser, error) {
+func (a *AdblockLayer) readFileSystem(path string) (*adblockList, error) {
 	log.WithFields(log.Fields{"path": path}).Debug("Open filesystem adblock list")
 
 	fp, err := os.Open(path) // nolint: gosec
@@ -173,39 +363,257 @@ func (a *AdblockLayer) readFileSystem(path string) (io.ReadCloser, error) {
 		return nil, fmt.Errorf("cannot open file %s: %w", path, err)
 	}
 
-	return fp, nil
+	defer fp.Close() // nolint: errcheck
+
+	list, err := parseAdblockList(fp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse rules of item %s: %w", path, err)
+	}
+
+	return list, nil
 }
 
-func (a *AdblockLayer) consumeItems(channel <-chan *adblockParsedResult) {
-	rules := []*adblock.Rule{}
+// readCache returns a cached version of the list or nil if there is
+// none.
+func (a *AdblockLayer) readCache(url string) *adblockList {
+	if a.cacheDir == "" {
+		return nil
+	}
+
+	listPath, metaPath := a.cachePaths(url)
+	meta := adblockCacheMeta{}
+
+	if data, err := ioutil.ReadFile(metaPath); err != nil || json.Unmarshal(data, &meta) != nil || meta.URL != url {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(listPath)
+	if err != nil {
+		return nil
+	}
+
+	list, err := parseAdblockList(bytes.NewReader(data))
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url": url,
+			"err": err,
+		}).Warn("Cannot parse cached adblock list")
+
+		return nil
+	}
+
+	list.etag = meta.ETag
+	list.lastModified = meta.LastModified
+
+	return list
+}
+
+func (a *AdblockLayer) writeCache(url string, list *adblockList) {
+	if a.cacheDir == "" {
+		return
+	}
+
+	lines := make([]string, 0, len(list.rules))
+	for _, rule := range list.rules {
+		lines = append(lines, rule.Raw)
+	}
+
+	meta, _ := json.Marshal(adblockCacheMeta{ // nolint: errchkjson
+		URL:          url,
+		ETag:         list.etag,
+		LastModified: list.lastModified,
+	})
+	listPath, metaPath := a.cachePaths(url)
+
+	// A list is written before its metadata: metadata without a list
+	// is never used.
+	err := writeFileAtomically(listPath, []byte(strings.Join(lines, "\n")))
+	if err == nil {
+		err = writeFileAtomically(metaPath, meta)
+	}
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"url": url,
+			"err": err,
+		}).Warn("Cannot cache adblock list")
+	}
+}
+
+func (a *AdblockLayer) cachePaths(url string) (string, string) {
+	name := filepath.Join(a.cacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(url)))) // nolint: gosec
+
+	return name + ".txt", name + ".json"
+}
+
+// consumeItems builds a new matcher from loaded lists. Lists which have
+// failed to load keep their previous version, if there is any. It
+// returns true if some lists have failed.
+func (a *AdblockLayer) consumeItems(channel <-chan *adblockParsedResult) bool {
+	current := a.getLists()
+	lists := make(map[string]*adblockList, len(a.items))
+	failed := false
 
 	for item := range channel {
+		list := item.list
+		if list == nil {
+			list = current[item.item]
+		}
+
+		state := stats.AdblockListLoaded
+
 		if item.err != nil {
-			log.Fatal(item.err.Error())
+			failed = true
+			state = stats.AdblockListStale
+
+			if list == nil {
+				state = stats.AdblockListFailed
+			}
+
+			log.WithFields(log.Fields{
+				"list":  item.item,
+				"err":   item.err,
+				"state": state,
+			}).Warn("Cannot load adblock list")
+		}
+
+		rules := 0
+		if list != nil {
+			lists[item.item] = list
+			rules = len(list.rules)
 		}
 
-		rules = append(rules, item.rules...)
+		a.metrics.SetAdblockListState(item.item, state, rules, item.err)
 	}
 
-	a.cond.L.Lock()
-	defer a.cond.L.Unlock()
+	matcher := a.newMatcher(lists)
 
-	for idx, value := range rules {
-		if err := a.matcher.AddRule(value, idx); err != nil {
-			log.Warnf("Cannot add rule '%s': %s", value.Raw, err.Error())
+	a.lists.Store(lists)
+	a.matcher.Store(matcher)
+
+	if a.isLoaded() {
+		log.WithFields(log.Fields{"rules": matcher.size()}).Debug("Adblock lists are refreshed")
+	} else {
+		log.WithFields(log.Fields{"rules": matcher.size()}).Debug("Adblock lists are loaded")
+		close(a.ready)
+	}
+
+	return failed
+}
+
+// newMatcher builds a matcher from loaded lists and inline rules.
+func (a *AdblockLayer) newMatcher(lists map[string]*adblockList) *adblockMatcher {
+	matcher := newAdblockMatcher()
+
+	for _, v := range a.items {
+		if lists[v] != nil {
+			a.addRules(matcher, v, lists[v])
+		}
+	}
+
+	if a.inline != nil {
+		a.addRules(matcher, adblockInlineRules, a.inline)
+	}
+
+	return matcher
+}
+
+// getLists returns the latest loaded versions of lists. The map is
+// never modified once stored.
+func (a *AdblockLayer) getLists() map[string]*adblockList {
+	return a.lists.Load().(map[string]*adblockList)
+}
+
+// inherit takes lists loaded by the previous layer. If they were
+// loaded, the layer filters requests with them right away, lists which
+// were not configured before are added once they are loaded. Otherwise
+// requests wait for lists not longer than for the previous layer.
+func (a *AdblockLayer) inherit(ctx context.Context, previous *AdblockLayer) {
+	if !previous.isLoaded() {
+		if deadline, ok := previous.startup.Deadline(); ok {
+			a.stopStartup()
+			a.startup, a.stopStartup = context.WithDeadline(ctx, deadline)
+		}
+
+		return
+	}
+
+	previousLists := previous.getLists()
+	lists := make(map[string]*adblockList, len(a.items))
+
+	for _, v := range a.items {
+		if list, ok := previousLists[v]; ok {
+			lists[v] = list
 		}
 	}
 
-	a.loaded = true
-	a.cond.Broadcast()
+	a.lists.Store(lists)
+	a.matcher.Store(a.newMatcher(lists))
+	close(a.ready)
 }
 
-func NewAdblockLayer(lists []string) layers.Layer {
+func (a *AdblockLayer) addRules(matcher *adblockMatcher, name string, list *adblockList) {
+	for _, rule := range list.rules {
+		if err := matcher.add(name, rule); err != nil {
+			log.Warnf("Cannot add rule '%s': %s", rule.Raw, err.Error())
+		}
+	}
+}
+
+func parseAdblockList(reader io.Reader) (*adblockList, error) {
+	rules, err := adblock.ParseRules(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &adblockList{}
+
+	for _, rule := range rules {
+		if isAdblockRuleSupported(rule) {
+			list.rules = append(list.rules, rule)
+		} else {
+			log.WithFields(log.Fields{
+				"rule": rule.Raw,
+			}).Debug("Skip unsupported adblock rule")
+		}
+	}
+
+	return list, nil
+}
+
+// NewAdblockLayer returns a layer which blocks requests matched by
+// adblock lists and rules of the configuration, except for allowlisted
+// ones. Lists are loaded in background and refreshed until context is
+// closed. If state directory is set, downloaded lists are cached there.
+// Load state of lists is reported to metrics. If previous layer is not
+// nil, lists it has loaded are used until they are refreshed.
+func NewAdblockLayer(ctx context.Context, conf *config.Config, metrics *stats.Stats, previous *AdblockLayer) layers.Layer {
 	layer := &AdblockLayer{
-		cond:    sync.NewCond(&sync.Mutex{}),
-		matcher: adblock.NewMatcher(),
+		ready:           make(chan struct{}),
+		metrics:         metrics,
+		allowlist:       newAdblockAllowlist(conf.AdblockAllowlist),
+		responses:       newAdblockResponses(conf),
+		items:           conf.AdblockLists,
+		refreshInterval: conf.AdblockRefreshInterval.Duration,
+	}
+	layer.lists.Store(map[string]*adblockList{})
+	layer.matcher.Store(newAdblockMatcher())
+	layer.startup, layer.stopStartup = context.WithTimeout(ctx, conf.AdblockStartupTimeout.Duration)
+	metrics.SetAdblockLists(conf.AdblockLists)
+
+	if len(conf.AdblockRules) > 0 {
+		layer.inline = parseAdblockRules(conf.AdblockRules)
 	}
-	go layer.sync(lists)
+
+	if conf.StateDir != "" {
+		layer.cacheDir = filepath.Join(conf.StateDir, adblockCacheDirName)
+	}
+
+	if previous != nil {
+		layer.inherit(ctx, previous)
+	}
+
+	go layer.run(ctx)
 
 	return layer
 }
@@ -0,0 +1,374 @@
+package layers
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/pmezard/adblock/adblock"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+// adblockInlineRules is a name of the list of adblock rules set in the
+// configuration.
+const adblockInlineRules = "adblock_rules"
+
+// adblockRuleGroup is a set of rules which apply to the same types of
+// resources. Type options are stripped from rules of the group, so
+// the matcher of adblock rules checks only URL, $domain and
+// $third-party options.
+type adblockRuleGroup struct {
+	types   adblockResourceType
+	matcher *adblock.RuleMatcher
+}
+
+// adblockMatcher matches requests against rules of all adblock lists.
+// Blocking and exception rules are kept apart, so exception rules
+// apply to requests of all types they have. Exception rules with
+// $document option allow all requests made from matching pages.
+//
+// IDs of rules start from 1, so a rule which has matched can be told
+// from no match at all.
+type adblockMatcher struct {
+	includes   []*adblockRuleGroup
+	exceptions []*adblockRuleGroup
+	documents  *adblock.RuleMatcher
+	rules      []*adblock.Rule
+	lists      []string
+}
+
+func (m *adblockMatcher) add(list string, rule *adblock.Rule) error {
+	if !isAdblockRuleSupported(rule) {
+		return errors.New("rule options are not supported")
+	}
+
+	types := getAdblockRuleTypes(&rule.Opts)
+	if types == 0 {
+		return errors.New("rule does not apply to any resource type")
+	}
+
+	stripped := *rule
+	stripped.Exception = false
+	stripped.Opts = adblock.RuleOpts{
+		Raw:        rule.Opts.Raw,
+		Domains:    rule.Opts.Domains,
+		ThirdParty: rule.Opts.ThirdParty,
+	}
+
+	var err error
+
+	switch {
+	case rule.Exception && rule.Opts.Document:
+		err = m.documents.AddRule(&stripped, len(m.rules))
+	case rule.Exception:
+		err = getAdblockRuleGroup(&m.exceptions, types).matcher.AddRule(&stripped, len(m.rules))
+	default:
+		err = getAdblockRuleGroup(&m.includes, types).matcher.AddRule(&stripped, len(m.rules))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	m.rules = append(m.rules, rule)
+	m.lists = append(m.lists, list)
+
+	return nil
+}
+
+func (m *adblockMatcher) size() int {
+	return len(m.rules) - 1
+}
+
+// match returns if the request is blocked, ID of the blocking rule
+// which has matched and ID of the exception rule which has allowed the
+// request.
+func (m *adblockMatcher) match(query *adblockQuery) (bool, int, int, error) {
+	include, err := matchAdblockRuleGroups(m.includes, query)
+	if include == 0 || err != nil {
+		return false, include, 0, err
+	}
+
+	exception, err := matchAdblockRuleGroups(m.exceptions, query)
+	if exception == 0 && err == nil {
+		exception, err = m.matchPage(query)
+	}
+
+	if err != nil {
+		return false, include, exception, err
+	}
+
+	return exception == 0, include, exception, nil
+}
+
+// matchPage matches a page the request was made from against exception
+// rules with $document option. Requests for documents are pages
+// themselves.
+func (m *adblockMatcher) matchPage(query *adblockQuery) (int, error) {
+	pages := []string{query.page}
+	if query.resourceType == adblockTypeDocument {
+		pages = append(pages, query.request.URL)
+	}
+
+	for _, page := range pages {
+		parsed, err := url.Parse(page)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+
+		host := getAdblockHost(parsed.Host)
+
+		matched, id, err := m.documents.Match(&adblock.Request{
+			URL:          page,
+			Domain:       host,
+			OriginDomain: host,
+			Timeout:      adblockTimeout,
+		})
+		if matched || err != nil {
+			return id, err
+		}
+	}
+
+	return 0, nil
+}
+
+func newAdblockMatcher() *adblockMatcher {
+	return &adblockMatcher{
+		documents: adblock.NewMatcher(),
+		rules:     []*adblock.Rule{nil},
+		lists:     []string{""},
+	}
+}
+
+func getAdblockRuleGroup(groups *[]*adblockRuleGroup, types adblockResourceType) *adblockRuleGroup {
+	for _, v := range *groups {
+		if v.types == types {
+			return v
+		}
+	}
+
+	group := &adblockRuleGroup{
+		types:   types,
+		matcher: adblock.NewMatcher(),
+	}
+	*groups = append(*groups, group)
+
+	return group
+}
+
+func matchAdblockRuleGroups(groups []*adblockRuleGroup, query *adblockQuery) (int, error) {
+	for _, v := range groups {
+		if v.types&query.resourceType == 0 {
+			continue
+		}
+
+		matched, id, err := v.matcher.Match(&query.request)
+		if err != nil {
+			return 0, err
+		}
+
+		if matched {
+			return id, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// getAdblockRuleTypes returns types of resources the rule applies to.
+// Rules without type options apply to all of them, rules with inverse
+// options only ($~script) apply to all but given ones.
+func getAdblockRuleTypes(opts *adblock.RuleOpts) adblockResourceType {
+	var included, excluded adblockResourceType
+
+	if opts.Document {
+		included |= adblockTypeDocument
+	}
+
+	for _, v := range []struct {
+		value        *bool
+		resourceType adblockResourceType
+	}{
+		{opts.SubDocument, adblockTypeSubdocument},
+		{opts.Script, adblockTypeScript},
+		{opts.Image, adblockTypeImage},
+		{opts.Stylesheet, adblockTypeStylesheet},
+		{opts.Font, adblockTypeFont},
+		{opts.Media, adblockTypeMedia},
+		{opts.Object, adblockTypeObject},
+		{opts.ObjectSubRequest, adblockTypeObject},
+		{opts.XmlHttpRequest, adblockTypeXMLHTTPRequest},
+		{opts.Websocket, adblockTypeWebsocket},
+		{opts.Ping, adblockTypePing},
+		{opts.Other, adblockTypeOther},
+	} {
+		switch {
+		case v.value == nil:
+		case *v.value:
+			included |= v.resourceType
+		default:
+			excluded |= v.resourceType
+		}
+	}
+
+	if included == 0 {
+		included = adblockTypeAll
+	}
+
+	return included &^ excluded
+}
+
+// isAdblockRuleSupported tells if the rule can be applied to requests.
+// Element hiding options are for browsers, popups and WebRTC connections
+// cannot be seen by a proxy. $genericblock needs to know domains of all
+// the rules of a page.
+func isAdblockRuleSupported(rule *adblock.Rule) bool {
+	opts := &rule.Opts
+
+	return !opts.ElemHide && !opts.GenericHide && !opts.GenericBlock &&
+		(opts.Popup == nil || !*opts.Popup) &&
+		(opts.WebRTC == nil || !*opts.WebRTC)
+}
+
+// adblockAllowEntry is an entry of adblock allowlist. Entries wrapped
+// into slashes are regular expressions matching URLs, others are hosts
+// matching themselves and their subdomains.
+type adblockAllowEntry struct {
+	raw    string
+	host   string
+	regexp *regexp.Regexp
+}
+
+func (e *adblockAllowEntry) match(rawURL, host string) bool {
+	if e.regexp != nil {
+		return e.regexp.MatchString(rawURL)
+	}
+
+	return host == e.host || strings.HasSuffix(host, "."+e.host)
+}
+
+func newAdblockAllowlist(entries []string) []*adblockAllowEntry {
+	allowlist := make([]*adblockAllowEntry, 0, len(entries))
+
+	for _, v := range entries {
+		entry := &adblockAllowEntry{raw: v}
+
+		if len(v) > 2 && strings.HasPrefix(v, "/") && strings.HasSuffix(v, "/") {
+			entry.regexp = regexp.MustCompile(v[1 : len(v)-1])
+		} else {
+			entry.host = strings.ToLower(strings.TrimSuffix(v, "."))
+		}
+
+		allowlist = append(allowlist, entry)
+	}
+
+	return allowlist
+}
+
+// getAdblockHost returns a lowercased host of URL without port.
+func getAdblockHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// parseAdblockRules parses adblock rules set in the configuration.
+// Unsupported rules are skipped.
+func parseAdblockRules(lines []string) *adblockList {
+	list := &adblockList{}
+
+	for _, v := range lines {
+		rule, err := adblock.ParseRule(v)
+
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{
+				"rule": v,
+				"err":  err,
+			}).Warn("Cannot parse adblock rule")
+		case rule == nil:
+		case !isAdblockRuleSupported(rule):
+			log.WithFields(log.Fields{
+				"rule": v,
+			}).Warn("Skip unsupported adblock rule")
+		default:
+			list.rules = append(list.rules, rule)
+		}
+	}
+
+	return list
+}
+
+// Test reports how adblock lists treat the request to the URL with the
+// referer: if it is blocked and which rule or allowlist entry is
+// responsible for that. A type of the resource is inferred from the
+// URL.
+func (a *AdblockLayer) Test(rawURL, referer string) (stats.AdblockTestResult, error) {
+	result := stats.AdblockTestResult{URL: rawURL}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return result, fmt.Errorf("incorrect URL %s", rawURL)
+	}
+
+	resourceType := getAdblockResourceType(rawURL, "", "", "")
+	result.ResourceType = resourceType.String()
+
+	if entry := a.getAllowEntry(rawURL, parsed.Host); entry != nil {
+		result.Reason = stats.AdblockTestAllowlisted
+		result.Allowlist = entry.raw
+
+		return result, nil
+	}
+
+	if !a.isLoaded() {
+		result.Reason = stats.AdblockTestNotLoaded
+
+		return result, nil
+	}
+
+	matcher := a.matcher.Load().(*adblockMatcher)
+
+	blocked, include, exception, err := matcher.match(newAdblockQuery(rawURL, parsed.Host, referer, resourceType))
+	if err != nil {
+		return result, fmt.Errorf("cannot match URL: %w", err)
+	}
+
+	switch {
+	case blocked:
+		result.Blocked = true
+		result.Reason = stats.AdblockTestBlocked
+		result.Response = a.responses.get(matcher.rules[include].Raw, matcher.lists[include])
+	case include > 0:
+		result.Reason = stats.AdblockTestException
+		result.Exception = matcher.rules[exception].Raw
+	default:
+		result.Reason = stats.AdblockTestNotMatched
+
+		return result, nil
+	}
+
+	result.Rule = matcher.rules[include].Raw
+	result.List = matcher.lists[include]
+
+	return result, nil
+}
+
+func (a *AdblockLayer) getAllowEntry(rawURL, host string) *adblockAllowEntry {
+	host = getAdblockHost(host)
+
+	for _, v := range a.allowlist {
+		if v.match(rawURL, host) {
+			return v
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package layers
+
+import (
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pmezard/adblock/adblock"
+)
+
+// adblockResourceType is a set of types of resources. Rules with type
+// options ($script, $image, ...) apply only to requests of these types.
+type adblockResourceType uint16
+
+const (
+	adblockTypeDocument adblockResourceType = 1 << iota
+	adblockTypeSubdocument
+	adblockTypeScript
+	adblockTypeImage
+	adblockTypeStylesheet
+	adblockTypeFont
+	adblockTypeMedia
+	adblockTypeObject
+	adblockTypeXMLHTTPRequest
+	adblockTypeWebsocket
+	adblockTypePing
+	adblockTypeOther
+
+	adblockTypeAll = adblockTypeOther<<1 - 1
+)
+
+var adblockTypeNames = map[adblockResourceType]string{ // nolint: gochecknoglobals
+	adblockTypeDocument:       "document",
+	adblockTypeSubdocument:    "subdocument",
+	adblockTypeScript:         "script",
+	adblockTypeImage:          "image",
+	adblockTypeStylesheet:     "stylesheet",
+	adblockTypeFont:           "font",
+	adblockTypeMedia:          "media",
+	adblockTypeObject:         "object",
+	adblockTypeXMLHTTPRequest: "xmlhttprequest",
+	adblockTypeWebsocket:      "websocket",
+	adblockTypePing:           "ping",
+	adblockTypeOther:          "other",
+}
+
+// adblockFetchDests maps values of Sec-Fetch-Dest header to resource
+// types. An empty destination is used by fetch, XHR and beacons.
+var adblockFetchDests = map[string]adblockResourceType{ // nolint: gochecknoglobals
+	"document":      adblockTypeDocument,
+	"iframe":        adblockTypeSubdocument,
+	"frame":         adblockTypeSubdocument,
+	"script":        adblockTypeScript,
+	"worker":        adblockTypeScript,
+	"sharedworker":  adblockTypeScript,
+	"serviceworker": adblockTypeScript,
+	"audioworklet":  adblockTypeScript,
+	"paintworklet":  adblockTypeScript,
+	"image":         adblockTypeImage,
+	"style":         adblockTypeStylesheet,
+	"xslt":          adblockTypeStylesheet,
+	"font":          adblockTypeFont,
+	"audio":         adblockTypeMedia,
+	"video":         adblockTypeMedia,
+	"track":         adblockTypeMedia,
+	"object":        adblockTypeObject,
+	"embed":         adblockTypeObject,
+	"empty":         adblockTypeXMLHTTPRequest,
+}
+
+// adblockAcceptTypes maps prefixes of Accept header to resource types.
+// Only the first media range is considered, browsers put the most
+// specific one there.
+var adblockAcceptTypes = []struct { // nolint: gochecknoglobals
+	prefix       string
+	resourceType adblockResourceType
+}{
+	{"text/html", adblockTypeDocument},
+	{"application/xhtml+xml", adblockTypeDocument},
+	{"text/css", adblockTypeStylesheet},
+	{"image/", adblockTypeImage},
+	{"application/javascript", adblockTypeScript},
+	{"text/javascript", adblockTypeScript},
+	{"font/", adblockTypeFont},
+	{"audio/", adblockTypeMedia},
+	{"video/", adblockTypeMedia},
+	{"application/json", adblockTypeXMLHTTPRequest},
+}
+
+var adblockExtensionTypes = map[string]adblockResourceType{ // nolint: gochecknoglobals
+	".html":  adblockTypeDocument,
+	".htm":   adblockTypeDocument,
+	".js":    adblockTypeScript,
+	".mjs":   adblockTypeScript,
+	".css":   adblockTypeStylesheet,
+	".png":   adblockTypeImage,
+	".jpg":   adblockTypeImage,
+	".jpeg":  adblockTypeImage,
+	".gif":   adblockTypeImage,
+	".webp":  adblockTypeImage,
+	".avif":  adblockTypeImage,
+	".svg":   adblockTypeImage,
+	".ico":   adblockTypeImage,
+	".bmp":   adblockTypeImage,
+	".woff":  adblockTypeFont,
+	".woff2": adblockTypeFont,
+	".ttf":   adblockTypeFont,
+	".otf":   adblockTypeFont,
+	".eot":   adblockTypeFont,
+	".mp3":   adblockTypeMedia,
+	".mp4":   adblockTypeMedia,
+	".m4a":   adblockTypeMedia,
+	".ogg":   adblockTypeMedia,
+	".wav":   adblockTypeMedia,
+	".webm":  adblockTypeMedia,
+	".m3u8":  adblockTypeMedia,
+	".swf":   adblockTypeObject,
+}
+
+func (t adblockResourceType) String() string {
+	if name, ok := adblockTypeNames[t]; ok {
+		return name
+	}
+
+	return adblockTypeNames[adblockTypeOther]
+}
+
+// adblockQuery is a request to match against adblock rules.
+type adblockQuery struct {
+	request      adblock.Request
+	page         string
+	resourceType adblockResourceType
+}
+
+// getAdblockResourceType infers a type of the requested resource.
+// Sec-Fetch-Dest header is the most reliable source, then Accept header
+// and extension of the URL path are used.
+func getAdblockResourceType(rawURL, fetchDest, accept, upgrade string) adblockResourceType {
+	if strings.EqualFold(upgrade, "websocket") {
+		return adblockTypeWebsocket
+	}
+
+	if value, ok := adblockFetchDests[strings.ToLower(fetchDest)]; ok {
+		return value
+	}
+
+	accept = strings.ToLower(strings.TrimSpace(accept))
+	for _, v := range adblockAcceptTypes {
+		if strings.HasPrefix(accept, v.prefix) {
+			return v.resourceType
+		}
+	}
+
+	if parsed, err := url.Parse(rawURL); err == nil {
+		if value, ok := adblockExtensionTypes[strings.ToLower(path.Ext(parsed.Path))]; ok {
+			return value
+		}
+	}
+
+	return adblockTypeOther
+}
+
+// newAdblockQuery returns a query for the request to the URL made from
+// the referer page. A request without referer is considered to be made
+// by the page of its own host.
+//
+// Matcher of adblock rules uses origin domain both for $domain option
+// and to detect third-party requests, but it compares hosts, not
+// registrable domains. So a domain of first-party request is set to
+// its origin.
+func newAdblockQuery(rawURL, host, referer string, resourceType adblockResourceType) *adblockQuery {
+	host = getAdblockHost(host)
+	origin := host
+
+	if referer != "" && !strings.Contains(referer, "://") {
+		referer = "http://" + referer
+	}
+
+	if parsed, err := url.Parse(referer); err == nil && parsed.Host != "" {
+		origin = getAdblockHost(parsed.Host)
+	} else {
+		referer = ""
+	}
+
+	domain := host
+	if getRegistrableDomain(host) == getRegistrableDomain(origin) {
+		domain = origin
+	}
+
+	return &adblockQuery{
+		request: adblock.Request{
+			URL:          rawURL,
+			Domain:       domain,
+			OriginDomain: origin,
+			Timeout:      adblockTimeout,
+		},
+		page:         referer,
+		resourceType: resourceType,
+	}
+}
@@ -0,0 +1,161 @@
+package layers
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/9seconds/httransform/v2/layers"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+// adblockStubHost is a host of empty resources adblocked requests are
+// redirected to. Requests to this host are answered by headless proxy
+// itself and never go further.
+const adblockStubHost = "adblock-stub.headless-proxy.invalid"
+
+var (
+	errAdblockStubRequest = errors.New("request for adblock stub")
+	errAdblockReset       = errors.New("connection is closed without response")
+)
+
+// adblockEmptyGIF is a transparent 1x1 GIF image.
+var adblockEmptyGIF = []byte{ // nolint: gochecknoglobals
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// adblockStub is an empty resource of some type.
+type adblockStub struct {
+	extension   string
+	contentType string
+	body        []byte
+}
+
+var adblockStubs = map[adblockResourceType]adblockStub{ // nolint: gochecknoglobals
+	adblockTypeDocument:       {".html", "text/html; charset=utf-8", nil},
+	adblockTypeSubdocument:    {".html", "text/html; charset=utf-8", nil},
+	adblockTypeScript:         {".js", "application/javascript", nil},
+	adblockTypeStylesheet:     {".css", "text/css", nil},
+	adblockTypeImage:          {".gif", "image/gif", adblockEmptyGIF},
+	adblockTypeXMLHTTPRequest: {"", "text/plain; charset=utf-8", nil},
+}
+
+// adblockBlock is a decision about adblocked request: how to respond to
+// it and a type of the requested resource.
+type adblockBlock struct {
+	response     string
+	resourceType adblockResourceType
+}
+
+// adblockResetReader is a body of responses which have to drop the
+// connection. Layers have no access to the client connection, so it
+// cannot be reset for real. Instead, a server fails to write the body
+// and closes the connection while the response is still in its buffer,
+// so the client gets no response at all. For tunneled requests the whole
+// tunnel is closed.
+type adblockResetReader struct{}
+
+func (adblockResetReader) Read([]byte) (int, error) {
+	return 0, errAdblockReset
+}
+
+// adblockResponses chooses how to respond to adblocked requests: by the
+// rule which has blocked it, by the list of this rule or by default.
+type adblockResponses struct {
+	defaultResponse string
+	rules           map[string]string
+	lists           map[string]string
+}
+
+func (a *adblockResponses) get(rule, list string) string {
+	if value, ok := a.rules[rule]; ok {
+		return value
+	}
+
+	if value, ok := a.lists[list]; ok {
+		return value
+	}
+
+	return a.defaultResponse
+}
+
+func newAdblockResponses(conf *config.Config) *adblockResponses {
+	responses := &adblockResponses{
+		defaultResponse: conf.AdblockResponse,
+		rules:           map[string]string{},
+		lists:           map[string]string{},
+	}
+
+	for _, v := range conf.AdblockResponses {
+		if v.Rule != "" {
+			responses.rules[v.Rule] = v.Response
+		} else {
+			responses.lists[v.List] = v.Response
+		}
+	}
+
+	return responses
+}
+
+func respondAdblocked(ctx *layers.Context, block *adblockBlock) {
+	switch block.response {
+	case config.AdblockResponseNoContent:
+		ctx.Respond("", http.StatusNoContent)
+	case config.AdblockResponseEmpty:
+		respondAdblockStub(ctx, block.resourceType)
+	case config.AdblockResponseRedirect:
+		ctx.Respond("", http.StatusTemporaryRedirect)
+		ctx.ResponseHeaders.Set("Location", getAdblockStubURL(ctx, block.resourceType), true)
+	case config.AdblockResponseReset:
+		ctx.Respond("", http.StatusForbidden)
+		ctx.Response().SetBodyStream(adblockResetReader{}, -1)
+	default:
+		ctx.Respond("Request was adblocked", http.StatusForbidden)
+	}
+}
+
+func respondAdblockStub(ctx *layers.Context, resourceType adblockResourceType) {
+	stub, ok := adblockStubs[resourceType]
+	if !ok {
+		stub.contentType = "application/octet-stream"
+	}
+
+	ctx.Respond("", http.StatusOK)
+	ctx.Response().SetBody(stub.body)
+	ctx.ResponseHeaders.Set("Content-Type", stub.contentType, true)
+	ctx.ResponseHeaders.Set("Content-Length", strconv.Itoa(len(stub.body)), true)
+	ctx.ResponseHeaders.Set("Access-Control-Allow-Origin", "*", true)
+	ctx.ResponseHeaders.Set("Cache-Control", "max-age=86400", true)
+}
+
+// getAdblockStubURL returns URL of the empty resource of the type. A
+// scheme of the request is kept, so pages served over HTTPS do not get
+// mixed content.
+func getAdblockStubURL(ctx *layers.Context, resourceType adblockResourceType) string {
+	scheme := string(ctx.Request().URI().Scheme())
+	if scheme != "https" {
+		scheme = "http"
+	}
+
+	return scheme + "://" + adblockStubHost + "/" + resourceType.String() + adblockStubs[resourceType].extension
+}
+
+// getAdblockStubType returns a type of the empty resource by path of
+// its URL.
+func getAdblockStubType(stubPath string) adblockResourceType {
+	name := strings.TrimSuffix(path.Base(stubPath), path.Ext(stubPath))
+
+	for k, v := range adblockTypeNames {
+		if v == name {
+			return k
+		}
+	}
+
+	return adblockTypeOther
+}
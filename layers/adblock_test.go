@@ -1,20 +1,33 @@
 package layers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/9seconds/httransform/v2/layers"
 	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
 	gock "gopkg.in/h2non/gock.v1"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
 type AdblockLayerTestSuite struct {
 	CommonLayerTestSuite
 
-	lists []string
-	layer *AdblockLayer
+	conf    *config.Config
+	metrics *stats.Stats
+	lists   []string
+	layer   *AdblockLayer
 }
 
 func (suite *AdblockLayerTestSuite) SetupTest() {
@@ -25,16 +38,22 @@ func (suite *AdblockLayerTestSuite) SetupTest() {
 		BodyString("ad_code=")
 
 	suite.lists = []string{"https://scrapinghub.com/testlist.txt"}
-	suite.layer = NewAdblockLayer(suite.lists).(*AdblockLayer)
+	suite.conf = config.NewConfig()
+	suite.conf.AdblockLists = suite.lists
+	suite.metrics = getMetrics(suite.ctx)
+	suite.layer = NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
 }
 
 func (suite *AdblockLayerTestSuite) TearDownTest() {
+	// The list of the suite layer can still be downloading in tests
+	// which use other layers, it must not take mocks of the next test.
+	<-suite.layer.ready
 	gock.Off()
 }
 
 func (suite *AdblockLayerTestSuite) TestPass() {
-	time.Sleep(10 * time.Millisecond)
-	suite.True(suite.layer.loaded)
+	<-suite.layer.ready
+	suite.True(suite.layer.isLoaded())
 
 	suite.ctx.RequestHeaders.Set("host", "scrapinghub.com", true)
 	suite.ctx.Request().SetRequestURI("https://scrapinghub.com/testlist.txt")
@@ -42,30 +61,487 @@ func (suite *AdblockLayerTestSuite) TestPass() {
 }
 
 func (suite *AdblockLayerTestSuite) TestPassOnResponse() {
-	time.Sleep(10 * time.Millisecond)
-	suite.True(suite.layer.loaded)
+	<-suite.layer.ready
+	suite.True(suite.layer.isLoaded())
 
 	suite.layer.OnResponse(suite.ctx, errors.New("Unexpected")) // nolint:errcheck
 	suite.Equal(suite.ctx.Response().StatusCode(), http.StatusOK)
 }
 
 func (suite *AdblockLayerTestSuite) TestDontPassOnResponse() {
-	time.Sleep(10 * time.Millisecond)
-	suite.True(suite.layer.loaded)
+	<-suite.layer.ready
+	suite.True(suite.layer.isLoaded())
 
 	suite.layer.OnResponse(suite.ctx, errAdblockedRequest) // nolint:errcheck
 	suite.NotEqual(suite.ctx.Response().StatusCode(), http.StatusOK)
 }
 
 func (suite *AdblockLayerTestSuite) TestDontPass() {
-	time.Sleep(10 * time.Millisecond)
-	suite.True(suite.layer.loaded)
+	<-suite.layer.ready
+	suite.True(suite.layer.isLoaded())
 
 	suite.ctx.RequestHeaders.Set("host", "scrapinghub.com", true)
 	suite.ctx.Request().SetRequestURI("https://scrapinghub.com/testlist.txt/?ad_code=111")
 	suite.Equal(suite.layer.OnRequest(suite.ctx), errAdblockedRequest)
 }
 
+func (suite *AdblockLayerTestSuite) isBlocked(layer *AdblockLayer, url string) bool {
+	suite.ctx.RequestHeaders.Set("host", "scrapinghub.com", true)
+	suite.ctx.Request().SetRequestURI(url)
+
+	return layer.OnRequest(suite.ctx) == errAdblockedRequest
+}
+
+func (suite *AdblockLayerTestSuite) TestRefresh() {
+	<-suite.layer.ready
+
+	gock.New("https://scrapinghub.com/testlist.txt").
+		Get("/").
+		Reply(200).
+		SetHeader("ETag", `"v2"`).
+		BodyString("tracker_code=")
+
+	suite.layer.sync(context.Background())
+	suite.True(suite.isBlocked(suite.layer, "https://scrapinghub.com/?tracker_code=1"))
+	suite.False(suite.isBlocked(suite.layer, "https://scrapinghub.com/?ad_code=1"))
+
+	gock.New("https://scrapinghub.com/testlist.txt").
+		Get("/").
+		MatchHeader("If-None-Match", `"v2"`).
+		Reply(http.StatusNotModified)
+
+	suite.layer.sync(context.Background())
+	suite.True(gock.IsDone())
+	suite.True(suite.isBlocked(suite.layer, "https://scrapinghub.com/?tracker_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestRefreshFailed() {
+	<-suite.layer.ready
+
+	gock.New("https://scrapinghub.com/testlist.txt").
+		Get("/").
+		Reply(http.StatusInternalServerError)
+
+	suite.layer.sync(context.Background())
+	suite.True(suite.isBlocked(suite.layer, "https://scrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestCache() {
+	// gock mocks must not be changed while the suite layer downloads
+	// its list.
+	<-suite.layer.ready
+
+	dir, err := ioutil.TempDir("", "adblock")
+	suite.NoError(err)
+
+	defer os.RemoveAll(dir)
+
+	suite.conf.StateDir = dir
+	suite.conf.AdblockLists = []string{"https://scrapinghub.com/cachedlist.txt"}
+	gock.New("https://scrapinghub.com/cachedlist.txt").
+		Get("/").
+		Reply(200).
+		SetHeader("ETag", `"v1"`).
+		BodyString("ad_code=")
+
+	<-NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer).ready
+
+	gock.Off()
+	gock.New("https://scrapinghub.com/cachedlist.txt").
+		Get("/").
+		MatchHeader("If-None-Match", `"v1"`).
+		Reply(http.StatusNotModified)
+
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+	<-layer.ready
+
+	suite.True(layer.isLoaded())
+	suite.True(gock.IsDone())
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+
+	gock.New("https://scrapinghub.com/cachedlist.txt").
+		Get("/").
+		Reply(http.StatusServiceUnavailable)
+
+	layer = NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+	<-layer.ready
+
+	suite.True(layer.isLoaded())
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) adblockStats() map[string]interface{} {
+	encoded, err := json.Marshal(suite.metrics.Adblock)
+	suite.NoError(err)
+
+	value := map[string]interface{}{}
+	suite.NoError(json.Unmarshal(encoded, &value))
+
+	return value
+}
+
+func (suite *AdblockLayerTestSuite) TestStats() {
+	<-suite.layer.ready
+
+	value := suite.adblockStats()
+	suite.EqualValues(1, value["rules"])
+
+	list := value["lists"].(map[string]interface{})["https://scrapinghub.com/testlist.txt"].(map[string]interface{})
+	suite.Equal(stats.AdblockListLoaded, list["state"])
+	suite.EqualValues(0, list["errors"])
+}
+
+func (suite *AdblockLayerTestSuite) TestFailedList() {
+	suite.conf.AdblockLists = []string{"/nonexistent/list.txt"}
+
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+	<-layer.ready
+
+	suite.True(layer.isLoaded())
+	suite.False(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+
+	list := suite.adblockStats()["lists"].(map[string]interface{})["/nonexistent/list.txt"].(map[string]interface{})
+	suite.Equal(stats.AdblockListFailed, list["state"])
+	suite.EqualValues(1, list["errors"])
+	suite.NotEmpty(list["last_error"])
+}
+
+func (suite *AdblockLayerTestSuite) TestStartupTimeout() {
+	<-suite.layer.ready
+
+	suite.conf.AdblockLists = []string{"https://scrapinghub.com/slowlist.txt"}
+	suite.conf.AdblockStartupTimeout.Duration = 10 * time.Millisecond
+
+	gock.New("https://scrapinghub.com/slowlist.txt").
+		Get("/").
+		Reply(200).
+		Delay(100 * time.Millisecond).
+		BodyString("ad_code=")
+
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+
+	suite.False(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+	suite.EqualValues(1, suite.adblockStats()["unfiltered_requests"])
+
+	<-layer.ready
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestReload() {
+	<-suite.layer.ready
+
+	suite.conf.AdblockLists = []string{"https://scrapinghub.com/testlist.txt", "https://scrapinghub.com/newlist.txt"}
+	suite.conf.AdblockStartupTimeout.Duration = time.Minute
+
+	gock.New("https://scrapinghub.com/testlist.txt").
+		Get("/").
+		Reply(200).
+		BodyString("ad_code=")
+	gock.New("https://scrapinghub.com/newlist.txt").
+		Get("/").
+		Reply(200).
+		Delay(100 * time.Millisecond).
+		BodyString("tracker_code=")
+
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, suite.layer).(*AdblockLayer)
+
+	suite.True(layer.isLoaded())
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+	suite.False(suite.isBlocked(layer, "https://scrapinghub.com/?tracker_code=1"))
+
+	lists := suite.adblockStats()["lists"].(map[string]interface{})
+	suite.Equal(stats.AdblockListLoaded, lists["https://scrapinghub.com/testlist.txt"].(map[string]interface{})["state"])
+	suite.Equal(stats.AdblockListLoading, lists["https://scrapinghub.com/newlist.txt"].(map[string]interface{})["state"])
+
+	suite.Eventually(func() bool {
+		return suite.isBlocked(layer, "https://scrapinghub.com/?tracker_code=1")
+	}, time.Second, 10*time.Millisecond)
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestReloadNotLoaded() {
+	<-suite.layer.ready
+
+	previous := &AdblockLayer{ready: make(chan struct{})}
+	previous.startup, previous.stopStartup = context.WithTimeout(context.Background(), 10*time.Millisecond)
+
+	defer previous.stopStartup()
+
+	suite.conf.AdblockLists = []string{"https://scrapinghub.com/slowlist.txt"}
+	suite.conf.AdblockStartupTimeout.Duration = time.Minute
+
+	gock.New("https://scrapinghub.com/slowlist.txt").
+		Get("/").
+		Reply(200).
+		Delay(100 * time.Millisecond).
+		BodyString("ad_code=")
+
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, previous).(*AdblockLayer)
+
+	suite.False(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+
+	<-layer.ready
+	suite.True(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestInlineRules() {
+	suite.conf.AdblockLists = nil
+	suite.conf.AdblockRules = []string{"! comment", "||ads.example.com^", "@@||ads.example.com/allowed/"}
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+
+	<-layer.ready
+
+	suite.True(suite.isBlocked(layer, "https://ads.example.com/banner.js"))
+	suite.False(suite.isBlocked(layer, "https://ads.example.com/allowed/banner.js"))
+	suite.False(suite.isBlocked(layer, "https://example.com/"))
+}
+
+func (suite *AdblockLayerTestSuite) TestAllowlist() {
+	suite.conf.AdblockAllowlist = []string{"Scrapinghub.com", `/\?ad_code=222$/`}
+	layer := suite.inlineLayer("ad_code=")
+
+	suite.False(suite.isBlocked(layer, "https://scrapinghub.com/?ad_code=1"))
+	suite.False(suite.isBlocked(layer, "https://www.scrapinghub.com:8080/?ad_code=1"))
+	suite.False(suite.isBlocked(layer, "https://example.com/?ad_code=222"))
+	suite.True(suite.isBlocked(layer, "https://example.com/?ad_code=1"))
+	suite.True(suite.isBlocked(layer, "https://notscrapinghub.com/?ad_code=1"))
+}
+
+func (suite *AdblockLayerTestSuite) TestTest() {
+	suite.conf.AdblockAllowlist = []string{"example.com"}
+	layer := suite.inlineLayer("ad_code=", "@@||scrapinghub.com/allowed/")
+
+	result, err := layer.Test("https://scrapinghub.com/?ad_code=1", "")
+	suite.NoError(err)
+	suite.Equal(stats.AdblockTestResult{
+		URL:          "https://scrapinghub.com/?ad_code=1",
+		ResourceType: "other",
+		Blocked:      true,
+		Reason:       stats.AdblockTestBlocked,
+		Rule:         "ad_code=",
+		List:         adblockInlineRules,
+		Response:     config.AdblockResponseForbidden,
+	}, result)
+
+	result, err = layer.Test("https://scrapinghub.com/allowed/?ad_code=1", "")
+	suite.NoError(err)
+	suite.False(result.Blocked)
+	suite.Equal(stats.AdblockTestException, result.Reason)
+	suite.Equal("ad_code=", result.Rule)
+	suite.Equal("@@||scrapinghub.com/allowed/", result.Exception)
+
+	result, err = layer.Test("https://example.com/?ad_code=1", "")
+	suite.NoError(err)
+	suite.Equal(stats.AdblockTestAllowlisted, result.Reason)
+	suite.Equal("example.com", result.Allowlist)
+
+	result, err = layer.Test("https://scrapinghub.com/", "")
+	suite.NoError(err)
+	suite.Equal(stats.AdblockTestNotMatched, result.Reason)
+
+	_, err = layer.Test("scrapinghub.com", "")
+	suite.Error(err)
+}
+
+func (suite *AdblockLayerTestSuite) inlineLayer(rules ...string) *AdblockLayer {
+	suite.conf.AdblockLists = nil
+	suite.conf.AdblockRules = rules
+	layer := NewAdblockLayer(context.Background(), suite.conf, suite.metrics, nil).(*AdblockLayer)
+
+	<-layer.ready
+
+	return layer
+}
+
+func (suite *AdblockLayerTestSuite) isBlockedFrom(layer *AdblockLayer, url, referer string, headers ...string) bool {
+	suite.ctx.RequestHeaders.Set("referer", referer, true)
+
+	for i := 0; i < len(headers); i += 2 {
+		suite.ctx.RequestHeaders.Set(headers[i], headers[i+1], true)
+	}
+
+	suite.ctx.Request().SetRequestURI(url)
+	blocked := layer.OnRequest(suite.ctx) == errAdblockedRequest
+
+	for i := 0; i < len(headers); i += 2 {
+		suite.ctx.RequestHeaders.Remove(headers[i])
+	}
+
+	return blocked
+}
+
+func (suite *AdblockLayerTestSuite) TestResourceTypes() {
+	layer := suite.inlineLayer("||ads.example.com^$script", "||ads.example.com^$image,media", "||cdn.example.com^$~image")
+
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/ad.js", ""))
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/ad", "", "Sec-Fetch-Dest", "script"))
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/ad", "", "Accept", "image/webp,*/*"))
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/ad.mp4", ""))
+	suite.False(suite.isBlockedFrom(layer, "https://ads.example.com/ad.css", ""))
+	suite.False(suite.isBlockedFrom(layer, "https://ads.example.com/ad", "", "Sec-Fetch-Dest", "document"))
+
+	suite.True(suite.isBlockedFrom(layer, "https://cdn.example.com/lib.js", ""))
+	suite.False(suite.isBlockedFrom(layer, "https://cdn.example.com/logo.png", ""))
+}
+
+func (suite *AdblockLayerTestSuite) TestExceptionTypes() {
+	layer := suite.inlineLayer("||ads.example.com^", "@@||ads.example.com/player/$script")
+
+	suite.False(suite.isBlockedFrom(layer, "https://ads.example.com/player/main.js", ""))
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/player/poster.png", ""))
+}
+
+func (suite *AdblockLayerTestSuite) TestThirdParty() {
+	layer := suite.inlineLayer("||tracker.example.com^$third-party")
+
+	suite.True(suite.isBlockedFrom(layer, "https://tracker.example.com/pixel", "https://news.example.org/"))
+	suite.False(suite.isBlockedFrom(layer, "https://tracker.example.com/pixel", "https://www.example.com/page"))
+	suite.False(suite.isBlockedFrom(layer, "https://tracker.example.com/pixel", ""))
+}
+
+func (suite *AdblockLayerTestSuite) TestDomainOption() {
+	layer := suite.inlineLayer("/banner/$domain=example.com|~shop.example.com")
+
+	suite.True(suite.isBlockedFrom(layer, "https://cdn.net/banner/1.png", "https://www.example.com/"))
+	suite.False(suite.isBlockedFrom(layer, "https://cdn.net/banner/1.png", "https://shop.example.com/"))
+	suite.False(suite.isBlockedFrom(layer, "https://cdn.net/banner/1.png", "https://example.org/"))
+}
+
+func (suite *AdblockLayerTestSuite) TestDocumentException() {
+	layer := suite.inlineLayer("||ads.example.com^", "@@||partner.example.org^$document")
+
+	suite.False(suite.isBlockedFrom(layer, "https://ads.example.com/ad.js", "https://partner.example.org/page"))
+	suite.True(suite.isBlockedFrom(layer, "https://ads.example.com/ad.js", "https://example.org/page"))
+}
+
+func (suite *AdblockLayerTestSuite) TestUnsupportedRules() {
+	layer := suite.inlineLayer("||ads.example.com^$popup", "@@||ads.example.com^$elemhide", "||tracker.example.com^")
+
+	suite.Equal(1, layer.matcher.Load().(*adblockMatcher).size())
+	suite.False(suite.isBlockedFrom(layer, "https://ads.example.com/ad.js", ""))
+	suite.True(suite.isBlockedFrom(layer, "https://tracker.example.com/pixel", ""))
+}
+
+func (suite *AdblockLayerTestSuite) TestGetResourceType() {
+	suite.Equal(adblockTypeWebsocket, getAdblockResourceType("wss://example.com/", "empty", "", "websocket"))
+	suite.Equal(adblockTypeSubdocument, getAdblockResourceType("https://example.com/", "iframe", "text/html", ""))
+	suite.Equal(adblockTypeXMLHTTPRequest, getAdblockResourceType("https://example.com/a.js", "empty", "", ""))
+	suite.Equal(adblockTypeDocument, getAdblockResourceType("https://example.com/", "", "text/html,*/*", ""))
+	suite.Equal(adblockTypeStylesheet, getAdblockResourceType("https://example.com/a.CSS?v=1", "", "*/*", ""))
+	suite.Equal(adblockTypeOther, getAdblockResourceType("https://example.com/a", "", "*/*", ""))
+}
+
+// respond passes the request through the layer and returns a status
+// code of the response.
+func (suite *AdblockLayerTestSuite) respond(layer *AdblockLayer, url string) int {
+	suite.ctx.Delete(adblockLayerContextType)
+	suite.ctx.ResponseHeaders.Remove("Location")
+	suite.ctx.ResponseHeaders.Remove("Content-Type")
+	suite.ctx.Response().Reset()
+	suite.ctx.Request().SetRequestURI(url)
+
+	suite.NoError(layer.OnResponse(suite.ctx, layer.OnRequest(suite.ctx)))
+
+	return suite.ctx.Response().StatusCode()
+}
+
+func (suite *AdblockLayerTestSuite) TestResponses() {
+	suite.conf.AdblockResponses = []config.AdblockResponse{
+		{Rule: "||ads.example.com^$script", Response: config.AdblockResponseEmpty},
+		{Rule: "||ads.example.com^$image", Response: config.AdblockResponseEmpty},
+		{Rule: "||tracker.example.com^", Response: config.AdblockResponseReset},
+		{List: adblockInlineRules, Response: config.AdblockResponseNoContent},
+	}
+	layer := suite.inlineLayer("||ads.example.com^$script", "||ads.example.com^$image",
+		"||tracker.example.com^", "||cdn.example.com^")
+
+	suite.Equal(http.StatusOK, suite.respond(layer, "https://ads.example.com/ad.js"))
+	suite.Equal("application/javascript", suite.ctx.ResponseHeaders.GetLast("Content-Type").Value())
+	suite.Empty(suite.ctx.Response().Body())
+
+	suite.Equal(http.StatusOK, suite.respond(layer, "https://ads.example.com/ad.png"))
+	suite.Equal("image/gif", suite.ctx.ResponseHeaders.GetLast("Content-Type").Value())
+	suite.Equal(adblockEmptyGIF, suite.ctx.Response().Body())
+
+	suite.Equal(http.StatusForbidden, suite.respond(layer, "https://tracker.example.com/pixel"))
+	suite.True(suite.ctx.Response().IsBodyStream())
+
+	suite.Equal(http.StatusNoContent, suite.respond(layer, "https://cdn.example.com/lib.js"))
+	suite.Equal(http.StatusOK, suite.respond(layer, "https://example.com/"))
+}
+
+func (suite *AdblockLayerTestSuite) TestResetResponse() {
+	suite.conf.AdblockResponse = config.AdblockResponseReset
+	layer := suite.inlineLayer("||tracker.example.com^")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	suite.NoError(err)
+
+	server := &fasthttp.Server{
+		Logger: log.New(ioutil.Discard, "", 0),
+		Handler: func(fasthttpCtx *fasthttp.RequestCtx) {
+			ctx := layers.AcquireContext()
+			defer layers.ReleaseContext(ctx)
+
+			ctx.Init(fasthttpCtx, "tracker.example.com:80", suite.eventsChannel, "", 0) // nolint: errcheck
+			ctx.Set(logLayerContextType, getLogger(suite.ctx))
+			ctx.Set(metricsLayerContextType, suite.metrics)
+			layer.OnResponse(ctx, layer.OnRequest(ctx)) // nolint: errcheck
+		},
+	}
+
+	go server.Serve(listener) // nolint: errcheck
+
+	defer listener.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	suite.NoError(err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET http://tracker.example.com/pixel HTTP/1.1\r\nHost: tracker.example.com\r\n\r\n"))
+	suite.NoError(err)
+
+	// the connection is closed as usual (not reset) before any byte of
+	// the response is sent.
+	conn.SetReadDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	data, err := ioutil.ReadAll(conn)
+
+	suite.NoError(err)
+	suite.Empty(data)
+}
+
+func (suite *AdblockLayerTestSuite) TestDefaultResponse() {
+	suite.Equal(http.StatusForbidden, suite.respond(suite.inlineLayer("||ads.example.com^"), "https://ads.example.com/ad.js"))
+	suite.Equal("Request was adblocked", string(suite.ctx.Response().Body()))
+}
+
+func (suite *AdblockLayerTestSuite) TestRedirectResponse() {
+	suite.conf.AdblockResponse = config.AdblockResponseRedirect
+	layer := suite.inlineLayer("||ads.example.com^")
+
+	suite.Equal(http.StatusTemporaryRedirect, suite.respond(layer, "https://ads.example.com/ad.js"))
+	suite.Equal("https://adblock-stub.headless-proxy.invalid/script.js",
+		suite.ctx.ResponseHeaders.GetLast("Location").Value())
+
+	suite.Equal(http.StatusOK, suite.respond(layer, "https://adblock-stub.headless-proxy.invalid/script.js"))
+	suite.Equal("application/javascript", suite.ctx.ResponseHeaders.GetLast("Content-Type").Value())
+
+	suite.Equal(http.StatusOK, suite.respond(layer, "http://adblock-stub.headless-proxy.invalid/image.gif"))
+	suite.Equal(adblockEmptyGIF, suite.ctx.Response().Body())
+
+	result, err := layer.Test("https://ads.example.com/ad.js", "")
+	suite.NoError(err)
+	suite.Equal(config.AdblockResponseRedirect, result.Response)
+}
+
+func (suite *AdblockLayerTestSuite) TestRetryBackoff() {
+	suite.Equal(adblockRetryBackoff, getAdblockRetryBackoff(0, 0))
+	suite.Equal(4*adblockRetryBackoff, getAdblockRetryBackoff(2, 0))
+	suite.Equal(adblockMaxRetryBackoff, getAdblockRetryBackoff(100, 0))
+	suite.Equal(time.Minute, getAdblockRetryBackoff(100, time.Minute))
+}
+
 func TestAdblockLayer(t *testing.T) {
 	suite.Run(t, &AdblockLayerTestSuite{})
 }
@@ -8,11 +8,19 @@ import (
 )
 
 type AuthLayer struct {
-	user string
+	apiKey string
+	user   string
 }
 
 func (h *AuthLayer) OnRequest(ctx *layers.Context) error {
-	ctx.RequestHeaders.Append("proxy-authorization", fmt.Sprintf("Basic %s", h.user))
+	apiKey, user := h.apiKey, h.user
+	if current := getTenant(ctx); current != nil {
+		apiKey, user = current.apiKey, current.encodedAPIKey
+	}
+
+	ctx.Set(apiKeyLayerContextType, apiKey)
+	ctx.RequestHeaders.Set("proxy-authorization", fmt.Sprintf("Basic %s", user), true)
+
 	return nil
 }
 
@@ -20,10 +28,13 @@ func (h *AuthLayer) OnResponse(_ *layers.Context, err error) error {
 	return err
 }
 
-func NewAuthLayer(user string) layers.Layer {
-	encodedUser := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:", user)))
+func encodeAPIKey(apiKey string) string {
+	return base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:", apiKey)))
+}
 
+func NewAuthLayer(user string) layers.Layer {
 	return &AuthLayer{
-		user: encodedUser,
+		apiKey: user,
+		user:   encodeAPIKey(user),
 	}
 }
@@ -1,26 +1,26 @@
 package layers
 
 import (
-	"crypto/hmac"
-	"crypto/sha1" // nolint: gosec
-	"fmt"
-	"net"
 	"time"
 
 	"github.com/9seconds/httransform/v2/layers"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
 	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
 const baseLayerBadStatusCode = 400
 
 type BaseLayer struct {
-	metrics *stats.Stats
+	metrics     *stats.Stats
+	getClientID clientIDFunc
 }
 
 func (b *BaseLayer) OnRequest(ctx *layers.Context) error {
 	clientID := b.getClientID(ctx)
+	ctx.RequestHeaders.Remove(ClientIDHeader)
+
 	logger := log.WithFields(log.Fields{
 		"client_id":   clientID,
 		"request_id":  ctx.RequestID,
@@ -48,6 +48,11 @@ func (b *BaseLayer) OnResponse(ctx *layers.Context, err error) error {
 		"error":         err,
 	}).Info("Finish request")
 
+	metrics.NewResponse(getRoute(ctx),
+		string(ctx.Request().Header.Method()),
+		ctx.Response().StatusCode(),
+		ctx.ResponseHeaders.GetLast("x-crawlera-error").Value())
+
 	switch {
 	case isCrawleraError(ctx):
 		metrics.NewCrawleraError()
@@ -67,21 +72,9 @@ func (b *BaseLayer) calculateOverallTime(ctx *layers.Context) {
 	b.metrics.NewOverallTime(finishTime.Sub(startTimeUntyped.(time.Time)))
 }
 
-func (b *BaseLayer) getClientID(ctx *layers.Context) string {
-	host := ctx.RemoteAddr().String()
-	if parsedHost, _, err := net.SplitHostPort(host); err == nil {
-		host = parsedHost
-	}
-
-	hsh := hmac.New(sha1.New, []byte(host))
-	userAgent := ctx.RequestHeaders.GetLast("user-agent").Value()
-	hsh.Write([]byte(userAgent)) // nolint: errcheck
-
-	return fmt.Sprintf("%x", hsh.Sum(nil))
-}
-
-func NewBaseLayer(metrics *stats.Stats) layers.Layer {
+func NewBaseLayer(conf *config.Config, metrics *stats.Stats) layers.Layer {
 	return &BaseLayer{
-		metrics: metrics,
+		metrics:     metrics,
+		getClientID: newClientIDFunc(conf),
 	}
 }
@@ -0,0 +1,104 @@
+package layers
+
+import (
+	"crypto/hmac"
+	"crypto/sha1" // nolint: gosec
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/9seconds/httransform/v2/layers"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+// ClientIDHeader is a header clients identify themselves with. It is
+// never sent upstream.
+const ClientIDHeader = "X-Headless-Client-Id"
+
+// clientIDFunc returns an ID of the client which has sent the request.
+// Sessions, referers and traffic statistics are kept per client ID.
+type clientIDFunc func(ctx *layers.Context) string
+
+// getIPUserAgentClientID is a hash of client IP address and User-Agent.
+// It cannot tell apart several browsers of the same kind running on the
+// same host.
+func getIPUserAgentClientID(ctx *layers.Context) string {
+	host := ctx.RemoteAddr().String()
+	if parsedHost, _, err := net.SplitHostPort(host); err == nil {
+		host = parsedHost
+	}
+
+	hsh := hmac.New(sha1.New, []byte(host))
+	userAgent := ctx.RequestHeaders.GetLast("user-agent").Value()
+	hsh.Write([]byte(userAgent)) // nolint: errcheck
+
+	return fmt.Sprintf("%x", hsh.Sum(nil))
+}
+
+func getHeaderClientID(ctx *layers.Context) string {
+	if value := ctx.RequestHeaders.GetLast(ClientIDHeader).Value(); value != "" {
+		return value
+	}
+
+	return getIPUserAgentClientID(ctx)
+}
+
+func getProxyUserClientID(ctx *layers.Context) string {
+	if ctx.User != "" {
+		return ctx.User
+	}
+
+	return getIPUserAgentClientID(ctx)
+}
+
+func getBindPortClientID(ctx *layers.Context) string {
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+		return strconv.Itoa(addr.Port)
+	}
+
+	return getIPUserAgentClientID(ctx)
+}
+
+// makeSourcePortClientID identifies clients by IP address and a range
+// of source ports. Browsers which are given distinct port ranges by OS
+// (or by network namespaces) are told apart this way.
+func makeSourcePortClientID(portRange int) clientIDFunc {
+	return func(ctx *layers.Context) string {
+		addr, ok := ctx.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return getIPUserAgentClientID(ctx)
+		}
+
+		low := addr.Port / portRange * portRange
+
+		return fmt.Sprintf("%s:%d-%d", addr.IP, low, low+portRange-1)
+	}
+}
+
+// newClientIDFunc returns a function which identifies clients according
+// to the configuration. Clients of listeners are prefixed by a name of
+// the listener, so they never share sessions and referers with clients
+// of other listeners.
+func newClientIDFunc(conf *config.Config) clientIDFunc {
+	getClientID := getIPUserAgentClientID
+
+	switch conf.ClientID {
+	case config.ClientIDHeader:
+		getClientID = getHeaderClientID
+	case config.ClientIDProxyUser:
+		getClientID = getProxyUserClientID
+	case config.ClientIDSourcePort:
+		getClientID = makeSourcePortClientID(conf.ClientIDPortRange)
+	case config.ClientIDBindPort:
+		getClientID = getBindPortClientID
+	}
+
+	if conf.ListenerName == "" {
+		return getClientID
+	}
+
+	return func(ctx *layers.Context) string {
+		return conf.ListenerName + ":" + getClientID(ctx)
+	}
+}
@@ -0,0 +1,83 @@
+package layers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type ClientIDTestSuite struct {
+	CommonLayerTestSuite
+
+	conf *config.Config
+}
+
+func (suite *ClientIDTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.ctx.RequestHeaders.Set("User-Agent", "Chrome", true)
+}
+
+func (suite *ClientIDTestSuite) clientID(strategy string) string {
+	suite.conf.ClientID = strategy
+
+	return newClientIDFunc(suite.conf)(suite.ctx)
+}
+
+func (suite *ClientIDTestSuite) TestIPUserAgent() {
+	clientID := suite.clientID(config.ClientIDIPUserAgent)
+	suite.Len(clientID, 40)
+
+	suite.ctx.RequestHeaders.Set("User-Agent", "Firefox", true)
+	suite.NotEqual(clientID, suite.clientID(config.ClientIDIPUserAgent))
+}
+
+func (suite *ClientIDTestSuite) TestHeader() {
+	fallback := suite.clientID(config.ClientIDIPUserAgent)
+	suite.Equal(fallback, suite.clientID(config.ClientIDHeader))
+
+	suite.ctx.RequestHeaders.Set(ClientIDHeader, "browser-1", true)
+	suite.Equal("browser-1", suite.clientID(config.ClientIDHeader))
+}
+
+func (suite *ClientIDTestSuite) TestProxyUser() {
+	suite.Equal("user", suite.clientID(config.ClientIDProxyUser))
+
+	suite.ctx.User = ""
+	suite.Equal(suite.clientID(config.ClientIDIPUserAgent), suite.clientID(config.ClientIDProxyUser))
+}
+
+func (suite *ClientIDTestSuite) TestSourcePort() {
+	suite.Equal("127.0.0.1:65300-65399", suite.clientID(config.ClientIDSourcePort))
+
+	suite.conf.ClientIDPortRange = 1
+	suite.Equal("127.0.0.1:65342-65342", suite.clientID(config.ClientIDSourcePort))
+}
+
+func (suite *ClientIDTestSuite) TestBindPort() {
+	suite.Equal("0", suite.clientID(config.ClientIDBindPort))
+}
+
+func (suite *ClientIDTestSuite) TestListener() {
+	suite.conf.ListenerName = "firefox"
+
+	suite.Equal("firefox:user", suite.clientID(config.ClientIDProxyUser))
+}
+
+func (suite *ClientIDTestSuite) TestHeaderIsRemoved() {
+	suite.conf.ClientID = config.ClientIDHeader
+	suite.ctx.RequestHeaders.Set(ClientIDHeader, "browser-1", true)
+
+	layer := NewBaseLayer(suite.conf, nil)
+	suite.NoError(layer.OnRequest(suite.ctx))
+
+	suite.Equal("browser-1", getClientID(suite.ctx))
+	suite.Nil(suite.ctx.RequestHeaders.GetLast(ClientIDHeader))
+}
+
+func TestClientID(t *testing.T) {
+	suite.Run(t, &ClientIDTestSuite{})
+}
@@ -13,6 +13,12 @@ const (
 	startTimeLayerContextType = "start_time"
 	clientIDLayerContextType  = "client_id"
 	sessionChanContextType    = "session_chan"
+	sessionManagerContextType = "session_manager"
+	tenantLayerContextType    = "tenant"
+	routeLayerContextType     = "route"
+	sessionsLayerContextType  = "sessions_layer"
+	adblockLayerContextType   = "adblock"
+	apiKeyLayerContextType    = "api_key"
 )
 
 func isCrawleraError(ctx *layers.Context) bool {
@@ -32,6 +38,27 @@ func getClientID(ctx *layers.Context) string {
 	return clientIDUntyped.(string)
 }
 
+// ClientID returns ID of the client which has sent the request or an
+// empty string if it is not known yet.
+func ClientID(ctx *layers.Context) string {
+	if clientIDUntyped := ctx.Get(clientIDLayerContextType); clientIDUntyped != nil {
+		return clientIDUntyped.(string)
+	}
+
+	return ""
+}
+
+// APIKey returns Crawlera API key the request is sent with: a key of
+// its tenant or a global one. It returns an empty string if the key is
+// not chosen yet.
+func APIKey(ctx *layers.Context) string {
+	if apiKeyUntyped := ctx.Get(apiKeyLayerContextType); apiKeyUntyped != nil {
+		return apiKeyUntyped.(string)
+	}
+
+	return ""
+}
+
 func getLogger(ctx *layers.Context) *log.Entry {
 	loggerUntyped := ctx.Get(logLayerContextType)
 	return loggerUntyped.(*log.Entry)
@@ -41,3 +68,35 @@ func getMetrics(ctx *layers.Context) *stats.Stats {
 	metrics := ctx.Get(metricsLayerContextType)
 	return metrics.(*stats.Stats)
 }
+
+func getTenant(ctx *layers.Context) *tenant {
+	if tenantUntyped := ctx.Get(tenantLayerContextType); tenantUntyped != nil {
+		return tenantUntyped.(*tenant)
+	}
+
+	return nil
+}
+
+func getSessionsLayer(ctx *layers.Context) *SessionsLayer {
+	if sessionsUntyped := ctx.Get(sessionsLayerContextType); sessionsUntyped != nil {
+		return sessionsUntyped.(*SessionsLayer)
+	}
+
+	return nil
+}
+
+func getSessionManager(ctx *layers.Context) *sessionManager {
+	if mgrUntyped := ctx.Get(sessionManagerContextType); mgrUntyped != nil {
+		return mgrUntyped.(*sessionManager)
+	}
+
+	return nil
+}
+
+func getRoute(ctx *layers.Context) string {
+	if routeUntyped := ctx.Get(routeLayerContextType); routeUntyped != nil {
+		return routeUntyped.(string)
+	}
+
+	return stats.RouteProxied
+}
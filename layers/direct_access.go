@@ -3,11 +3,12 @@ package layers
 import (
 	"regexp"
 
-	"github.com/9seconds/httransform/v2/dialers"
 	"github.com/9seconds/httransform/v2/errors"
 	"github.com/9seconds/httransform/v2/executor"
 	"github.com/9seconds/httransform/v2/layers"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
 var errDirectAccess = errors.Annotate(nil, "direct access to the URL", "direct_executor", 0)
@@ -42,6 +43,8 @@ func (d *DirectAccessLayer) OnRequest(ctx *layers.Context) error {
 
 func (d *DirectAccessLayer) OnResponse(ctx *layers.Context, err error) error {
 	if err == errDirectAccess {
+		ctx.Set(routeLayerContextType, stats.RouteDirect)
+
 		if err := ctx.RequestHeaders.Push(); err != nil {
 			return errors.Annotate(err, "cannot sync request headers", "direct_executor", 0)
 		}
@@ -63,7 +66,7 @@ func (d *DirectAccessLayer) OnResponse(ctx *layers.Context, err error) error {
 	return err
 }
 
-func NewDirectAccessLayer(regexps []string, exceptRegxeps []string) layers.Layer {
+func NewDirectAccessLayer(regexps []string, exceptRegxeps []string, executor executor.Executor) layers.Layer {
 	rules := make([]*regexp.Regexp, len(regexps))
 	for i, v := range regexps {
 		rules[i] = regexp.MustCompile(v)
@@ -77,6 +80,6 @@ func NewDirectAccessLayer(regexps []string, exceptRegxeps []string) layers.Layer
 	return &DirectAccessLayer{
 		rules:      rules,
 		exceptions: exceptions,
-		executor:   executor.MakeDefaultExecutor(dialers.NewBase(dialers.Opts{})),
+		executor:   executor,
 	}
 }
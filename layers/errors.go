@@ -0,0 +1,163 @@
+package layers
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"strconv"
+
+	"github.com/9seconds/httransform/v2/layers"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+// ErrorHeader is a header of responses with Crawlera errors. It has a
+// category of the error, so clients do not have to know all the values
+// of X-Crawlera-Error.
+const ErrorHeader = "X-Headless-Error"
+
+// errorCategories maps values of X-Crawlera-Error to categories. Errors
+// which are not here have ErrorCategoryOther.
+var errorCategories = map[string]string{ // nolint: gochecknoglobals
+	"banned":                 stats.ErrorCategoryBanned,
+	"slavebanned":            stats.ErrorCategoryBanned,
+	"noslaves":               stats.ErrorCategoryBanned,
+	"bad_session_id":         stats.ErrorCategorySession,
+	"user_session_limit":     stats.ErrorCategorySession,
+	"bad_proxy_auth":         stats.ErrorCategoryAuth,
+	"header_auth":            stats.ErrorCategoryAuth,
+	"user_suspended":         stats.ErrorCategoryAuth,
+	"domain_forbidden":       stats.ErrorCategoryAuth,
+	"too_many_conns":         stats.ErrorCategoryRateLimit,
+	"serverbusy":             stats.ErrorCategoryRateLimit,
+	"timeout":                stats.ErrorCategoryTimeout,
+	"msgtimeout":             stats.ErrorCategoryTimeout,
+	"nxdomain":               stats.ErrorCategoryTarget,
+	"econnrefused":           stats.ErrorCategoryTarget,
+	"econnreset":             stats.ErrorCategoryTarget,
+	"ehostunreach":           stats.ErrorCategoryTarget,
+	"socket_closed_remotely": stats.ErrorCategoryTarget,
+	"bad_uri":                stats.ErrorCategoryBadRequest,
+	"bad_header":             stats.ErrorCategoryBadRequest,
+	"bad_endpoint":           stats.ErrorCategoryBadRequest,
+	"bad_request":            stats.ErrorCategoryBadRequest,
+}
+
+const errorPageHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Status }} {{ .Category }}</title>
+</head>
+<body>
+<h1>Request has failed: {{ .Category }}</h1>
+<p>Crawlera has responded to {{ .URL }} with {{ .Status }} ({{ .Error }}).</p>
+<p>Request ID: {{ .RequestID }}</p>
+</body>
+</html>
+`
+
+var errorPageTemplate = template.Must(template.New("error_page").Parse(errorPageHTML)) // nolint: gochecknoglobals
+
+// errorPage is a data error pages are rendered from.
+type errorPage struct {
+	Category  string `json:"category"`
+	Error     string `json:"error"`
+	Status    int    `json:"status"`
+	URL       string `json:"url"`
+	RequestID string `json:"request_id"`
+}
+
+// ErrorsLayer classifies responses with Crawlera errors. A category of
+// the error is set to ErrorHeader and counted in stats. If configured,
+// a body of the response is replaced with an HTML or JSON error page.
+type ErrorsLayer struct {
+	errorPages string
+}
+
+func (e *ErrorsLayer) OnRequest(_ *layers.Context) error {
+	return nil
+}
+
+func (e *ErrorsLayer) OnResponse(ctx *layers.Context, err error) error {
+	if err != nil || !isCrawleraError(ctx) {
+		return err
+	}
+
+	page := errorPage{
+		Error:     ctx.ResponseHeaders.GetLast("x-crawlera-error").Value(),
+		Status:    ctx.Response().StatusCode(),
+		URL:       string(ctx.Request().URI().FullURI()),
+		RequestID: ctx.RequestID,
+	}
+	page.Category = classifyCrawleraError(page.Error)
+
+	getMetrics(ctx).NewErrorCategory(page.Category)
+	ctx.ResponseHeaders.Set(ErrorHeader, page.Category, true)
+
+	if e.errorPages == config.ErrorPagesOff {
+		return nil
+	}
+
+	if err := e.respond(ctx, &page); err != nil {
+		getLogger(ctx).WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot render error page")
+	}
+
+	return nil
+}
+
+func (e *ErrorsLayer) respond(ctx *layers.Context, page *errorPage) error {
+	var (
+		body        []byte
+		contentType string
+	)
+
+	switch e.errorPages {
+	case config.ErrorPagesJSON:
+		encoded, err := json.Marshal(page)
+		if err != nil {
+			return err
+		}
+
+		body = encoded
+		contentType = "application/json"
+	default:
+		buf := bytes.Buffer{}
+		if err := errorPageTemplate.Execute(&buf, page); err != nil {
+			return err
+		}
+
+		body = buf.Bytes()
+		contentType = "text/html; charset=utf-8"
+	}
+
+	ctx.ResponseHeaders.Remove("Content-Encoding")
+	ctx.ResponseHeaders.Remove("Transfer-Encoding")
+	ctx.ResponseHeaders.Set("Content-Type", contentType, true)
+	ctx.ResponseHeaders.Set("Content-Length", strconv.Itoa(len(body)), true)
+	ctx.Response().SetBody(body)
+
+	return nil
+}
+
+// classifyCrawleraError returns a category of the value of
+// X-Crawlera-Error header.
+func classifyCrawleraError(crawleraError string) string {
+	if category, ok := errorCategories[crawleraError]; ok {
+		return category
+	}
+
+	return stats.ErrorCategoryOther
+}
+
+// NewErrorsLayer returns a layer which classifies Crawlera errors and
+// renders error pages for them.
+func NewErrorsLayer(conf *config.Config) layers.Layer {
+	return &ErrorsLayer{
+		errorPages: conf.ErrorPages,
+	}
+}
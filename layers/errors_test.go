@@ -0,0 +1,84 @@
+package layers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+type ErrorsTestSuite struct {
+	CommonLayerTestSuite
+
+	conf *config.Config
+}
+
+func (suite *ErrorsTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.ctx.Request().SetRequestURI("http://example.com/page")
+	suite.ctx.Response().SetStatusCode(503)
+	suite.ctx.Response().SetBodyString("upstream body")
+	suite.ctx.ResponseHeaders.Set("X-Crawlera-Error", "slavebanned", true)
+}
+
+func (suite *ErrorsTestSuite) TestClassify() {
+	suite.Equal(stats.ErrorCategoryBanned, classifyCrawleraError("banned"))
+	suite.Equal(stats.ErrorCategorySession, classifyCrawleraError("user_session_limit"))
+	suite.Equal(stats.ErrorCategoryAuth, classifyCrawleraError("bad_proxy_auth"))
+	suite.Equal(stats.ErrorCategoryTimeout, classifyCrawleraError("timeout"))
+	suite.Equal(stats.ErrorCategoryOther, classifyCrawleraError("something_new"))
+}
+
+func (suite *ErrorsTestSuite) TestNoError() {
+	suite.ctx.ResponseHeaders.Remove("X-Crawlera-Error")
+
+	suite.NoError(NewErrorsLayer(suite.conf).OnResponse(suite.ctx, nil))
+	suite.Nil(suite.ctx.ResponseHeaders.GetLast(ErrorHeader))
+}
+
+func (suite *ErrorsTestSuite) TestHeader() {
+	suite.NoError(NewErrorsLayer(suite.conf).OnResponse(suite.ctx, nil))
+
+	suite.Equal(stats.ErrorCategoryBanned, suite.ctx.ResponseHeaders.GetLast(ErrorHeader).Value())
+	suite.Equal("upstream body", string(suite.ctx.Response().Body()))
+
+	encoded, err := json.Marshal(getMetrics(suite.ctx).ErrorCategories)
+	suite.NoError(err)
+
+	categories := map[string]uint64{}
+	suite.NoError(json.Unmarshal(encoded, &categories))
+	suite.EqualValues(1, categories[stats.ErrorCategoryBanned])
+	suite.EqualValues(0, categories[stats.ErrorCategoryOther])
+}
+
+func (suite *ErrorsTestSuite) TestJSON() {
+	suite.conf.ErrorPages = config.ErrorPagesJSON
+
+	suite.NoError(NewErrorsLayer(suite.conf).OnResponse(suite.ctx, nil))
+	suite.Equal("application/json", suite.ctx.ResponseHeaders.GetLast("Content-Type").Value())
+	suite.Equal(503, suite.ctx.Response().StatusCode())
+
+	page := errorPage{}
+	suite.NoError(json.Unmarshal(suite.ctx.Response().Body(), &page))
+	suite.Equal(stats.ErrorCategoryBanned, page.Category)
+	suite.Equal("slavebanned", page.Error)
+	suite.Equal(503, page.Status)
+	suite.Equal("http://example.com/page", page.URL)
+}
+
+func (suite *ErrorsTestSuite) TestHTML() {
+	suite.conf.ErrorPages = config.ErrorPagesHTML
+
+	suite.NoError(NewErrorsLayer(suite.conf).OnResponse(suite.ctx, nil))
+	suite.Contains(suite.ctx.ResponseHeaders.GetLast("Content-Type").Value(), "text/html")
+	suite.Contains(string(suite.ctx.Response().Body()), "Request has failed: banned")
+}
+
+func TestErrors(t *testing.T) {
+	suite.Run(t, &ErrorsTestSuite{})
+}
@@ -0,0 +1,304 @@
+package layers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/9seconds/httransform/v2/auth"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/karlseguin/ccache"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+const (
+	inboundAuthCacheSize = 1000
+	inboundAuthCacheTTL  = 10 * time.Minute
+)
+
+// InboundAuthLayer authenticates clients of headless proxy. It is both
+// an authenticator of httransform (so CONNECT requests are rejected with
+// 407 before the tunnel is established) and a layer which strips client
+// credentials before they reach Crawlera.
+//
+// Client is authenticated if its IP belongs to the allowlist, or it sends
+// Basic credentials from htpasswd file, or it sends one of static tokens
+// either as a Bearer token or as a password of Basic credentials.
+//
+// If authentication is enabled, a name of the user is passed further
+// (to tenants and client identification) only if it was checked against
+// htpasswd file. Clients authenticated by token or by IP are anonymous.
+//
+// Checks of bcrypt hashes are slow, so credentials which have passed
+// them are cached for a while.
+type InboundAuthLayer struct {
+	enabled    bool
+	users      map[string][]byte
+	tokens     [][]byte
+	subnets    []*net.IPNet
+	apiTokens  [][]byte
+	apiSubnets []*net.IPNet
+	verified   *ccache.Cache
+}
+
+func (i *InboundAuthLayer) Authenticate(ctx *fasthttp.RequestCtx) (string, error) {
+	header := ctx.Request.Header.Peek("Proxy-Authorization")
+
+	if !i.enabled {
+		_, user, _ := parseProxyAuthorization(header)
+		return user, nil
+	}
+
+	if len(header) > 0 {
+		if user, ok := i.authenticateHeader(header); ok {
+			return user, nil
+		}
+	}
+
+	switch {
+	case containsIP(i.subnets, ctx.RemoteIP()):
+		return "", nil
+	case len(header) == 0:
+		return "", auth.ErrAuthRequired
+	}
+
+	log.WithFields(log.Fields{
+		"remote_addr": ctx.RemoteAddr(),
+	}).Debug("Client has failed authentication")
+
+	return "", auth.ErrFailedAuth
+}
+
+// AuthenticateAPI tells if a request to API of headless proxy is sent by
+// authenticated client. Clients from API networks or with API tokens
+// are always allowed. If inbound authentication is enabled, clients can
+// also use the same credentials as for proxy but send them in
+// Authorization header. If neither inbound authentication nor API
+// access is configured, only local clients are allowed.
+func (i *InboundAuthLayer) AuthenticateAPI(r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+
+	if ip != nil && (containsIP(i.apiSubnets, ip) || (i.enabled && containsIP(i.subnets, ip))) {
+		return true
+	}
+
+	if header := []byte(r.Header.Get("Authorization")); len(header) > 0 {
+		_, _, password := parseProxyAuthorization(header)
+		if isValidToken(i.apiTokens, password) {
+			return true
+		}
+
+		if i.enabled {
+			_, ok := i.authenticateHeader(header)
+			return ok
+		}
+	}
+
+	if !i.enabled && len(i.apiTokens) == 0 && len(i.apiSubnets) == 0 {
+		return ip != nil && ip.IsLoopback()
+	}
+
+	return false
+}
+
+func (i *InboundAuthLayer) OnRequest(ctx *layers.Context) error {
+	ctx.RequestHeaders.Remove("proxy-authorization")
+	return nil
+}
+
+func (i *InboundAuthLayer) OnResponse(_ *layers.Context, err error) error {
+	return err
+}
+
+// authenticateHeader checks credentials of the header. It returns a
+// name of the user if credentials were checked against htpasswd file,
+// and an empty name if the client has sent a valid token.
+func (i *InboundAuthLayer) authenticateHeader(header []byte) (string, bool) {
+	scheme, user, password := parseProxyAuthorization(header)
+
+	switch scheme {
+	case "bearer":
+		return "", isValidToken(i.tokens, password)
+	case "basic":
+		if i.isValidUser(user, password) {
+			return user, true
+		}
+
+		return "", isValidToken(i.tokens, password)
+	}
+
+	return "", false
+}
+
+func (i *InboundAuthLayer) isValidUser(user, password string) bool {
+	hash, ok := i.users[user]
+	if !ok {
+		return false
+	}
+
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(user+":"+password)))
+	if item := i.verified.Get(key); item != nil && !item.Expired() {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	i.verified.Set(key, true, inboundAuthCacheTTL)
+
+	return true
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, v := range subnets {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isValidToken(tokens [][]byte, token string) bool {
+	if token == "" {
+		return false
+	}
+
+	valid := 0
+
+	for _, v := range tokens {
+		valid |= subtle.ConstantTimeCompare([]byte(token), v)
+	}
+
+	return valid == 1
+}
+
+// parseProxyAuthorization returns a lowercased scheme, user and password
+// from Proxy-Authorization header. Bearer token is returned as password.
+func parseProxyAuthorization(header []byte) (string, string, string) {
+	pos := bytes.IndexByte(header, ' ')
+	if pos < 0 {
+		return "", "", ""
+	}
+
+	scheme := strings.ToLower(string(header[:pos]))
+	value := string(bytes.TrimSpace(header[pos:]))
+
+	switch scheme {
+	case "bearer":
+		return scheme, "", value
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return "", "", ""
+		}
+
+		chunks := strings.SplitN(string(decoded), ":", 2) // nolint: gomnd
+		if len(chunks) == 1 {
+			return scheme, chunks[0], ""
+		}
+
+		return scheme, chunks[0], chunks[1]
+	}
+
+	return "", "", ""
+}
+
+func readHtpasswd(path string) (map[string][]byte, error) {
+	users := map[string][]byte{}
+
+	if path == "" {
+		return users, nil
+	}
+
+	fp, err := os.Open(path) // nolint: gosec
+	if err != nil {
+		return nil, fmt.Errorf("cannot open htpasswd file: %w", err)
+	}
+
+	defer fp.Close() // nolint: errcheck
+
+	scanner := bufio.NewScanner(fp)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		chunks := strings.SplitN(line, ":", 2)                       // nolint: gomnd
+		if len(chunks) != 2 || !strings.HasPrefix(chunks[1], "$2") { // nolint: gomnd
+			return nil, fmt.Errorf("incorrect htpasswd line for user %s: only bcrypt is supported", chunks[0])
+		}
+
+		users[chunks[0]] = []byte(chunks[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read htpasswd file: %w", err)
+	}
+
+	return users, nil
+}
+
+func parseTokens(tokens []string) [][]byte {
+	rv := make([][]byte, 0, len(tokens))
+
+	for _, v := range tokens {
+		rv = append(rv, []byte(v))
+	}
+
+	return rv
+}
+
+func NewInboundAuthLayer(conf *config.Config) (*InboundAuthLayer, error) {
+	users, err := readHtpasswd(conf.InboundAuthHtpasswd)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := &InboundAuthLayer{
+		users:      users,
+		verified:   ccache.New(ccache.Configure().MaxSize(inboundAuthCacheSize)),
+		tokens:     parseTokens(conf.InboundAuthTokens),
+		apiTokens:  parseTokens(conf.ProxyAPITokens),
+		subnets:    make([]*net.IPNet, 0, len(conf.InboundAuthCIDRs)),
+		apiSubnets: make([]*net.IPNet, 0, len(conf.ProxyAPICIDRs)),
+	}
+
+	for _, v := range conf.InboundAuthCIDRs {
+		_, subnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect inbound auth CIDR %s: %w", v, err)
+		}
+
+		layer.subnets = append(layer.subnets, subnet)
+	}
+
+	for _, v := range conf.ProxyAPICIDRs {
+		_, subnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("incorrect proxy API CIDR %s: %w", v, err)
+		}
+
+		layer.apiSubnets = append(layer.apiSubnets, subnet)
+	}
+
+	layer.enabled = conf.InboundAuthHtpasswd != "" || len(layer.tokens) > 0 || len(layer.subnets) > 0
+
+	return layer, nil
+}
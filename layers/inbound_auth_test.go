@@ -0,0 +1,228 @@
+package layers
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/9seconds/httransform/v2/auth"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type InboundAuthLayerTestSuite struct {
+	CommonLayerTestSuite
+
+	htpasswd string
+	conf     *config.Config
+}
+
+func (suite *InboundAuthLayerTestSuite) SetupSuite() {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	htpasswd, _ := ioutil.TempFile("", "htpasswd")
+
+	htpasswd.WriteString("# comment\nuser:" + string(hash) + "\n") // nolint: errcheck
+	htpasswd.Close()
+
+	suite.htpasswd = htpasswd.Name()
+}
+
+func (suite *InboundAuthLayerTestSuite) TearDownSuite() {
+	os.Remove(suite.htpasswd)
+}
+
+func (suite *InboundAuthLayerTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.conf.InboundAuthHtpasswd = suite.htpasswd
+	suite.conf.InboundAuthTokens = []string{"token"}
+}
+
+func (suite *InboundAuthLayerTestSuite) authenticate(header, ip string) (string, error) {
+	layer, err := NewInboundAuthLayer(suite.conf)
+	suite.NoError(err)
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP(ip), Port: 65342}, nil)
+
+	if header != "" {
+		ctx.Request.Header.Set("Proxy-Authorization", header)
+	}
+
+	return layer.Authenticate(ctx)
+}
+
+func (suite *InboundAuthLayerTestSuite) authenticateAPI(header, ip string) bool {
+	layer, err := NewInboundAuthLayer(suite.conf)
+	suite.NoError(err)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:3130/config/reload", nil) // nolint: noctx
+	req.RemoteAddr = net.JoinHostPort(ip, "65342")
+
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+
+	return layer.AuthenticateAPI(req)
+}
+
+func (suite *InboundAuthLayerTestSuite) basic(value string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func (suite *InboundAuthLayerTestSuite) TestDisabled() {
+	suite.conf.InboundAuthHtpasswd = ""
+	suite.conf.InboundAuthTokens = nil
+
+	user, err := suite.authenticate(suite.basic("tenant:"), "127.0.0.1")
+	suite.NoError(err)
+	suite.Equal("tenant", user)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestAuthRequired() {
+	_, err := suite.authenticate("", "127.0.0.1")
+	suite.Equal(auth.ErrAuthRequired, err)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestHtpasswd() {
+	user, err := suite.authenticate(suite.basic("user:password"), "127.0.0.1")
+	suite.NoError(err)
+	suite.Equal("user", user)
+
+	_, err = suite.authenticate(suite.basic("user:incorrect"), "127.0.0.1")
+	suite.Equal(auth.ErrFailedAuth, err)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestToken() {
+	_, err := suite.authenticate("Bearer token", "127.0.0.1")
+	suite.NoError(err)
+
+	// A name sent with a token is not checked, so it is not passed.
+	user, err := suite.authenticate(suite.basic("tenant:token"), "127.0.0.1")
+	suite.NoError(err)
+	suite.Empty(user)
+
+	_, err = suite.authenticate("Bearer incorrect", "127.0.0.1")
+	suite.Equal(auth.ErrFailedAuth, err)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestCIDR() {
+	suite.conf.InboundAuthCIDRs = []string{"10.0.0.0/8"}
+
+	_, err := suite.authenticate("", "10.1.2.3")
+	suite.NoError(err)
+
+	_, err = suite.authenticate("", "192.168.1.1")
+	suite.Equal(auth.ErrAuthRequired, err)
+
+	user, err := suite.authenticate(suite.basic("tenant:anything"), "10.1.2.3")
+	suite.NoError(err)
+	suite.Empty(user)
+
+	user, err = suite.authenticate(suite.basic("user:password"), "10.1.2.3")
+	suite.NoError(err)
+	suite.Equal("user", user)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestEmptyHtpasswd() {
+	htpasswd, _ := ioutil.TempFile("", "htpasswd")
+	htpasswd.Close()
+
+	defer os.Remove(htpasswd.Name())
+
+	suite.conf.InboundAuthHtpasswd = htpasswd.Name()
+	suite.conf.InboundAuthTokens = nil
+
+	_, err := suite.authenticate(suite.basic("tenant:"), "127.0.0.1")
+	suite.Equal(auth.ErrFailedAuth, err)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestVerifiedCache() {
+	layer, err := NewInboundAuthLayer(suite.conf)
+	suite.NoError(err)
+
+	for i := 0; i < 3; i++ {
+		_, ok := layer.authenticateHeader([]byte(suite.basic(fmt.Sprintf("client-%d:token", i))))
+		suite.True(ok)
+	}
+
+	suite.Equal(0, layer.verified.ItemCount())
+
+	_, ok := layer.authenticateHeader([]byte(suite.basic("user:password")))
+	suite.True(ok)
+	_, ok = layer.authenticateHeader([]byte(suite.basic("user:incorrect")))
+	suite.False(ok)
+	suite.Equal(1, layer.verified.ItemCount())
+
+	user, ok := layer.authenticateHeader([]byte(suite.basic("user:password")))
+	suite.True(ok)
+	suite.Equal("user", user)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestStripCredentials() {
+	layer, err := NewInboundAuthLayer(suite.conf)
+	suite.NoError(err)
+
+	suite.ctx.RequestHeaders.Set("Proxy-Authorization", suite.basic("user:password"), true)
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Nil(suite.ctx.RequestHeaders.GetLast("proxy-authorization"))
+}
+
+func (suite *InboundAuthLayerTestSuite) TestAPI() {
+	suite.conf.InboundAuthCIDRs = []string{"10.0.0.0/8"}
+
+	suite.True(suite.authenticateAPI(suite.basic("user:password"), "192.168.1.1"))
+	suite.True(suite.authenticateAPI("Bearer token", "192.168.1.1"))
+	suite.True(suite.authenticateAPI("", "10.1.2.3"))
+	suite.False(suite.authenticateAPI(suite.basic("user:incorrect"), "192.168.1.1"))
+	suite.False(suite.authenticateAPI("", "127.0.0.1"))
+}
+
+func (suite *InboundAuthLayerTestSuite) TestAPIDisabled() {
+	suite.conf.InboundAuthHtpasswd = ""
+	suite.conf.InboundAuthTokens = nil
+
+	suite.True(suite.authenticateAPI("", "127.0.0.1"))
+	suite.True(suite.authenticateAPI("", "::1"))
+	suite.False(suite.authenticateAPI("", "192.168.1.1"))
+}
+
+func (suite *InboundAuthLayerTestSuite) TestAPITokens() {
+	suite.conf.InboundAuthHtpasswd = ""
+	suite.conf.InboundAuthTokens = nil
+	suite.conf.ProxyAPITokens = []string{"api-token"}
+
+	suite.True(suite.authenticateAPI("Bearer api-token", "172.17.0.1"))
+	suite.True(suite.authenticateAPI(suite.basic("admin:api-token"), "172.17.0.1"))
+	suite.False(suite.authenticateAPI("Bearer token", "172.17.0.1"))
+	suite.False(suite.authenticateAPI("", "172.17.0.1"))
+	suite.False(suite.authenticateAPI("", "127.0.0.1"))
+
+	user, err := suite.authenticate("", "172.17.0.1")
+	suite.NoError(err)
+	suite.Empty(user)
+}
+
+func (suite *InboundAuthLayerTestSuite) TestAPICIDRs() {
+	suite.conf.ProxyAPICIDRs = []string{"172.16.0.0/12"}
+
+	suite.True(suite.authenticateAPI("", "172.17.0.1"))
+	suite.True(suite.authenticateAPI("Bearer token", "192.168.1.1"))
+	suite.False(suite.authenticateAPI("", "192.168.1.1"))
+	suite.False(suite.authenticateAPI("", "127.0.0.1"))
+
+	_, err := suite.authenticate("", "172.17.0.1")
+	suite.Equal(auth.ErrAuthRequired, err)
+}
+
+func TestInboundAuthLayer(t *testing.T) {
+	suite.Run(t, &InboundAuthLayerTestSuite{})
+}
@@ -1,6 +1,10 @@
 package layers
 
-import "github.com/9seconds/httransform/v2/layers"
+import (
+	"sync"
+
+	"github.com/9seconds/httransform/v2/layers"
+)
 
 type RateLimiterLayer struct {
 	limiter chan struct{}
@@ -21,3 +25,65 @@ func NewRateLimiterLayer(concurrentConnections int) layers.Layer {
 		limiter: make(chan struct{}, concurrentConnections),
 	}
 }
+
+// clientLimiter is a limiter of the client. It is kept while the client
+// has requests in flight or waiting for the limiter.
+type clientLimiter struct {
+	limiter chan struct{}
+	users   int
+}
+
+// ClientRateLimiterLayer limits concurrent connections of each client
+// ID, so a single client cannot take all connections of global or
+// tenant limits.
+type ClientRateLimiterLayer struct {
+	concurrentConnections int
+	clients               map[string]*clientLimiter
+	lock                  sync.Mutex
+}
+
+func (c *ClientRateLimiterLayer) OnRequest(ctx *layers.Context) error {
+	c.acquire(getClientID(ctx)).limiter <- struct{}{}
+	return nil
+}
+
+func (c *ClientRateLimiterLayer) OnResponse(ctx *layers.Context, err error) error {
+	clientID := getClientID(ctx)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if client, ok := c.clients[clientID]; ok {
+		<-client.limiter
+
+		if client.users--; client.users == 0 {
+			delete(c.clients, clientID)
+		}
+	}
+
+	return err
+}
+
+func (c *ClientRateLimiterLayer) acquire(clientID string) *clientLimiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client, ok := c.clients[clientID]
+	if !ok {
+		client = &clientLimiter{
+			limiter: make(chan struct{}, c.concurrentConnections),
+		}
+		c.clients[clientID] = client
+	}
+
+	client.users++
+
+	return client
+}
+
+func NewClientRateLimiterLayer(concurrentConnections int) layers.Layer {
+	return &ClientRateLimiterLayer{
+		concurrentConnections: concurrentConnections,
+		clients:               map[string]*clientLimiter{},
+	}
+}
@@ -2,7 +2,9 @@ package layers
 
 import (
 	"testing"
+	"time"
 
+	"github.com/9seconds/httransform/v2/layers"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -19,6 +21,51 @@ func (suite *RateLimiterLayerTestSuite) TestRateLimiter() {
 	suite.Len(layer.limiter, 0)
 }
 
+func (suite *RateLimiterLayerTestSuite) TestClientRateLimiter() {
+	layer := NewClientRateLimiterLayer(1).(*ClientRateLimiterLayer)
+	first := makeClientContext("first")
+	second := makeClientContext("second")
+
+	defer layers.ReleaseContext(first)
+	defer layers.ReleaseContext(second)
+
+	suite.Nil(layer.OnRequest(first))
+	suite.Nil(layer.OnRequest(second))
+	suite.Len(layer.clients, 2)
+
+	acquired := make(chan struct{})
+
+	go func() {
+		layer.OnRequest(first) // nolint:errcheck
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		suite.FailNow("client has exceeded its limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	layer.OnResponse(first, nil) // nolint:errcheck
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		suite.FailNow("client has not got a released connection")
+	}
+
+	layer.OnResponse(first, nil)  // nolint:errcheck
+	layer.OnResponse(second, nil) // nolint:errcheck
+	suite.Empty(layer.clients)
+}
+
+func makeClientContext(clientID string) *layers.Context {
+	ctx := layers.AcquireContext()
+	ctx.Set(clientIDLayerContextType, clientID)
+
+	return ctx
+}
+
 func TestRateLimiter(t *testing.T) {
 	suite.Run(t, &RateLimiterLayerTestSuite{})
 }
@@ -8,21 +8,30 @@ import (
 
 	"github.com/9seconds/httransform/v2/layers"
 	"github.com/karlseguin/ccache"
+	"github.com/valyala/fasthttp"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
 )
 
 const (
-	refererLayerTTL  = 10 * time.Second
 	defaultHTTPPort  = 80
 	defaultHTTPSPort = 443
 )
 
+// RefererLayer sets Referer header for requests which do not have it.
+// It remembers a referer of the last request of the client to each host
+// and reuses it for the next requests to the same host. If a response is
+// a redirect, referer of the original request is remembered for the host
+// the client is redirected to, as browsers do.
 type RefererLayer struct {
 	referers *ccache.LayeredCache
+	ttl      time.Duration
+	policy   string
 }
 
 func (r *RefererLayer) OnRequest(ctx *layers.Context) error {
 	clientID := getClientID(ctx)
-	host := ctx.RequestHeaders.GetLast("host").Value()
+	host := string(ctx.Request().URI().Host())
 	referer := ctx.RequestHeaders.GetLast("referer").Value()
 
 	referer = r.clean(referer)
@@ -39,7 +48,26 @@ func (r *RefererLayer) OnRequest(ctx *layers.Context) error {
 	return nil
 }
 
-func (r *RefererLayer) OnResponse(_ *layers.Context, err error) error {
+func (r *RefererLayer) OnResponse(ctx *layers.Context, err error) error {
+	if err != nil || !fasthttp.StatusCodeIsRedirect(ctx.Response().StatusCode()) {
+		return err
+	}
+
+	location := ctx.ResponseHeaders.GetLast("location").Value()
+	if location == "" {
+		return err
+	}
+
+	base, errBase := url.Parse(string(ctx.Request().URI().FullURI()))
+	if errBase != nil {
+		return err
+	}
+
+	if target, errLocation := base.Parse(location); errLocation == nil {
+		referer := ctx.RequestHeaders.GetLast("referer").Value()
+		r.set(getClientID(ctx), target.Host, referer)
+	}
+
 	return err
 }
 
@@ -50,10 +78,22 @@ func (r *RefererLayer) clean(referer string) string {
 	}
 
 	urlCopy.Fragment = ""
-	urlCopy.RawQuery = ""
-	urlCopy.ForceQuery = false
+	urlCopy.User = nil
 	urlCopy.Host = r.prepareHost(urlCopy)
 
+	switch r.policy {
+	case config.RefererPolicyOrigin:
+		if urlCopy.Host != "" {
+			urlCopy.Path = "/"
+			urlCopy.RawPath = ""
+		}
+
+		fallthrough
+	case config.RefererPolicyStripQuery:
+		urlCopy.RawQuery = ""
+		urlCopy.ForceQuery = false
+	}
+
 	return urlCopy.String()
 }
 
@@ -81,11 +121,16 @@ func (r *RefererLayer) get(primary, secondary string) string {
 }
 
 func (r *RefererLayer) set(primary, secondary, item string) {
-	r.referers.Set(primary, secondary, item, refererLayerTTL)
+	r.referers.Set(primary, secondary, item, r.ttl)
 }
 
-func NewRefererLayer() layers.Layer {
+// NewRefererLayer returns a layer which sets missing Referer headers.
+// Referers are remembered for the given TTL and are reduced according
+// to the given policy: only origin, URL without query or full URL.
+func NewRefererLayer(ttl time.Duration, policy string) layers.Layer {
 	return &RefererLayer{
 		referers: ccache.Layered(ccache.Configure()),
+		ttl:      ttl,
+		policy:   policy,
 	}
 }
@@ -0,0 +1,195 @@
+package layers
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/9seconds/httransform/v2/errors"
+	"github.com/9seconds/httransform/v2/executor"
+	"github.com/9seconds/httransform/v2/layers"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+// defaultRetryPolicy retries requests failed with any Crawlera error
+// once with a new session. It is used if automatic sessions are enabled
+// and no retry policies are configured.
+var defaultRetryPolicy = config.RetryPolicy{ // nolint: gochecknoglobals
+	Error:         config.RetryAnyError,
+	Attempts:      1,
+	RotateSession: true,
+}
+
+// RetryLayer retries requests which have failed with an error of
+// Crawlera or with a status code there is a retry policy for. If the
+// policy says so, a session of the request is replaced before each
+// retry. A final response is returned to the client as is.
+type RetryLayer struct {
+	policies map[string]config.RetryPolicy
+	executor executor.Executor
+}
+
+func (r *RetryLayer) OnRequest(_ *layers.Context) error {
+	return nil
+}
+
+func (r *RetryLayer) OnResponse(ctx *layers.Context, err error) error {
+	if err != nil {
+		return err
+	}
+
+	reason, policy, ok := r.getPolicy(ctx)
+	if !ok {
+		return nil
+	}
+
+	metrics := getMetrics(ctx)
+	logger := getLogger(ctx).WithFields(log.Fields{
+		"error":    reason,
+		"attempts": policy.Attempts,
+	})
+
+	var deadline time.Time
+	if policy.Deadline.Duration > 0 {
+		deadline = time.Now().Add(policy.Deadline.Duration)
+	}
+
+	for attempt := 1; attempt <= policy.Attempts; attempt++ {
+		backoff := getRetryBackoff(policy, attempt)
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			logger.Info("Retry deadline is reached")
+			break
+		}
+
+		logger.WithFields(log.Fields{
+			"attempt": attempt,
+			"backoff": backoff,
+		}).Info("Retry request")
+
+		if err := r.sleep(ctx, backoff); err != nil {
+			return err
+		}
+
+		if sessions := getSessionsLayer(ctx); sessions != nil && policy.RotateSession {
+			sessions.rotateSession(ctx)
+		}
+
+		metrics.NewRetry(reason)
+
+		if err := r.executeRequest(ctx); err != nil {
+			metrics.NewRetryResult(reason, false)
+			return err
+		}
+
+		if _, _, ok := r.getPolicy(ctx); !ok {
+			metrics.NewRetryResult(reason, true)
+			logger.Info("Request succeed after retry")
+
+			return nil
+		}
+	}
+
+	metrics.NewRetryResult(reason, false)
+	logger.Info("Request failed even after retries")
+
+	return nil
+}
+
+// getPolicy returns a policy for the response and an error it has
+// failed with. A policy for X-Crawlera-Error has priority over a policy
+// for a status code.
+func (r *RetryLayer) getPolicy(ctx *layers.Context) (string, config.RetryPolicy, bool) {
+	crawleraError := ctx.ResponseHeaders.GetLast("x-crawlera-error").Value()
+	if policy, ok := r.policies[crawleraError]; ok && crawleraError != "" {
+		return crawleraError, policy, true
+	}
+
+	statusCode := strconv.Itoa(ctx.Response().StatusCode())
+	if policy, ok := r.policies[statusCode]; ok {
+		return statusCode, policy, true
+	}
+
+	if policy, ok := r.policies[config.RetryAnyError]; ok && crawleraError != "" {
+		return crawleraError, policy, true
+	}
+
+	return "", config.RetryPolicy{}, false
+}
+
+func (r *RetryLayer) sleep(ctx *layers.Context, backoff time.Duration) error {
+	if backoff <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "request is cancelled while waiting for retry", "retry", 0)
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (r *RetryLayer) executeRequest(ctx *layers.Context) error {
+	if err := ctx.RequestHeaders.Push(); err != nil {
+		return errors.Annotate(err, "cannot sync request headers", "retry", 0)
+	}
+
+	if err := r.executor(ctx); err != nil {
+		return errors.Annotate(err, "cannot execute a request", "retry", 0)
+	}
+
+	if err := ctx.ResponseHeaders.Pull(); err != nil {
+		return errors.Annotate(err, "cannot read response headers", "retry", 0)
+	}
+
+	return nil
+}
+
+// getRetryBackoff returns a delay before the attempt. It doubles with
+// each attempt up to a maximal backoff. A random half of the delay is
+// jitter, so clients which have failed together do not retry together.
+func getRetryBackoff(policy config.RetryPolicy, attempt int) time.Duration {
+	backoff := policy.Backoff.Duration
+	if backoff <= 0 {
+		return 0
+	}
+
+	maxBackoff := policy.MaxBackoff.Duration
+
+	for i := 1; i < attempt && (maxBackoff == 0 || backoff < maxBackoff); i++ {
+		backoff *= 2
+	}
+
+	if maxBackoff > 0 && backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	half := backoff / 2 // nolint: gomnd
+
+	return half + time.Duration(rand.Int63n(int64(half)+1)) // nolint: gosec
+}
+
+// NewRetryLayer returns a layer which retries failed requests according
+// to configured retry policies. If there are none, default policy is
+// used.
+func NewRetryLayer(conf *config.Config, executor executor.Executor) layers.Layer {
+	layer := &RetryLayer{
+		policies: map[string]config.RetryPolicy{},
+		executor: executor,
+	}
+
+	for _, v := range conf.Retries {
+		layer.policies[v.Error] = v
+	}
+
+	if len(layer.policies) == 0 {
+		layer.policies[defaultRetryPolicy.Error] = defaultRetryPolicy
+	}
+
+	return layer
+}
@@ -0,0 +1,152 @@
+package layers
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type RetryTestSuite struct {
+	CommonLayerTestSuite
+
+	conf      *config.Config
+	responses []string
+	executed  int
+}
+
+func (suite *RetryTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.responses = nil
+	suite.executed = 0
+}
+
+// executor returns responses with X-Crawlera-Error headers from the
+// list one by one. An empty value means a good response.
+func (suite *RetryTestSuite) executor(ctx *layers.Context) error {
+	ctx.Response().Header.Del("X-Crawlera-Error")
+
+	if suite.executed < len(suite.responses) && suite.responses[suite.executed] != "" {
+		ctx.Response().Header.Set("X-Crawlera-Error", suite.responses[suite.executed])
+	}
+
+	suite.executed++
+
+	return nil
+}
+
+func (suite *RetryTestSuite) failWith(crawleraError string) {
+	suite.ctx.ResponseHeaders.Set("X-Crawlera-Error", crawleraError, true)
+}
+
+func (suite *RetryTestSuite) layer() *RetryLayer {
+	return NewRetryLayer(suite.conf, suite.executor).(*RetryLayer)
+}
+
+func (suite *RetryTestSuite) retriesStats(expected string) {
+	encoded, err := json.Marshal(getMetrics(suite.ctx).Retries)
+
+	suite.NoError(err)
+	suite.JSONEq(expected, string(encoded))
+}
+
+func (suite *RetryTestSuite) TestNoError() {
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Equal(0, suite.executed)
+}
+
+func (suite *RetryTestSuite) TestDefaultPolicy() {
+	suite.failWith("banned")
+
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Equal(1, suite.executed)
+	suite.Nil(suite.ctx.ResponseHeaders.GetLast("X-Crawlera-Error"))
+
+	suite.retriesStats(`{"banned":{"attempts":1,"succeeded":1,"failed":0}}`)
+}
+
+func (suite *RetryTestSuite) TestAttempts() {
+	suite.conf.Retries = []config.RetryPolicy{{Error: "banned", Attempts: 3}}
+	suite.responses = []string{"banned", "banned", "banned"}
+	suite.failWith("banned")
+
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Equal(3, suite.executed)
+	suite.Equal("banned", suite.ctx.ResponseHeaders.GetLast("X-Crawlera-Error").Value())
+
+	suite.retriesStats(`{"banned":{"attempts":3,"succeeded":0,"failed":1}}`)
+}
+
+func (suite *RetryTestSuite) TestUnknownError() {
+	suite.conf.Retries = []config.RetryPolicy{{Error: "banned", Attempts: 3}}
+	suite.failWith("bad_header")
+
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Equal(0, suite.executed)
+}
+
+func (suite *RetryTestSuite) TestStatusCode() {
+	suite.conf.Retries = []config.RetryPolicy{{Error: "429", Attempts: 1}}
+	suite.ctx.Response().SetStatusCode(429)
+
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Equal(1, suite.executed)
+}
+
+func (suite *RetryTestSuite) TestErrorHasPriority() {
+	suite.conf.Retries = []config.RetryPolicy{
+		{Error: "503", Attempts: 1},
+		{Error: "slavebanned", Attempts: 2},
+	}
+	suite.ctx.Response().SetStatusCode(503)
+	suite.failWith("slavebanned")
+
+	reason, policy, ok := suite.layer().getPolicy(suite.ctx)
+	suite.True(ok)
+	suite.Equal("slavebanned", reason)
+	suite.Equal(2, policy.Attempts)
+}
+
+func (suite *RetryTestSuite) TestDeadline() {
+	suite.conf.Retries = []config.RetryPolicy{{
+		Error:    "banned",
+		Attempts: 10,
+		Backoff:  config.Duration{Duration: 20 * time.Millisecond},
+		Deadline: config.Duration{Duration: 100 * time.Millisecond},
+	}}
+	suite.responses = []string{"banned", "banned", "banned", "banned", "banned"}
+	suite.failWith("banned")
+
+	suite.NoError(suite.layer().OnResponse(suite.ctx, nil))
+	suite.Less(suite.executed, 5)
+	suite.Greater(suite.executed, 0)
+}
+
+func (suite *RetryTestSuite) TestBackoff() {
+	policy := config.RetryPolicy{
+		Backoff:    config.Duration{Duration: time.Second},
+		MaxBackoff: config.Duration{Duration: 5 * time.Second},
+	}
+
+	inRange := func(value, low, high time.Duration) {
+		suite.True(value >= low && value <= high, "%v is not in [%v, %v]", value, low, high)
+	}
+
+	for i := 0; i < 100; i++ {
+		inRange(getRetryBackoff(policy, 1), 500*time.Millisecond, time.Second)
+		inRange(getRetryBackoff(policy, 3), 2*time.Second, 4*time.Second)
+		inRange(getRetryBackoff(policy, 10), 2500*time.Millisecond, 5*time.Second)
+	}
+
+	suite.Zero(getRetryBackoff(config.RetryPolicy{}, 3))
+}
+
+func TestRetry(t *testing.T) {
+	suite.Run(t, &RetryTestSuite{})
+}
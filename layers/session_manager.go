@@ -1,7 +1,9 @@
 package layers
 
 import (
+	"context"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"net"
@@ -9,50 +11,164 @@ import (
 	"net/url"
 	"path"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
 const (
-	sessionClientTimeout      = 180 * time.Second
-	sessionClientTimeoutRetry = 30 * time.Second
-	sessionAPITimeout         = 10 * time.Second
-	sessionTTL                = 5 * time.Minute
-
 	sessionUserAgent = "crawlera-headless-proxy"
+
+	sessionDeleteWaitInterval = 100 * time.Millisecond
 )
 
+// sessionManagerOpts are settings of session managers. Zero maxAge and
+// maxRequests mean that sessions are not rotated on purpose. Requests to
+// Crawlera API are sent with transport; if it is nil, they go directly
+// to crawleraHost.
+type sessionManagerOpts struct {
+	crawleraHost       string
+	transport          http.RoundTripper
+	size               int
+	balancing          string
+	createTimeout      time.Duration
+	createRetryTimeout time.Duration
+	apiTimeout         time.Duration
+	ttl                time.Duration
+	maxAge             time.Duration
+	maxRequests        int
+}
+
+func newSessionManagerOpts(conf *config.Config) sessionManagerOpts {
+	return sessionManagerOpts{
+		crawleraHost:       net.JoinHostPort(conf.CrawleraHost, strconv.Itoa(conf.CrawleraPort)),
+		size:               conf.SessionsPerClient,
+		balancing:          conf.SessionBalancing,
+		createTimeout:      conf.SessionCreateTimeout.Duration,
+		createRetryTimeout: conf.SessionCreateRetryTimeout.Duration,
+		apiTimeout:         conf.SessionAPITimeout.Duration,
+		ttl:                conf.SessionTTL.Duration,
+		maxAge:             conf.SessionMaxAge.Duration,
+		maxRequests:        conf.SessionMaxRequests,
+	}
+}
+
+// sessionManager manages a pool of Crawlera sessions of a single
+// client. All state is owned by a goroutine started with Start, other
+// goroutines talk to it with channels.
+//
+// Each session lives in its own slot. A request gets a session of the
+// slot chosen by balancing strategy. If this slot has no session, the
+// request gets a channel and has to create a new session with Crawlera
+// and send its ID back. Meanwhile other requests keep using sessions
+// of other slots.
+//
+// Sessions are rotated on purpose when they reach maximal age or
+// number of requests.
+//
+// A session can be pinned via API. Pinned session is used for all
+// requests until it is broken, expired or rotated.
+//
+// Settings can be changed on configuration reload with setOpts.
+//
+// A manager without sessions for longer than TTL reports itself with
+// onIdle, so its owner can remove and stop it. Stopped manager does
+// not serve requests anymore.
 type sessionManager struct {
-	id           string
-	apiKey       string
-	crawleraHost string
-	lastUsed     time.Time
+	// a number of sessions which are queued for deletion or are being
+	// deleted from Crawlera.
+	deleting int64
+
+	// the latest settings; unlike opts, they can be read by any
+	// goroutine.
+	configured atomic.Value
+
+	apiKey  string
+	opts    sessionManagerOpts
+	slots   []sessionSlot
+	pinned  sessionSlot
+	next    int
+	pending []*sessionIDRequest
+	errors  uint64
+
+	// when the manager has lost its last session; zero if it has
+	// sessions.
+	emptySince time.Time
+	onIdle     func()
+
+	requestIDChan      chan *sessionIDRequest
+	brokenSessionChan  chan string
+	createdSessionChan chan createdSession
+	callChan           chan func()
+	sessionsToDelete   chan string
+	stopChan           chan struct{}
+}
+
+type sessionSlot struct {
+	id       string
+	created  time.Time
+	lastUsed time.Time
+	requests int
+	creating bool
+}
+
+func (s *sessionSlot) set(id string) {
+	s.id = id
+	s.created = time.Now()
+	s.lastUsed = s.created
+}
+
+func (s *sessionSlot) reset() {
+	s.id = ""
+	s.created = time.Time{}
+	s.lastUsed = time.Time{}
+	s.requests = 0
+}
+
+func (s *sessionSlot) info(pinned bool) stats.Session {
+	return stats.Session{
+		ID:       s.id,
+		Age:      int(time.Since(s.created).Seconds()),
+		LastUsed: s.lastUsed,
+		Requests: s.requests,
+		Pinned:   pinned,
+	}
+}
 
-	requestIDChan     chan *sessionIDRequest
-	brokenSessionChan chan string
-	sessionsToDelete  chan string
+type createdSession struct {
+	slot int
+	id   string
 }
 
 type sessionIDRequest struct {
 	channel chan<- interface{}
+	host    string
 	retry   bool
 }
 
-func (s *sessionManager) getSessionID(retry bool) interface{} {
+// getSessionID returns either ID of the session or a channel to send
+// ID of the new session to. It returns nil if the manager is stopped.
+func (s *sessionManager) getSessionID(host string, retry bool) interface{} {
 	respChan := make(chan interface{})
 	defer close(respChan)
 
-	s.requestIDChan <- &sessionIDRequest{
-		channel: respChan,
-		retry:   retry,
+	select {
+	case s.requestIDChan <- &sessionIDRequest{channel: respChan, host: host, retry: retry}:
+		return <-respChan
+	case <-s.stopChan:
+		return nil
 	}
-
-	return <-respChan
 }
 
-func (s *sessionManager) getBrokenSessionChan() chan<- string {
-	return s.brokenSessionChan
+func (s *sessionManager) reportBrokenSession(sessionID string) {
+	select {
+	case s.brokenSessionChan <- sessionID:
+	case <-s.stopChan:
+	}
 }
 
 func (s *sessionManager) Start() {
@@ -64,67 +180,471 @@ func (s *sessionManager) Start() {
 	for {
 		select {
 		case feedback := <-s.requestIDChan:
-			if s.id == "" {
-				s.requestNewSession(feedback)
-			} else {
-				feedback.channel <- s.id
-				s.lastUsed = time.Now()
-			}
+			s.onRequest(feedback)
 		case brokenSession := <-s.brokenSessionChan:
-			if s.id == brokenSession {
-				s.sessionsToDelete <- brokenSession
-				s.id = ""
-				s.lastUsed = time.Time{}
-			} else {
-				log.WithFields(log.Fields{
-					"current-id": s.id,
-					"broken-id":  brokenSession,
-				}).Debug("Unknown broken session has been reported.")
-			}
+			s.onBrokenSession(brokenSession)
+		case created := <-s.createdSessionChan:
+			s.onCreatedSession(created)
+		case fn := <-s.callChan:
+			fn()
 		case <-ticker.C:
-			if !s.lastUsed.IsZero() && s.id != "" && time.Since(s.lastUsed) >= sessionTTL {
-				log.WithFields(log.Fields{
-					"id": s.id,
-				}).Debug("Delete session by timeout")
-
-				s.sessionsToDelete <- s.id
-				s.id = ""
-				s.lastUsed = time.Time{}
+			s.deleteExpiredSessions()
+			s.checkIdle()
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+// stop terminates goroutines of the manager. Sessions which are still
+// queued for deletion are not deleted, so the manager should be stopped
+// only after waitDeleted.
+func (s *sessionManager) stop() {
+	close(s.stopChan)
+}
+
+// call runs fn in the goroutine of the manager and waits until it is
+// done. If the manager is stopped, fn is not run.
+func (s *sessionManager) call(fn func()) {
+	done := make(chan struct{})
+
+	select {
+	case s.callChan <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-s.stopChan:
+	}
+}
+
+// isIdle tells if the manager has neither sessions nor requests which
+// are waiting for them, and all dropped sessions are deleted.
+func (s *sessionManager) isIdle() bool {
+	idle := false
+
+	s.call(func() {
+		idle = s.isEmpty() && atomic.LoadInt64(&s.deleting) == 0
+	})
+
+	return idle
+}
+
+func (s *sessionManager) isEmpty() bool {
+	if s.pinned.id != "" || len(s.pending) > 0 {
+		return false
+	}
+
+	for i := range s.slots {
+		if s.slots[i].id != "" || s.slots[i].creating {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkIdle calls onIdle if the manager has no sessions for longer
+// than TTL.
+func (s *sessionManager) checkIdle() {
+	switch {
+	case !s.isEmpty():
+		s.emptySince = time.Time{}
+	case s.emptySince.IsZero():
+		s.emptySince = time.Now()
+	case time.Since(s.emptySince) >= s.opts.ttl && s.onIdle != nil:
+		s.emptySince = time.Time{}
+		go s.onIdle()
+	}
+}
+
+func (s *sessionManager) snapshot(client string) stats.ClientSessions {
+	rv := stats.ClientSessions{
+		Client:   client,
+		Sessions: []stats.Session{},
+	}
+
+	s.call(func() {
+		rv.Errors = s.errors
+
+		if s.pinned.id != "" {
+			rv.Sessions = append(rv.Sessions, s.pinned.info(true))
+		}
+
+		for i := range s.slots {
+			if s.slots[i].id != "" {
+				rv.Sessions = append(rv.Sessions, s.slots[i].info(false))
+			}
+		}
+	})
+
+	return rv
+}
+
+// rotate drops all sessions of the client, including the pinned one.
+// New sessions are created by the next requests.
+func (s *sessionManager) rotate() {
+	s.call(func() {
+		s.dropSession(&s.pinned)
+
+		for i := range s.slots {
+			s.dropSession(&s.slots[i])
+		}
+	})
+}
+
+// release drops sessions on shutdown. If all is not set, only expired
+// sessions are dropped.
+func (s *sessionManager) release(all bool) {
+	s.call(func() {
+		if all || s.isExpired(&s.pinned) {
+			s.dropSession(&s.pinned)
+		}
+
+		for i := range s.slots {
+			if all || s.isExpired(&s.slots[i]) {
+				s.dropSession(&s.slots[i])
 			}
 		}
+	})
+}
+
+// waitDeleted blocks until all dropped sessions are deleted from
+// Crawlera or context is closed.
+func (s *sessionManager) waitDeleted(ctx context.Context) error {
+	ticker := time.NewTicker(sessionDeleteWaitInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&s.deleting) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d sessions are not deleted: %w", atomic.LoadInt64(&s.deleting), ctx.Err())
+		case <-ticker.C:
+		}
 	}
+
+	return nil
 }
 
-func (s *sessionManager) startCrawleraAPISessionDeleter() {
-	for sessionID := range s.sessionsToDelete {
-		if sessionID == "" {
-			continue
+func (s *sessionManager) pin(sessionID string) {
+	s.call(func() {
+		if s.pinned.id != sessionID {
+			s.dropSession(&s.pinned)
+			s.pinned.set(sessionID)
 		}
+	})
+}
 
-		if err := s.deleteCrawleraSession(sessionID); err != nil {
-			log.WithFields(log.Fields{
-				"session-id": sessionID,
-				"error":      err,
-			}).Warn("Cannot delete session from Crawlera")
+// setOpts applies new settings to the running manager. If a number of
+// sessions per client is reduced, sessions of the extra slots are
+// deleted.
+func (s *sessionManager) setOpts(opts sessionManagerOpts) {
+	if s.getOpts() == opts {
+		return
+	}
+
+	s.configured.Store(opts)
+	s.call(func() {
+		s.opts = opts
+
+		for i := opts.size; i < len(s.slots); i++ {
+			s.dropSession(&s.slots[i])
+		}
+
+		if opts.size < len(s.slots) {
+			s.slots = s.slots[:opts.size]
 		} else {
+			s.slots = append(s.slots, make([]sessionSlot, opts.size-len(s.slots))...)
+		}
+
+		s.next %= len(s.slots)
+	})
+}
+
+func (s *sessionManager) getOpts() sessionManagerOpts {
+	return s.configured.Load().(sessionManagerOpts)
+}
+
+func (s *sessionManager) onRequest(feedback *sessionIDRequest) {
+	if s.pinned.id != "" {
+		feedback.channel <- s.pinned.id
+		s.pinned.lastUsed = time.Now()
+		s.pinned.requests++
+
+		return
+	}
+
+	s.deleteExhaustedSessions()
+
+	chosen := s.chooseSlot(feedback.host)
+
+	switch {
+	case s.slots[chosen].id != "":
+		s.useSession(chosen, feedback)
+
+		return
+	case !s.slots[chosen].creating:
+		s.createSession(chosen, feedback)
+
+		return
+	}
+
+	for i := range s.slots {
+		if s.slots[i].id != "" {
+			s.useSession(i, feedback)
+
+			return
+		}
+	}
+
+	for i := range s.slots {
+		if !s.slots[i].creating {
+			s.createSession(i, feedback)
+
+			return
+		}
+	}
+
+	s.pending = append(s.pending, feedback)
+}
+
+func (s *sessionManager) onBrokenSession(brokenSession string) {
+	if s.pinned.id == brokenSession {
+		s.errors++
+		s.dropSession(&s.pinned)
+
+		return
+	}
+
+	for i := range s.slots {
+		if s.slots[i].id == brokenSession {
+			s.errors++
+			s.dropSession(&s.slots[i])
+
+			return
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"broken-id": brokenSession,
+	}).Debug("Unknown broken session has been reported.")
+}
+
+func (s *sessionManager) onCreatedSession(created createdSession) {
+	if created.slot >= len(s.slots) {
+		s.onRemovedSlotSession(created)
+		return
+	}
+
+	slot := &s.slots[created.slot]
+	slot.creating = false
+
+	if created.id != "" {
+		slot.set(created.id)
+		slot.requests = 1 + len(s.pending)
+
+		for _, feedback := range s.pending {
+			feedback.channel <- slot.id
+		}
+
+		s.pending = nil
+
+		return
+	}
+
+	if len(s.pending) > 0 {
+		feedback := s.pending[0]
+		s.pending = s.pending[1:]
+		s.createSession(created.slot, feedback)
+	}
+}
+
+// onRemovedSlotSession handles a session created for a slot which was
+// removed by setOpts meanwhile. The session is not needed anymore and
+// pending requests are served by the remaining slots.
+func (s *sessionManager) onRemovedSlotSession(created createdSession) {
+	if created.id != "" {
+		s.deleteLater(created.id)
+	}
+
+	pending := s.pending
+	s.pending = nil
+
+	for _, feedback := range pending {
+		s.onRequest(feedback)
+	}
+}
+
+func (s *sessionManager) deleteExpiredSessions() {
+	s.deleteExpiredSession(&s.pinned)
+
+	for i := range s.slots {
+		s.deleteExpiredSession(&s.slots[i])
+	}
+}
+
+func (s *sessionManager) deleteExpiredSession(slot *sessionSlot) {
+	if s.isExpired(slot) {
+		log.WithFields(log.Fields{
+			"id": slot.id,
+		}).Debug("Delete expired session")
+
+		s.dropSession(slot)
+	}
+}
+
+// isExpired checks if session in the slot is unused for longer than TTL
+// or is older than max age. Pinned sessions have no max age.
+func (s *sessionManager) isExpired(slot *sessionSlot) bool {
+	switch {
+	case slot.id == "":
+		return false
+	case time.Since(slot.lastUsed) >= s.opts.ttl:
+		return true
+	case slot != &s.pinned && s.opts.maxAge > 0 && time.Since(slot.created) >= s.opts.maxAge:
+		return true
+	}
+
+	return false
+}
+
+// deleteExhaustedSessions rotates sessions which have served maximal
+// number of requests.
+func (s *sessionManager) deleteExhaustedSessions() {
+	if s.opts.maxRequests == 0 {
+		return
+	}
+
+	for i := range s.slots {
+		if slot := &s.slots[i]; slot.id != "" && slot.requests >= s.opts.maxRequests {
 			log.WithFields(log.Fields{
-				"session-id": sessionID,
-			}).Warn("Session was deleted from Crawlera")
+				"id": slot.id,
+			}).Debug("Rotate session by max requests")
+
+			s.dropSession(slot)
 		}
 	}
 }
 
+// dropSession removes a session from the slot and deletes it from
+// Crawlera.
+func (s *sessionManager) dropSession(slot *sessionSlot) {
+	if slot.id != "" {
+		s.deleteLater(slot.id)
+		slot.reset()
+	}
+}
+
+// deleteLater queues a session to be deleted from Crawlera in
+// background. It never blocks the manager: if the queue is full (for
+// example, Crawlera API is slow), the session is queued by a separate
+// goroutine.
+func (s *sessionManager) deleteLater(sessionID string) {
+	atomic.AddInt64(&s.deleting, 1)
+
+	select {
+	case s.sessionsToDelete <- sessionID:
+	default:
+		go func() {
+			select {
+			case s.sessionsToDelete <- sessionID:
+			case <-s.stopChan:
+			}
+		}()
+	}
+}
+
+func (s *sessionManager) chooseSlot(host string) int {
+	if s.opts.balancing == config.SessionBalancingHost {
+		hash := fnv.New32a()
+		hash.Write([]byte(host)) // nolint: errcheck
+
+		return int(hash.Sum32() % uint32(len(s.slots)))
+	}
+
+	chosen := s.next
+	s.next = (s.next + 1) % len(s.slots)
+
+	return chosen
+}
+
+func (s *sessionManager) useSession(slot int, feedback *sessionIDRequest) {
+	feedback.channel <- s.slots[slot].id
+	s.slots[slot].lastUsed = time.Now()
+	s.slots[slot].requests++
+}
+
+// createSession makes the request to create a new session for the
+// slot. A session ID is waited for in a separate goroutine, so other
+// requests are served meanwhile.
+func (s *sessionManager) createSession(slot int, feedback *sessionIDRequest) {
+	newSessionChan := make(chan string, 1)
+	feedback.channel <- (chan<- string(newSessionChan))
+	s.slots[slot].creating = true
+
+	timeAfter := s.getTimeoutChannel(feedback.retry)
+
+	go func() {
+		created := createdSession{slot: slot}
+
+		select {
+		case created.id = <-newSessionChan:
+		case <-timeAfter:
+			log.Debug("Timeout in waiting for the new session.")
+		}
+
+		select {
+		case s.createdSessionChan <- created:
+		case <-s.stopChan:
+			if created.id != "" {
+				s.deleteSession(created.id)
+			}
+		}
+	}()
+}
+
+func (s *sessionManager) startCrawleraAPISessionDeleter() {
+	for {
+		select {
+		case sessionID := <-s.sessionsToDelete:
+			if sessionID != "" {
+				s.deleteSession(sessionID)
+				atomic.AddInt64(&s.deleting, -1)
+			}
+		case <-s.stopChan:
+			return
+		}
+	}
+}
+
+func (s *sessionManager) deleteSession(sessionID string) {
+	if err := s.deleteCrawleraSession(sessionID); err != nil {
+		log.WithFields(log.Fields{
+			"session-id": sessionID,
+			"error":      err,
+		}).Warn("Cannot delete session from Crawlera")
+	} else {
+		log.WithFields(log.Fields{
+			"session-id": sessionID,
+		}).Warn("Session was deleted from Crawlera")
+	}
+}
+
 func (s *sessionManager) deleteCrawleraSession(sessionID string) error {
+	opts := s.getOpts()
 	apiURL := url.URL{
 		Scheme: "http",
-		Host:   s.crawleraHost,
+		Host:   opts.crawleraHost,
 		Path:   path.Join("sessions", sessionID),
 	}
 	req, _ := http.NewRequest("DELETE", apiURL.String(), http.NoBody) // nolint: gosec
 	req.SetBasicAuth(s.apiKey, "")
 	req.Header.Set("User-Agent", sessionUserAgent)
 
-	client := &http.Client{Timeout: sessionAPITimeout}
+	client := &http.Client{
+		Transport: opts.transport,
+		Timeout:   opts.apiTimeout,
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -142,53 +662,27 @@ func (s *sessionManager) deleteCrawleraSession(sessionID string) error {
 	return nil
 }
 
-func (s *sessionManager) requestNewSession(feedback *sessionIDRequest) {
-	newSessionChan := make(chan string, 1)
-	feedback.channel <- (chan<- string(newSessionChan))
-
-	timeAfter := s.getTimeoutChannel(feedback.retry)
-
-	for {
-		select {
-		case brokenSession := <-s.brokenSessionChan:
-			if s.id == brokenSession {
-				s.sessionsToDelete <- brokenSession
-				s.id = ""
-				s.lastUsed = time.Time{}
-			} else {
-				log.WithFields(log.Fields{
-					"current-id": s.id,
-					"broken-id":  brokenSession,
-				}).Debug("Unknown broken session has been reported.")
-			}
-		case newSession, notClosed := <-newSessionChan:
-			if notClosed {
-				s.id = newSession
-				s.lastUsed = time.Now()
-			}
-
-			return
-		case <-timeAfter:
-			log.Debug("Timeout in waiting for the new session.")
-			return
-		}
-	}
-}
-
 func (s *sessionManager) getTimeoutChannel(retry bool) <-chan time.Time {
 	if retry {
-		return time.After(sessionClientTimeoutRetry)
+		return time.After(s.opts.createRetryTimeout)
 	}
 
-	return time.After(sessionClientTimeout)
+	return time.After(s.opts.createTimeout)
 }
 
-func newSessionManager(apiKey, crawleraHost string, crawleraPort int) *sessionManager {
-	return &sessionManager{
-		apiKey:            apiKey,
-		crawleraHost:      net.JoinHostPort(crawleraHost, strconv.Itoa(crawleraPort)),
-		requestIDChan:     make(chan *sessionIDRequest),
-		brokenSessionChan: make(chan string),
-		sessionsToDelete:  make(chan string, 1),
+func newSessionManager(apiKey string, opts sessionManagerOpts) *sessionManager {
+	mgr := &sessionManager{
+		apiKey:             apiKey,
+		opts:               opts,
+		slots:              make([]sessionSlot, opts.size),
+		requestIDChan:      make(chan *sessionIDRequest),
+		brokenSessionChan:  make(chan string),
+		createdSessionChan: make(chan createdSession),
+		callChan:           make(chan func()),
+		sessionsToDelete:   make(chan string, opts.size+1),
+		stopChan:           make(chan struct{}),
 	}
+	mgr.configured.Store(opts)
+
+	return mgr
 }
@@ -0,0 +1,533 @@
+package layers
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type SessionManagerTestSuite struct {
+	suite.Suite
+
+	conf    *config.Config
+	server  *httptest.Server
+	deleted chan string
+}
+
+func (suite *SessionManagerTestSuite) SetupTest() {
+	suite.deleted = make(chan string, 10)
+	suite.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suite.deleted <- r.URL.Path
+	}))
+
+	host, portRaw, _ := net.SplitHostPort(suite.server.Listener.Addr().String())
+	port, _ := strconv.Atoi(portRaw)
+
+	suite.conf = config.NewConfig()
+	suite.conf.CrawleraHost = host
+	suite.conf.CrawleraPort = port
+}
+
+func (suite *SessionManagerTestSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *SessionManagerTestSuite) newManager(size int, balancing string) *sessionManager {
+	suite.conf.SessionsPerClient = size
+	suite.conf.SessionBalancing = balancing
+
+	return newSessionManager("apikey", newSessionManagerOpts(suite.conf))
+}
+
+func (suite *SessionManagerTestSuite) makeManager(size int, balancing string) *sessionManager {
+	mgr := suite.newManager(size, balancing)
+	go mgr.Start()
+
+	return mgr
+}
+
+func (suite *SessionManagerTestSuite) create(mgr *sessionManager, host, sessionID string) {
+	channel, ok := mgr.getSessionID(host, false).(chan<- string)
+	suite.True(ok)
+
+	channel <- sessionID
+	close(channel)
+}
+
+func (suite *SessionManagerTestSuite) waitForSession(mgr *sessionManager, host, sessionID string) {
+	suite.Eventually(func() bool {
+		return mgr.getSessionID(host, false) == sessionID
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (suite *SessionManagerTestSuite) TestRoundRobin() {
+	mgr := suite.makeManager(2, config.SessionBalancingRoundRobin)
+
+	first, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	second, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	first <- "first"
+	second <- "second"
+
+	suite.waitForSession(mgr, "example.com", "second")
+	suite.Equal("first", mgr.getSessionID("example.com", false))
+	suite.Equal("second", mgr.getSessionID("example.com", false))
+}
+
+func (suite *SessionManagerTestSuite) TestHost() {
+	mgr := suite.makeManager(8, config.SessionBalancingHost)
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+
+	for i := 0; i < 5; i++ {
+		suite.Equal("first", mgr.getSessionID("example.com", false))
+	}
+}
+
+func (suite *SessionManagerTestSuite) TestReplaceBrokenSession() {
+	mgr := suite.makeManager(2, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.create(mgr, "example.com", "second")
+	suite.waitForSession(mgr, "example.com", "second")
+
+	mgr.reportBrokenSession("first")
+	suite.Equal("/sessions/first", <-suite.deleted)
+
+	replacement, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	suite.Equal("second", mgr.getSessionID("example.com", false))
+	suite.Equal("second", mgr.getSessionID("example.com", false))
+
+	replacement <- "third"
+
+	suite.waitForSession(mgr, "example.com", "third")
+}
+
+func (suite *SessionManagerTestSuite) TestPending() {
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	channel, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	result := make(chan interface{}, 1)
+
+	go func() {
+		result <- mgr.getSessionID("example.com", false)
+	}()
+
+	select {
+	case <-result:
+		suite.FailNow("request has to wait for a new session")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	channel <- "first"
+
+	suite.Equal("first", <-result)
+}
+
+func (suite *SessionManagerTestSuite) TestPendingFailure() {
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	channel, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	result := make(chan interface{}, 1)
+
+	go func() {
+		result <- mgr.getSessionID("example.com", false)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(channel)
+
+	_, ok = (<-result).(chan<- string)
+	suite.True(ok)
+}
+
+func (suite *SessionManagerTestSuite) TestRotate() {
+	mgr := suite.makeManager(2, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.create(mgr, "example.com", "second")
+	suite.waitForSession(mgr, "example.com", "second")
+
+	mgr.rotate()
+
+	suite.ElementsMatch([]string{"/sessions/first", "/sessions/second"},
+		[]string{<-suite.deleted, <-suite.deleted})
+	suite.Empty(mgr.snapshot("client").Sessions)
+
+	_, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+}
+
+func (suite *SessionManagerTestSuite) TestPin() {
+	mgr := suite.makeManager(2, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+
+	mgr.pin("pinned")
+
+	for i := 0; i < 3; i++ {
+		suite.Equal("pinned", mgr.getSessionID("example.com", false))
+	}
+
+	snapshot := mgr.snapshot("client")
+	suite.Equal("client", snapshot.Client)
+	suite.Len(snapshot.Sessions, 2)
+	suite.Equal("pinned", snapshot.Sessions[0].ID)
+	suite.True(snapshot.Sessions[0].Pinned)
+	suite.Equal("first", snapshot.Sessions[1].ID)
+	suite.False(snapshot.Sessions[1].Pinned)
+
+	mgr.reportBrokenSession("pinned")
+	suite.Equal("/sessions/pinned", <-suite.deleted)
+
+	suite.Equal("first", mgr.getSessionID("example.com", false))
+	suite.EqualValues(1, mgr.snapshot("client").Errors)
+}
+
+func (suite *SessionManagerTestSuite) TestManagers() {
+	managers := NewSessionManagers("", nil)
+
+	suite.False(managers.RotateSessions("client"))
+	suite.False(managers.PinSession("client", "pinned"))
+	suite.Empty(managers.ListSessions())
+
+	opts := newSessionManagerOpts(suite.conf)
+	mgr := managers.getOrCreate("client", "apikey", opts)
+	suite.Same(mgr, managers.getOrCreate("client", "apikey", opts))
+
+	suite.True(managers.PinSession("client", "pinned"))
+	suite.Equal("pinned", mgr.getSessionID("example.com", false))
+
+	sessions := managers.ListSessions()
+	suite.Len(sessions, 1)
+	suite.Equal("client", sessions[0].Client)
+	suite.Equal("pinned", sessions[0].Sessions[0].ID)
+
+	suite.True(managers.RotateSessions("client"))
+	suite.Equal("/sessions/pinned", <-suite.deleted)
+}
+
+func (suite *SessionManagerTestSuite) TestReloadOpts() {
+	managers := NewSessionManagers("", nil)
+
+	suite.conf.SessionsPerClient = 2
+	mgr := managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+
+	suite.create(mgr, "example.com", "first")
+	suite.create(mgr, "example.com", "second")
+	suite.waitForSession(mgr, "example.com", "second")
+
+	suite.conf.SessionsPerClient = 1
+	suite.conf.SessionMaxRequests = 10
+	suite.Same(mgr, managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf)))
+
+	suite.Equal("/sessions/second", <-suite.deleted)
+	suite.Len(mgr.snapshot("client").Sessions, 1)
+	suite.Equal(10, mgr.getOpts().maxRequests)
+
+	suite.conf.SessionsPerClient = 3
+	managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+
+	mgr.call(func() {
+		suite.Len(mgr.slots, 3)
+		suite.Equal("first", mgr.slots[0].id)
+	})
+}
+
+func (suite *SessionManagerTestSuite) TestReloadAPIKey() {
+	managers := NewSessionManagers("", nil)
+	opts := newSessionManagerOpts(suite.conf)
+
+	mgr := managers.getOrCreate("client", "apikey", opts)
+	mgr.pin("pinned")
+
+	replaced := managers.getOrCreate("client", "newkey", opts)
+	suite.NotSame(mgr, replaced)
+	suite.Equal("newkey", replaced.apiKey)
+	suite.Same(replaced, managers.getOrCreate("client", "newkey", opts))
+	suite.Equal("/sessions/pinned", <-suite.deleted)
+
+	select {
+	case <-mgr.stopChan:
+	case <-time.After(time.Second):
+		suite.Fail("replaced manager is not stopped")
+	}
+
+	suite.Nil(mgr.getSessionID("example.com", false))
+}
+
+func (suite *SessionManagerTestSuite) TestReloadRemovedSlot() {
+	suite.conf.SessionsPerClient = 2
+	mgr := suite.makeManager(2, config.SessionBalancingRoundRobin)
+
+	first, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	second, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	suite.conf.SessionsPerClient = 1
+	mgr.setOpts(newSessionManagerOpts(suite.conf))
+
+	second <- "second"
+	close(second)
+	suite.Equal("/sessions/second", <-suite.deleted)
+
+	first <- "first"
+	close(first)
+	suite.waitForSession(mgr, "example.com", "first")
+}
+
+func (suite *SessionManagerTestSuite) TestSlowDeletion() {
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 20; i++ {
+			mgr.pin(strconv.Itoa(i))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		suite.FailNow("manager is blocked by session deletion")
+	}
+
+	for i := 0; i < 19; i++ {
+		<-suite.deleted
+	}
+
+	suite.NoError(mgr.waitDeleted(context.Background()))
+}
+
+func (suite *SessionManagerTestSuite) TestMaxRequests() {
+	suite.conf.SessionMaxRequests = 3
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+	suite.Equal("first", mgr.getSessionID("example.com", false))
+	suite.Equal(3, mgr.snapshot("client").Sessions[0].Requests)
+
+	_, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+	suite.Equal("/sessions/first", <-suite.deleted)
+}
+
+func (suite *SessionManagerTestSuite) TestMaxAge() {
+	suite.conf.SessionMaxAge.Duration = time.Second
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+
+	select {
+	case path := <-suite.deleted:
+		suite.Equal("/sessions/first", path)
+	case <-time.After(3 * time.Second):
+		suite.FailNow("session was not rotated")
+	}
+
+	suite.Empty(mgr.snapshot("client").Sessions)
+}
+
+func (suite *SessionManagerTestSuite) TestTTL() {
+	suite.conf.SessionTTL.Duration = time.Second
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+	mgr.pin("pinned")
+
+	suite.ElementsMatch([]string{"/sessions/first", "/sessions/pinned"},
+		[]string{<-suite.deleted, <-suite.deleted})
+}
+
+func (suite *SessionManagerTestSuite) TestIdleManagers() {
+	managers := NewSessionManagers("", nil)
+
+	suite.conf.SessionTTL.Duration = 10 * time.Millisecond
+	opts := newSessionManagerOpts(suite.conf)
+
+	first := managers.getOrCreate("client@example.com", "apikey", opts)
+	suite.create(first, "example.com", "first")
+	suite.waitForSession(first, "example.com", "first")
+
+	second := managers.getOrCreate("client@example.org", "apikey", opts)
+	suite.create(second, "example.org", "second")
+	suite.waitForSession(second, "example.org", "second")
+
+	suite.Len(managers.ListSessions(), 2)
+	suite.ElementsMatch([]string{"/sessions/first", "/sessions/second"},
+		[]string{<-suite.deleted, <-suite.deleted})
+
+	suite.Eventually(func() bool {
+		return len(managers.ListSessions()) == 0
+	}, 5*time.Second, 100*time.Millisecond)
+
+	for _, mgr := range []*sessionManager{first, second} {
+		select {
+		case <-mgr.stopChan:
+		default:
+			suite.Fail("idle manager is not stopped")
+		}
+
+		suite.Nil(mgr.getSessionID("example.com", false))
+	}
+
+	mgr := managers.getOrCreate("client@example.com", "apikey", opts)
+	suite.NotSame(first, mgr)
+	suite.create(mgr, "example.com", "third")
+	suite.waitForSession(mgr, "example.com", "third")
+}
+
+func (suite *SessionManagerTestSuite) TestCreateTimeout() {
+	suite.conf.SessionCreateTimeout.Duration = 50 * time.Millisecond
+	mgr := suite.makeManager(1, config.SessionBalancingRoundRobin)
+
+	_, ok := mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+
+	time.Sleep(100 * time.Millisecond)
+
+	_, ok = mgr.getSessionID("example.com", false).(chan<- string)
+	suite.True(ok)
+}
+
+func (suite *SessionManagerTestSuite) TestStore() {
+	stateDir, err := ioutil.TempDir("", "sessions")
+	suite.NoError(err)
+
+	defer os.RemoveAll(stateDir)
+
+	managers := NewSessionManagers(stateDir, nil)
+	suite.NoError(managers.Restore(suite.conf))
+
+	mgr := managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+	mgr.pin("pinned")
+
+	suite.NoError(managers.Save())
+
+	restored := NewSessionManagers(stateDir, nil)
+	suite.NoError(restored.Restore(suite.conf))
+
+	sessions := restored.ListSessions()
+	suite.Len(sessions, 1)
+	suite.Equal("client", sessions[0].Client)
+	suite.Len(sessions[0].Sessions, 2)
+	suite.Equal("pinned", sessions[0].Sessions[0].ID)
+	suite.True(sessions[0].Sessions[0].Pinned)
+	suite.Equal("first", sessions[0].Sessions[1].ID)
+	suite.Equal(2, sessions[0].Sessions[1].Requests)
+	suite.Equal("pinned", restored.get("client").getSessionID("example.com", false))
+}
+
+func (suite *SessionManagerTestSuite) TestStoreExistingClient() {
+	stateDir, err := ioutil.TempDir("", "sessions")
+	suite.NoError(err)
+
+	defer os.RemoveAll(stateDir)
+
+	managers := NewSessionManagers(stateDir, nil)
+	suite.conf.SessionsPerClient = 2
+	mgr := managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+
+	suite.create(mgr, "example.com", "first")
+	suite.create(mgr, "example.com", "second")
+	suite.waitForSession(mgr, "example.com", "second")
+	suite.NoError(managers.Save())
+
+	restored := NewSessionManagers(stateDir, nil)
+	suite.conf.SessionsPerClient = 1
+	existing := restored.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+	existing.pin("pinned")
+
+	suite.NoError(restored.Restore(suite.conf))
+	suite.ElementsMatch([]string{"/sessions/first", "/sessions/second"},
+		[]string{<-suite.deleted, <-suite.deleted})
+
+	suite.Same(existing, restored.get("client"))
+	suite.Equal("pinned", existing.getSessionID("example.com", false))
+}
+
+func (suite *SessionManagerTestSuite) TestStoreShutdown() {
+	stateDir, err := ioutil.TempDir("", "sessions")
+	suite.NoError(err)
+
+	defer os.RemoveAll(stateDir)
+
+	managers := NewSessionManagers(stateDir, nil)
+	suite.conf.SessionsPerClient = 2
+	mgr := managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+
+	suite.create(mgr, "example.com", "first")
+	suite.create(mgr, "example.com", "second")
+	suite.waitForSession(mgr, "example.com", "second")
+	mgr.call(func() {
+		mgr.slots[0].lastUsed = time.Now().Add(-time.Hour)
+	})
+
+	suite.NoError(managers.Shutdown(context.Background()))
+	suite.Equal("/sessions/first", <-suite.deleted)
+
+	restored := NewSessionManagers(stateDir, nil)
+	suite.NoError(restored.Restore(suite.conf))
+
+	sessions := restored.ListSessions()
+	suite.Len(sessions, 1)
+	suite.Len(sessions[0].Sessions, 1)
+	suite.Equal("second", sessions[0].Sessions[0].ID)
+}
+
+func (suite *SessionManagerTestSuite) TestShutdown() {
+	managers := NewSessionManagers("", nil)
+	mgr := managers.getOrCreate("client", "apikey", newSessionManagerOpts(suite.conf))
+
+	suite.create(mgr, "example.com", "first")
+	suite.waitForSession(mgr, "example.com", "first")
+	mgr.pin("pinned")
+
+	suite.NoError(managers.Shutdown(context.Background()))
+	suite.Len(suite.deleted, 2)
+	suite.Empty(managers.ListSessions()[0].Sessions)
+}
+
+func (suite *SessionManagerTestSuite) TestStoreCorrupted() {
+	stateDir, err := ioutil.TempDir("", "sessions")
+	suite.NoError(err)
+
+	defer os.RemoveAll(stateDir)
+
+	suite.NoError(ioutil.WriteFile(stateDir+"/sessions.json", []byte("{"), 0o600))
+	suite.Error(NewSessionManagers(stateDir, nil).Restore(suite.conf))
+}
+
+func TestSessionManager(t *testing.T) {
+	suite.Run(t, &SessionManagerTestSuite{})
+}
@@ -0,0 +1,187 @@
+package layers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+// SessionManagers keeps session managers of all clients. It is shared
+// by sessions layers built on configuration reloads and exposed via
+// API. If state directory is set, sessions are kept there between
+// restarts. Requests to Crawlera API are sent with transport.
+//
+// Managers which have no sessions for longer than session TTL are
+// removed and stopped, so clients which are gone (or domains visited
+// once with domain affinity) do not hold goroutines forever.
+type SessionManagers struct {
+	managers  sync.Map
+	lock      sync.Mutex
+	stateDir  string
+	transport http.RoundTripper
+}
+
+// ListSessions conforms stats.SessionsController interface.
+func (s *SessionManagers) ListSessions() []stats.ClientSessions {
+	rv := []stats.ClientSessions{}
+
+	s.managers.Range(func(key, value interface{}) bool {
+		rv = append(rv, value.(*sessionManager).snapshot(key.(string)))
+
+		return true
+	})
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Client < rv[j].Client
+	})
+
+	return rv
+}
+
+// RotateSessions conforms stats.SessionsController interface.
+func (s *SessionManagers) RotateSessions(client string) bool {
+	mgr := s.get(client)
+	if mgr == nil {
+		return false
+	}
+
+	mgr.rotate()
+
+	return true
+}
+
+// PinSession conforms stats.SessionsController interface.
+func (s *SessionManagers) PinSession(client, sessionID string) bool {
+	mgr := s.get(client)
+	if mgr == nil {
+		return false
+	}
+
+	mgr.pin(sessionID)
+
+	return true
+}
+
+// Shutdown deletes sessions from Crawlera and waits until deletions are
+// done or context is closed. If state directory is set, only expired
+// sessions are deleted and the rest are saved for the next start.
+func (s *SessionManagers) Shutdown(ctx context.Context) error {
+	managers := []*sessionManager{}
+
+	s.managers.Range(func(key, value interface{}) bool {
+		mgr := value.(*sessionManager)
+		mgr.release(s.stateDir == "")
+		managers = append(managers, mgr)
+
+		return true
+	})
+
+	for _, mgr := range managers {
+		if err := mgr.waitDeleted(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Not all sessions were deleted from Crawlera")
+		}
+	}
+
+	return s.Save()
+}
+
+func (s *SessionManagers) get(client string) *sessionManager {
+	if mgrRaw, ok := s.managers.Load(client); ok {
+		return mgrRaw.(*sessionManager)
+	}
+
+	return nil
+}
+
+// getOrCreate returns a session manager of the client. New managers
+// are started. Existing ones get opts if they were changed by
+// configuration reload. If API key of the client was changed, its
+// manager is replaced: sessions of the previous key are deleted and
+// then the previous manager is stopped.
+func (s *SessionManagers) getOrCreate(client, apiKey string, opts sessionManagerOpts) *sessionManager {
+	if mgr := s.get(client); mgr != nil && mgr.apiKey == apiKey {
+		mgr.setOpts(opts)
+		return mgr
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if mgr := s.get(client); mgr != nil {
+		if mgr.apiKey == apiKey {
+			mgr.setOpts(opts)
+			return mgr
+		}
+
+		go s.retire(mgr)
+	}
+
+	mgr := s.newManager(client, apiKey, opts)
+	s.managers.Store(client, mgr)
+
+	go mgr.Start()
+
+	return mgr
+}
+
+// retire deletes all sessions of the replaced manager and stops it once
+// they are deleted from Crawlera. Requests which have got sessions from
+// the manager still report broken ones to it meanwhile.
+func (s *SessionManagers) retire(mgr *sessionManager) {
+	mgr.release(true)
+	mgr.waitDeleted(context.Background()) // nolint: errcheck
+	mgr.stop()
+}
+
+// newManager returns a new session manager of the client which is
+// evicted when it becomes idle. The manager is not started.
+func (s *SessionManagers) newManager(client, apiKey string, opts sessionManagerOpts) *sessionManager {
+	mgr := newSessionManager(apiKey, opts)
+	mgr.onIdle = func() {
+		s.evict(client, mgr)
+	}
+
+	return mgr
+}
+
+// evict removes the idle manager of the client and stops it. If the
+// manager has got sessions meanwhile or was replaced, nothing happens.
+func (s *SessionManagers) evict(client string, mgr *sessionManager) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(client) != mgr || !mgr.isIdle() {
+		return
+	}
+
+	s.managers.Delete(client)
+	mgr.stop()
+
+	log.WithFields(log.Fields{
+		"client": client,
+	}).Debug("Idle session manager has been removed")
+}
+
+// newSessionManagerOpts returns settings of session managers with
+// transport to Crawlera API.
+func (s *SessionManagers) newSessionManagerOpts(conf *config.Config) sessionManagerOpts {
+	opts := newSessionManagerOpts(conf)
+	opts.transport = s.transport
+
+	return opts
+}
+
+func NewSessionManagers(stateDir string, transport http.RoundTripper) *SessionManagers {
+	return &SessionManagers{
+		stateDir:  stateDir,
+		transport: transport,
+	}
+}
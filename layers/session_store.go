@@ -0,0 +1,260 @@
+package layers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+const (
+	sessionStoreFileName     = "sessions.json"
+	sessionStoreSaveInterval = 30 * time.Second
+	sessionStoreFileMode     = 0o600
+	sessionStoreDirMode      = 0o700
+)
+
+// sessionStoreEntry is a state of the session manager of a client which
+// is kept on disk between restarts.
+type sessionStoreEntry struct {
+	Client   string                `json:"client"`
+	APIKey   string                `json:"api_key"`
+	Sessions []sessionStoreSession `json:"sessions"`
+	Errors   uint64                `json:"errors"`
+}
+
+type sessionStoreSession struct {
+	ID       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+	Requests int       `json:"requests"`
+	Pinned   bool      `json:"pinned"`
+}
+
+func (s *sessionSlot) storeSession(pinned bool) sessionStoreSession {
+	return sessionStoreSession{
+		ID:       s.id,
+		Created:  s.created,
+		LastUsed: s.lastUsed,
+		Requests: s.requests,
+		Pinned:   pinned,
+	}
+}
+
+func (s *sessionSlot) restoreSession(session sessionStoreSession) {
+	s.id = session.ID
+	s.created = session.Created
+	s.lastUsed = session.LastUsed
+	s.requests = session.Requests
+}
+
+// dumpState returns a state of the manager to store.
+func (s *sessionManager) dumpState(client string) sessionStoreEntry {
+	entry := sessionStoreEntry{
+		Client:   client,
+		APIKey:   s.apiKey,
+		Sessions: []sessionStoreSession{},
+	}
+
+	s.call(func() {
+		entry.Errors = s.errors
+
+		if s.pinned.id != "" {
+			entry.Sessions = append(entry.Sessions, s.pinned.storeSession(true))
+		}
+
+		for i := range s.slots {
+			if s.slots[i].id != "" {
+				entry.Sessions = append(entry.Sessions, s.slots[i].storeSession(false))
+			}
+		}
+	})
+
+	return entry
+}
+
+// restoreState fills a manager which is not started yet with stored
+// sessions. Sessions which do not fit into the pool are returned, they
+// have to be deleted from Crawlera. Expired sessions are deleted by the
+// manager itself once it is started.
+func (s *sessionManager) restoreState(entry sessionStoreEntry) []string {
+	s.errors = entry.Errors
+	extra := []string{}
+	free := 0
+
+	for _, session := range entry.Sessions {
+		switch {
+		case session.Pinned && s.pinned.id == "":
+			s.pinned.restoreSession(session)
+		case !session.Pinned && free < len(s.slots):
+			s.slots[free].restoreSession(session)
+			free++
+		default:
+			extra = append(extra, session.ID)
+		}
+	}
+
+	return extra
+}
+
+// Restore loads sessions stored in the state directory and starts their
+// managers. Session managers get settings from the given configuration.
+// It does nothing if state directory is not set or there is no stored
+// state yet.
+func (s *SessionManagers) Restore(conf *config.Config) error {
+	if s.stateDir == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.storePath())
+
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("cannot read sessions state: %w", err)
+	}
+
+	entries := []sessionStoreEntry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("cannot parse sessions state: %w", err)
+	}
+
+	opts := s.newSessionManagerOpts(conf)
+
+	for _, entry := range entries {
+		mgr := s.newManager(entry.Client, entry.APIKey, opts)
+		extra := mgr.restoreState(entry)
+		_, loaded := s.managers.LoadOrStore(entry.Client, mgr)
+
+		go mgr.Start()
+
+		// if the client already has a manager, restored sessions are
+		// not needed and are deleted with its own API key.
+		go func(mgr *sessionManager, extra []string, loaded bool) {
+			for _, sessionID := range extra {
+				mgr.deleteLater(sessionID)
+			}
+
+			if loaded {
+				s.retire(mgr)
+			}
+		}(mgr, extra, loaded)
+
+		if loaded {
+			log.WithFields(log.Fields{
+				"client":   entry.Client,
+				"sessions": len(entry.Sessions),
+			}).Debug("Client already has sessions, stored ones are deleted")
+
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"client":   entry.Client,
+			"sessions": len(entry.Sessions) - len(extra),
+		}).Debug("Sessions were restored")
+	}
+
+	return nil
+}
+
+// Save writes sessions of all clients into the state directory. It
+// does nothing if state directory is not set.
+func (s *SessionManagers) Save() error {
+	if s.stateDir == "" {
+		return nil
+	}
+
+	entries := []sessionStoreEntry{}
+
+	s.managers.Range(func(key, value interface{}) bool {
+		if entry := value.(*sessionManager).dumpState(key.(string)); len(entry.Sessions) > 0 {
+			entries = append(entries, entry)
+		}
+
+		return true
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return fmt.Errorf("cannot serialize sessions state: %w", err)
+	}
+
+	if err := writeFileAtomically(s.storePath(), data); err != nil {
+		return fmt.Errorf("cannot write sessions state: %w", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomically writes data into a temporary file and renames it,
+// so a crash never leaves a partially written file. Parent directories
+// are created if necessary.
+func writeFileAtomically(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+
+	if err := os.MkdirAll(dir, sessionStoreDirMode); err != nil {
+		return fmt.Errorf("cannot create directory: %w", err)
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %w", err)
+	}
+
+	defer os.Remove(tmpFile.Name()) // nolint: errcheck
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close() // nolint: errcheck, gosec
+		return fmt.Errorf("cannot write temporary file: %w", err)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("cannot write temporary file: %w", err)
+	}
+
+	if err := os.Chmod(tmpFile.Name(), sessionStoreFileMode); err != nil {
+		return fmt.Errorf("cannot change file mode: %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("cannot rename temporary file: %w", err)
+	}
+
+	return nil
+}
+
+// Run saves sessions periodically until context is closed.
+func (s *SessionManagers) Run(ctx context.Context) {
+	if s.stateDir == "" {
+		return
+	}
+
+	ticker := time.NewTicker(sessionStoreSaveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Warn("Cannot save sessions")
+			}
+		}
+	}
+}
+
+func (s *SessionManagers) storePath() string {
+	return filepath.Join(s.stateDir, sessionStoreFileName)
+}
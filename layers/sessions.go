@@ -1,41 +1,26 @@
 package layers
 
 import (
-	"sync"
+	"net"
+	"strings"
 
-	"github.com/9seconds/httransform/v2/errors"
-	"github.com/9seconds/httransform/v2/executor"
 	"github.com/9seconds/httransform/v2/layers"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
 
 	"github.com/scrapinghub/crawlera-headless-proxy/config"
 )
 
 type SessionsLayer struct {
-	apiKey       string
-	crawleraHost string
-	crawleraPort int
-	clients      *sync.Map
-	executor     executor.Executor
+	apiKey          string
+	managerOpts     sessionManagerOpts
+	sessionAffinity string
+	clients         *SessionManagers
 }
 
 func (s *SessionsLayer) OnRequest(ctx *layers.Context) error {
-	clientID := getClientID(ctx)
-	mgrRaw, loaded := s.clients.LoadOrStore(clientID,
-		newSessionManager(s.apiKey, s.crawleraHost, s.crawleraPort))
-	mgr := mgrRaw.(*sessionManager)
-
-	if !loaded {
-		go mgr.Start()
-	}
-
-	switch value := mgr.getSessionID(false).(type) {
-	case string:
-		ctx.RequestHeaders.Set("X-Crawlera-Session", value, true)
-	case chan<- string:
-		ctx.RequestHeaders.Set("X-Crawlera-Session", "create", true)
-		ctx.Set(sessionChanContextType, value)
-	}
+	s.setSession(ctx, false)
+	ctx.Set(sessionsLayerContextType, s)
 
 	return nil
 }
@@ -55,8 +40,9 @@ func (s *SessionsLayer) OnResponse(ctx *layers.Context, err error) error {
 	}
 
 	getMetrics(ctx).NewCrawleraError()
+	s.onResponseError(ctx)
 
-	return s.onResponseError(ctx)
+	return err
 }
 
 func (s *SessionsLayer) onResponseOK(ctx *layers.Context) {
@@ -65,7 +51,7 @@ func (s *SessionsLayer) onResponseOK(ctx *layers.Context) {
 		channelUntyped.(chan<- string) <- sessionID
 		close(channelUntyped.(chan<- string))
 
-		getMetrics(ctx).NewSessionCreated()
+		s.newSessionCreated(ctx)
 
 		getLogger(ctx).WithFields(log.Fields{
 			"session-id": sessionID,
@@ -73,95 +59,114 @@ func (s *SessionsLayer) onResponseOK(ctx *layers.Context) {
 	}
 }
 
-func (s *SessionsLayer) onResponseError(ctx *layers.Context) error {
-	clientID := getClientID(ctx)
-	mgrRaw, _ := s.clients.Load(clientID)
-	mgr := mgrRaw.(*sessionManager)
-
+// onResponseError reports a session of the request as broken to the
+// manager which has given it, even if the manager of the client has
+// been replaced meanwhile. The request itself is retried by the retry
+// layer.
+func (s *SessionsLayer) onResponseError(ctx *layers.Context) {
 	if channelUntyped := ctx.Get(sessionChanContextType); channelUntyped != nil {
 		close(channelUntyped.(chan<- string))
+		ctx.Delete(sessionChanContextType)
 	}
 
-	if brokenSessionID := ctx.ResponseHeaders.GetLast("x-crawlera-session").Value(); brokenSessionID != "" {
-		mgr.getBrokenSessionChan() <- brokenSessionID
-	}
-
-	switch value := mgr.getSessionID(true).(type) {
-	case chan<- string:
-		return s.onResponseErrorRetryCreateSession(ctx, value)
-	case string:
-		return s.onResponseErrorRetryWithSession(ctx, mgr, value)
+	brokenSessionID := ctx.ResponseHeaders.GetLast("x-crawlera-session").Value()
+	if mgr := getSessionManager(ctx); mgr != nil && brokenSessionID != "" {
+		mgr.reportBrokenSession(brokenSessionID)
 	}
-
-	return errors.Annotate(nil, "Unexpected error in onResponseError", "session_manager", 0)
 }
 
-func (s *SessionsLayer) onResponseErrorRetryCreateSession(ctx *layers.Context, channel chan<- string) error {
-	defer close(channel)
-
-	logger := getLogger(ctx)
-	ctx.RequestHeaders.Set("X-Crawlera-Session", "create", true)
-	err := s.executeRequest(ctx)
+// rotateSession replaces a broken session of the request with another
+// one before the request is retried.
+func (s *SessionsLayer) rotateSession(ctx *layers.Context) {
+	s.onResponseError(ctx)
+	s.setSession(ctx, true)
+}
 
-	if err != nil || isCrawleraResponseError(ctx) {
-		log.Warn("Could not obtain new session even after retry")
-		return errors.Annotate(err, "Could not obtain new session even after retry", "session_manager", 0)
-	}
+// setSession sets a session of the client to the request and keeps its
+// manager in the context. If the manager of the client is stopped as
+// idle meanwhile, a new one is created.
+func (s *SessionsLayer) setSession(ctx *layers.Context, retry bool) {
+	key, apiKey := s.getClientKey(ctx)
+	host := string(ctx.Request().URI().Host())
 
-	sessionID := ctx.ResponseHeaders.GetLast("X-Crawlera-Session").Value()
-	channel <- sessionID
+	for {
+		mgr := s.clients.getOrCreate(key, apiKey, s.managerOpts)
 
-	getMetrics(ctx).NewSessionCreated()
+		switch value := mgr.getSessionID(host, retry).(type) {
+		case string:
+			ctx.RequestHeaders.Set("X-Crawlera-Session", value, true)
+			ctx.Set(sessionManagerContextType, mgr)
 
-	logger.WithFields(log.Fields{
-		"session-id": sessionID,
-	}).Info("Got fresh session after retry.")
+			return
+		case chan<- string:
+			ctx.RequestHeaders.Set("X-Crawlera-Session", "create", true)
+			ctx.Set(sessionChanContextType, value)
+			ctx.Set(sessionManagerContextType, mgr)
 
-	return nil
+			return
+		}
+	}
 }
 
-func (s *SessionsLayer) onResponseErrorRetryWithSession(ctx *layers.Context, mgr *sessionManager, sessionID string) error {
-	ctx.RequestHeaders.Set("X-Crawlera-Session", sessionID, true)
-	logger := getLogger(ctx).WithFields(log.Fields{
-		"session-id": sessionID,
-	})
-
-	err := s.executeRequest(ctx)
-
-	if err != nil || isCrawleraResponseError(ctx) {
-		mgr.getBrokenSessionChan() <- sessionID
-		logger.Info("Request failed even after retry")
-
-		return errors.Annotate(err, "Request failed even after retry", "session_manager", 0)
+// getClientKey returns a key of session manager for the client and
+// API key this session manager should use. Clients of different tenants
+// never share session managers. With domain affinity, each registrable
+// domain of the client gets its own session manager.
+func (s *SessionsLayer) getClientKey(ctx *layers.Context) (string, string) {
+	key := getClientID(ctx)
+	apiKey := s.apiKey
+
+	if current := getTenant(ctx); current != nil {
+		key = current.name + "/" + key
+		apiKey = current.apiKey
 	}
 
-	logger.Info("Request succeed after retry")
+	if s.sessionAffinity == config.SessionAffinityDomain {
+		key += "@" + getRegistrableDomain(string(ctx.Request().URI().Host()))
+	}
 
-	return nil
+	return key, apiKey
 }
 
-func (s *SessionsLayer) executeRequest(ctx *layers.Context) error {
-	if err := ctx.RequestHeaders.Push(); err != nil {
-		return errors.Annotate(err, "cannot sync request headers", "session_manager", 0)
+// getRegistrableDomain returns a domain which can be registered by
+// an owner of the host according to public suffix list: example.co.uk
+// for www.example.co.uk. IP addresses and hosts which are public
+// suffixes are returned as is.
+func getRegistrableDomain(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
 	}
 
-	if err := s.executor(ctx); err != nil {
-		return errors.Annotate(err, "cannot execute a request", "session_manager", 0)
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if net.ParseIP(host) != nil {
+		return host
 	}
 
-	if err := ctx.ResponseHeaders.Pull(); err != nil {
-		return errors.Annotate(err, "cannot read response headers", "session_manager", 0)
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
 	}
 
-	return nil
+	return host
+}
+
+func (s *SessionsLayer) newSessionCreated(ctx *layers.Context) {
+	metrics := getMetrics(ctx)
+	metrics.NewSessionCreated()
+
+	if current := getTenant(ctx); current != nil {
+		metrics.NewTenantSessionCreated(current.name)
+	}
 }
 
-func NewSessionsLayer(conf *config.Config, executor executor.Executor) layers.Layer {
+// NewSessionsLayer returns a layer which manages Crawlera sessions.
+// clients keeps session managers per client, it is shared between
+// layers built on configuration reloads so live sessions survive them.
+func NewSessionsLayer(conf *config.Config, clients *SessionManagers) layers.Layer {
 	return &SessionsLayer{
-		crawleraHost: conf.CrawleraHost,
-		crawleraPort: conf.CrawleraPort,
-		apiKey:       conf.APIKey,
-		clients:      &sync.Map{},
-		executor:     executor,
+		managerOpts:     clients.newSessionManagerOpts(conf),
+		apiKey:          conf.APIKey,
+		sessionAffinity: conf.SessionAffinity,
+		clients:         clients,
 	}
 }
@@ -0,0 +1,119 @@
+package layers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type SessionsLayerTestSuite struct {
+	CommonLayerTestSuite
+
+	conf *config.Config
+}
+
+func (suite *SessionsLayerTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.conf.APIKey = "apikey"
+}
+
+func (suite *SessionsLayerTestSuite) clientKey(uri string) (string, string) {
+	layer := NewSessionsLayer(suite.conf, NewSessionManagers("", nil)).(*SessionsLayer)
+	suite.ctx.Request().SetRequestURI(uri)
+
+	return layer.getClientKey(suite.ctx)
+}
+
+func (suite *SessionsLayerTestSuite) TestClientAffinity() {
+	key, apiKey := suite.clientKey("https://www.example.com/")
+
+	suite.Equal("id", key)
+	suite.Equal("apikey", apiKey)
+}
+
+func (suite *SessionsLayerTestSuite) TestDomainAffinity() {
+	suite.conf.SessionAffinity = config.SessionAffinityDomain
+
+	key, apiKey := suite.clientKey("https://www.example.co.uk/path")
+	suite.Equal("id@example.co.uk", key)
+	suite.Equal("apikey", apiKey)
+
+	key, _ = suite.clientKey("https://static.example.co.uk:8443/path")
+	suite.Equal("id@example.co.uk", key)
+}
+
+func (suite *SessionsLayerTestSuite) TestDomainAffinityTenant() {
+	suite.conf.SessionAffinity = config.SessionAffinityDomain
+	suite.ctx.Set(tenantLayerContextType, &tenant{name: "users", apiKey: "userskey"})
+
+	key, apiKey := suite.clientKey("https://www.example.com/")
+
+	suite.Equal("users/id@example.com", key)
+	suite.Equal("userskey", apiKey)
+}
+
+func (suite *SessionsLayerTestSuite) TestBrokenSessionOfReplacedManager() {
+	deleted := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deleted <- r.URL.Path
+	}))
+
+	defer server.Close()
+
+	host, portRaw, _ := net.SplitHostPort(server.Listener.Addr().String())
+	suite.conf.CrawleraHost = host
+	suite.conf.CrawleraPort, _ = strconv.Atoi(portRaw)
+
+	managers := NewSessionManagers("", nil)
+	layer := NewSessionsLayer(suite.conf, managers).(*SessionsLayer)
+	opts := managers.newSessionManagerOpts(suite.conf)
+
+	mgr := managers.getOrCreate("id", "apikey", opts)
+	mgr.pin("first")
+
+	suite.ctx.Request().SetRequestURI("https://example.com/")
+	suite.NoError(layer.OnRequest(suite.ctx))
+	suite.Equal("first", suite.ctx.RequestHeaders.GetLast("X-Crawlera-Session").Value())
+
+	replaced := managers.newManager("id", "apikey", opts)
+	go replaced.Start()
+	managers.managers.Store("id", replaced)
+	replaced.pin("second")
+
+	suite.ctx.ResponseHeaders.Set("X-Crawlera-Session", "first", true)
+	suite.ctx.ResponseHeaders.Set("X-Crawlera-Error", "banned", true)
+	layer.onResponseError(suite.ctx)
+
+	suite.Equal("/sessions/first", <-deleted)
+	suite.EqualValues(1, mgr.snapshot("id").Errors)
+	suite.EqualValues(0, replaced.snapshot("id").Errors)
+	suite.Equal("second", replaced.getSessionID("example.com", false))
+}
+
+func (suite *SessionsLayerTestSuite) TestRegistrableDomain() {
+	for host, expected := range map[string]string{
+		"www.example.com":      "example.com",
+		"a.b.example.co.uk":    "example.co.uk",
+		"Example.COM.":         "example.com",
+		"user.github.io":       "user.github.io",
+		"co.uk":                "co.uk",
+		"localhost":            "localhost",
+		"127.0.0.1:8080":       "127.0.0.1",
+		"[::1]:8080":           "::1",
+		"www.example.com:8080": "example.com",
+	} {
+		suite.Equal(expected, getRegistrableDomain(host), host)
+	}
+}
+
+func TestSessionsLayer(t *testing.T) {
+	suite.Run(t, &SessionsLayerTestSuite{})
+}
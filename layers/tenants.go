@@ -0,0 +1,168 @@
+package layers
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/9seconds/httransform/v2/errors"
+	"github.com/9seconds/httransform/v2/layers"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+var errUnknownTenant = errors.Annotate(nil, "cannot find a tenant for this client", "tenant", http.StatusForbidden)
+
+type tenant struct {
+	name          string
+	apiKey        string
+	encodedAPIKey string
+	limiter       layers.Layer
+}
+
+type tenantSubnet struct {
+	subnet *net.IPNet
+	tenant *tenant
+}
+
+// TenantsLayer routes clients to tenants. Clients are routed by the
+// name of proxy user only if inbound authentication checks names against
+// htpasswd file: otherwise any client could use any tenant.
+type TenantsLayer struct {
+	byProxyUser map[string]*tenant
+	byBindPort  map[int]*tenant
+	bySubnet    []tenantSubnet
+	fallback    *tenant
+
+	verifiedUsers bool
+}
+
+func (t *TenantsLayer) OnRequest(ctx *layers.Context) error {
+	current := t.resolve(ctx)
+	if current == nil {
+		return errUnknownTenant
+	}
+
+	ctx.Set(tenantLayerContextType, current)
+	ctx.Set(logLayerContextType, getLogger(ctx).WithFields(log.Fields{
+		"tenant": current.name,
+	}))
+	getMetrics(ctx).NewTenantRequest(current.name)
+
+	return nil
+}
+
+func (t *TenantsLayer) OnResponse(ctx *layers.Context, err error) error {
+	current := getTenant(ctx)
+	if current == nil {
+		return err
+	}
+
+	metrics := getMetrics(ctx)
+
+	switch {
+	case isCrawleraError(ctx):
+		metrics.NewTenantCrawleraError(current.name)
+	case err != nil || ctx.Response().StatusCode() >= baseLayerBadStatusCode:
+		metrics.NewTenantOtherError(current.name)
+	}
+
+	return err
+}
+
+func (t *TenantsLayer) resolve(ctx *layers.Context) *tenant {
+	if value, ok := t.byProxyUser[ctx.User]; ok && ctx.User != "" && t.verifiedUsers {
+		return value
+	}
+
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+		if value, ok := t.byBindPort[addr.Port]; ok {
+			return value
+		}
+	}
+
+	if addr, ok := ctx.RemoteAddr().(*net.TCPAddr); ok {
+		for _, v := range t.bySubnet {
+			if v.subnet.Contains(addr.IP) {
+				return v.tenant
+			}
+		}
+	}
+
+	return t.fallback
+}
+
+// TenantRateLimiterLayer limits a number of concurrent connections of
+// each tenant independently.
+type TenantRateLimiterLayer struct{}
+
+func (t *TenantRateLimiterLayer) OnRequest(ctx *layers.Context) error {
+	if current := getTenant(ctx); current != nil && current.limiter != nil {
+		return current.limiter.OnRequest(ctx)
+	}
+
+	return nil
+}
+
+func (t *TenantRateLimiterLayer) OnResponse(ctx *layers.Context, err error) error {
+	if current := getTenant(ctx); current != nil && current.limiter != nil {
+		return current.limiter.OnResponse(ctx, err)
+	}
+
+	return err
+}
+
+func newTenant(name, apiKey string, concurrentConnections int) *tenant {
+	value := &tenant{
+		name:          name,
+		apiKey:        apiKey,
+		encodedAPIKey: encodeAPIKey(apiKey),
+	}
+
+	if concurrentConnections > 0 {
+		value.limiter = NewRateLimiterLayer(concurrentConnections)
+	}
+
+	return value
+}
+
+// NewTenantsLayer returns a layer which routes a client to the tenant.
+// Clients which do not match any tenant use global API key if it is
+// set. Otherwise, their requests are rejected.
+func NewTenantsLayer(conf *config.Config) layers.Layer {
+	layer := &TenantsLayer{
+		byProxyUser:   map[string]*tenant{},
+		byBindPort:    map[int]*tenant{},
+		verifiedUsers: conf.InboundAuthHtpasswd != "",
+	}
+
+	if conf.APIKey != "" {
+		layer.fallback = newTenant("default", conf.APIKey, 0)
+	}
+
+	for _, v := range conf.Tenants {
+		current := newTenant(v.Name, v.APIKey, v.ConcurrentConnections)
+
+		for _, user := range v.ProxyUsers {
+			layer.byProxyUser[user] = current
+		}
+
+		for _, port := range v.BindPorts {
+			layer.byBindPort[port] = current
+		}
+
+		for _, cidr := range v.SourceCIDRs {
+			_, subnet, _ := net.ParseCIDR(cidr)
+			layer.bySubnet = append(layer.bySubnet, tenantSubnet{
+				subnet: subnet,
+				tenant: current,
+			})
+		}
+	}
+
+	return layer
+}
+
+func NewTenantRateLimiterLayer() layers.Layer {
+	return &TenantRateLimiterLayer{}
+}
@@ -0,0 +1,102 @@
+package layers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type TenantsLayerTestSuite struct {
+	CommonLayerTestSuite
+
+	conf *config.Config
+}
+
+func (suite *TenantsLayerTestSuite) SetupTest() {
+	suite.CommonLayerTestSuite.SetupTest()
+
+	suite.conf = config.NewConfig()
+	suite.conf.InboundAuthHtpasswd = "/etc/headless-proxy/htpasswd"
+	suite.conf.Tenants = []config.Tenant{
+		{
+			Name:       "users",
+			APIKey:     "userskey",
+			ProxyUsers: []string{"user"},
+		},
+		{
+			Name:                  "local",
+			APIKey:                "localkey",
+			SourceCIDRs:           []string{"127.0.0.0/8"},
+			ConcurrentConnections: 1,
+		},
+	}
+}
+
+func (suite *TenantsLayerTestSuite) TestProxyUser() {
+	layer := NewTenantsLayer(suite.conf)
+
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Equal("users", getTenant(suite.ctx).name)
+}
+
+func (suite *TenantsLayerTestSuite) TestProxyUserWithoutHtpasswd() {
+	suite.conf.InboundAuthHtpasswd = ""
+	layer := NewTenantsLayer(suite.conf)
+
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Equal("local", getTenant(suite.ctx).name)
+}
+
+func (suite *TenantsLayerTestSuite) TestSourceCIDR() {
+	suite.ctx.User = "unknown"
+	layer := NewTenantsLayer(suite.conf)
+
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Equal("local", getTenant(suite.ctx).name)
+}
+
+func (suite *TenantsLayerTestSuite) TestFallback() {
+	suite.ctx.User = ""
+	suite.conf.APIKey = "globalkey"
+	suite.conf.Tenants = suite.conf.Tenants[:1]
+	layer := NewTenantsLayer(suite.conf)
+
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Equal("default", getTenant(suite.ctx).name)
+}
+
+func (suite *TenantsLayerTestSuite) TestUnknownTenant() {
+	suite.ctx.User = ""
+	suite.conf.Tenants = suite.conf.Tenants[:1]
+	layer := NewTenantsLayer(suite.conf)
+
+	suite.Equal(errUnknownTenant, layer.OnRequest(suite.ctx))
+}
+
+func (suite *TenantsLayerTestSuite) TestAPIKey() {
+	suite.Nil(NewTenantsLayer(suite.conf).OnRequest(suite.ctx))
+	suite.Nil(NewAuthLayer("globalkey").OnRequest(suite.ctx))
+
+	suite.Equal("Basic "+encodeAPIKey("userskey"),
+		suite.ctx.RequestHeaders.GetLast("proxy-authorization").Value())
+	suite.Equal("userskey", APIKey(suite.ctx))
+}
+
+func (suite *TenantsLayerTestSuite) TestRateLimiter() {
+	suite.ctx.User = ""
+	suite.Nil(NewTenantsLayer(suite.conf).OnRequest(suite.ctx))
+
+	limiter := getTenant(suite.ctx).limiter.(*RateLimiterLayer)
+	layer := NewTenantRateLimiterLayer()
+
+	suite.Nil(layer.OnRequest(suite.ctx))
+	suite.Len(limiter.limiter, 1)
+	layer.OnResponse(suite.ctx, nil) // nolint: errcheck
+	suite.Len(limiter.limiter, 0)
+}
+
+func TestTenantsLayer(t *testing.T) {
+	suite.Run(t, &TenantsLayerTestSuite{})
+}
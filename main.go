@@ -1,11 +1,12 @@
 package main
 
-//go:generate go run ./scripts/generate_certs.go ./ca.crt ./private-key.pem ./certs.go
+//go:generate go run ./scripts/generate_certs.go ./ca.crt ./private-key.pem ./zyte-smartproxy-ca.crt ./certs.go
 
 import (
 	"bytes"
 	"context"
 	"crypto/sha1" // nolint: gosec
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -13,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
@@ -73,6 +75,18 @@ var ( // nolint: gochecknoglobals
 		Short('t').
 		Envar("CRAWLERA_HEADLESS_NOAUTOSESSIONS").
 		Bool()
+	autoReferer = app.Flag("auto-referer",
+		"Set Referer header for requests which do not have it.").
+		Envar("CRAWLERA_HEADLESS_AUTOREFERER").
+		Bool()
+	refererPolicy = app.Flag("referer-policy",
+		"Which part of the page URL to use as automatic referer (origin, strip-query or full).").
+		Envar("CRAWLERA_HEADLESS_REFERERPOLICY").
+		Enum(config.RefererPolicyOrigin, config.RefererPolicyStripQuery, config.RefererPolicyFull)
+	refererTTL = app.Flag("referer-ttl",
+		"For how long automatic referers are remembered.").
+		Envar("CRAWLERA_HEADLESS_REFERERTTL").
+		Duration()
 	concurrentConnections = app.Flag("concurrent-connections",
 		"Number of concurrent connections.").
 		Short('n').
@@ -98,6 +112,115 @@ var ( // nolint: gochecknoglobals
 		Short('v').
 		Envar("CRAWLERA_HEADLESS_DONTVERIFY").
 		Bool()
+	crawleraTLS = app.Flag("crawlera-tls",
+		"Connect to Crawlera using TLS.").
+		Envar("CRAWLERA_HEADLESS_CTLS").
+		Bool()
+	crawleraCABundle = app.Flag("crawlera-ca-bundle",
+		"Path to the file with additional CA certificates to verify Crawlera TLS certificates.").
+		Envar("CRAWLERA_HEADLESS_CCABUNDLE").
+		ExistingFile()
+	inboundAuthHtpasswd = app.Flag("inbound-auth-htpasswd",
+		"Path to htpasswd file (bcrypt) with credentials of proxy clients.").
+		Envar("CRAWLERA_HEADLESS_INBOUNDAUTHHTPASSWD").
+		ExistingFile()
+	inboundAuthTokens = app.Flag("inbound-auth-token",
+		"Static token proxy clients can authenticate with.").
+		Envar("CRAWLERA_HEADLESS_INBOUNDAUTHTOKENS").
+		Strings()
+	inboundAuthCIDRs = app.Flag("inbound-auth-cidr",
+		"Subnet which proxy clients can access proxy from without authentication.").
+		Envar("CRAWLERA_HEADLESS_INBOUNDAUTHCIDRS").
+		Strings()
+	proxyAPITokens = app.Flag("proxy-api-token",
+		"Static token clients of proxy API can authenticate with.").
+		Envar("CRAWLERA_HEADLESS_PROXYAPITOKENS").
+		Strings()
+	proxyAPICIDRs = app.Flag("proxy-api-cidr",
+		"Subnet which clients can access proxy API from without authentication.").
+		Envar("CRAWLERA_HEADLESS_PROXYAPICIDRS").
+		Strings()
+	sessionsPerClient = app.Flag("sessions-per-client",
+		"A number of Crawlera sessions per client.").
+		Envar("CRAWLERA_HEADLESS_SESSIONSPERCLIENT").
+		Int()
+	sessionBalancing = app.Flag("session-balancing",
+		"How to choose a session of the client for the request (round-robin or host).").
+		Envar("CRAWLERA_HEADLESS_SESSIONBALANCING").
+		Enum(config.SessionBalancingRoundRobin, config.SessionBalancingHost)
+	sessionAffinity = app.Flag("session-affinity",
+		"What sessions are bound to (client or domain).").
+		Envar("CRAWLERA_HEADLESS_SESSIONAFFINITY").
+		Enum(config.SessionAffinityClient, config.SessionAffinityDomain)
+	sessionCreateTimeout = app.Flag("session-create-timeout",
+		"How long requests wait for a new session.").
+		Envar("CRAWLERA_HEADLESS_SESSIONCREATETIMEOUT").
+		Duration()
+	sessionCreateRetryTimeout = app.Flag("session-create-retry-timeout",
+		"How long retried requests wait for a new session.").
+		Envar("CRAWLERA_HEADLESS_SESSIONCREATERETRYTIMEOUT").
+		Duration()
+	sessionAPITimeout = app.Flag("session-api-timeout",
+		"Timeout of requests to Crawlera sessions API.").
+		Envar("CRAWLERA_HEADLESS_SESSIONAPITIMEOUT").
+		Duration()
+	sessionTTL = app.Flag("session-ttl",
+		"For how long unused sessions are kept.").
+		Envar("CRAWLERA_HEADLESS_SESSIONTTL").
+		Duration()
+	sessionMaxAge = app.Flag("session-max-age",
+		"Age after which sessions are rotated.").
+		Envar("CRAWLERA_HEADLESS_SESSIONMAXAGE").
+		Duration()
+	sessionMaxRequests = app.Flag("session-max-requests",
+		"A number of requests after which sessions are rotated.").
+		Envar("CRAWLERA_HEADLESS_SESSIONMAXREQUESTS").
+		Int()
+	stateDir = app.Flag("state-dir",
+		"Directory where sessions are kept between restarts.").
+		Envar("CRAWLERA_HEADLESS_STATEDIR").
+		String()
+	shutdownTimeout = app.Flag("shutdown-timeout",
+		"For how long graceful shutdown waits for requests in flight.").
+		Envar("CRAWLERA_HEADLESS_SHUTDOWNTIMEOUT").
+		Duration()
+	clientID = app.Flag("client-id",
+		"How to identify clients (ip-user-agent, header, proxy-user, source-port or bind-port).").
+		Envar("CRAWLERA_HEADLESS_CLIENTID").
+		Enum(config.ClientIDIPUserAgent, config.ClientIDHeader, config.ClientIDProxyUser,
+			config.ClientIDSourcePort, config.ClientIDBindPort)
+	clientIDPortRange = app.Flag("client-id-port-range",
+		"A size of source port ranges for source-port client identification.").
+		Envar("CRAWLERA_HEADLESS_CLIENTIDPORTRANGE").
+		Int()
+	clientConcurrentConnections = app.Flag("client-concurrent-connections",
+		"Number of concurrent connections of each client.").
+		Envar("CRAWLERA_HEADLESS_CLIENTCONCURRENCY").
+		Int()
+	errorPages = app.Flag("error-pages",
+		"How to return responses with Crawlera errors (off, html or json).").
+		Envar("CRAWLERA_HEADLESS_ERRORPAGES").
+		Enum(config.ErrorPagesOff, config.ErrorPagesHTML, config.ErrorPagesJSON)
+	upstreams = app.Flag("upstream",
+		"Crawlera endpoint (host:port, optionally prefixed by http:// or https://). Can be set several times.").
+		Envar("CRAWLERA_HEADLESS_UPSTREAMS").
+		Strings()
+	upstreamBalancing = app.Flag("upstream-balancing",
+		"How to choose an upstream for the request (round-robin or least-connections).").
+		Envar("CRAWLERA_HEADLESS_UPSTREAMBALANCING").
+		Enum(config.UpstreamBalancingRoundRobin, config.UpstreamBalancingLeastConnections)
+	upstreamMaxFailures = app.Flag("upstream-max-failures",
+		"A number of consecutive failures after which upstream is considered unhealthy.").
+		Envar("CRAWLERA_HEADLESS_UPSTREAMMAXFAILURES").
+		Int()
+	upstreamHealthCheckInterval = app.Flag("upstream-health-check-interval",
+		"How often to check health of unhealthy upstreams.").
+		Envar("CRAWLERA_HEADLESS_UPSTREAMHEALTHCHECKINTERVAL").
+		Duration()
+	upstreamHealthCheckTarget = app.Flag("upstream-health-check-target",
+		"host:port health checks establish tunnels to through upstreams (empty to only connect).").
+		Envar("CRAWLERA_HEADLESS_UPSTREAMHEALTHCHECKTARGET").
+		String()
 	xheaders = app.Flag("xheader",
 		"Crawlera X-Headers.").
 		Short('x').
@@ -108,6 +231,27 @@ var ( // nolint: gochecknoglobals
 		Short('k').
 		Envar("CRAWLERA_HEADLESS_ADBLOCKLISTS").
 		Strings()
+	adblockRefreshInterval = app.Flag("adblock-refresh-interval",
+		"How often to refresh adblock lists.").
+		Envar("CRAWLERA_HEADLESS_ADBLOCKREFRESHINTERVAL").
+		Duration()
+	adblockStartupTimeout = app.Flag("adblock-startup-timeout",
+		"For how long requests wait for adblock lists on start before they pass unfiltered.").
+		Envar("CRAWLERA_HEADLESS_ADBLOCKSTARTUPTIMEOUT").
+		Duration()
+	adblockRules = app.Flag("adblock-rule",
+		"An adblock rule to use in addition to adblock lists.").
+		Envar("CRAWLERA_HEADLESS_ADBLOCKRULES").
+		Strings()
+	adblockAllowlist = app.Flag("adblock-allow",
+		"A host or /regexp/ of URLs which are never blocked by adblock lists.").
+		Envar("CRAWLERA_HEADLESS_ADBLOCKALLOWLIST").
+		Strings()
+	adblockResponse = app.Flag("adblock-response",
+		"How to respond to adblocked requests by default.").
+		Envar("CRAWLERA_HEADLESS_ADBLOCKRESPONSE").
+		Enum(config.AdblockResponseForbidden, config.AdblockResponseNoContent, config.AdblockResponseEmpty,
+			config.AdblockResponseRedirect, config.AdblockResponseReset)
 	directAccessHostPathRegexps = app.Flag("direct-access-hostpath-regexps",
 		"A list of regexps for hostpath for direct access, bypassing Crawlera.").
 		Short('z').
@@ -127,15 +271,13 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Gracefully terminate context on SIGINT and SIGTERM signals.
+	// Gracefully shutdown on SIGINT and SIGTERM signals.
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	go func() {
-		for range signals {
-			cancel()
-		}
-	}()
+	// Reload configuration on SIGHUP.
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
 
 	app.Version(version)
 	log.SetFormatter(&log.TextFormatter{})
@@ -153,10 +295,6 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	if conf.APIKey == "" {
-		log.Fatal("API key is not set")
-	}
-
 	if err = initCertificates(conf); err != nil {
 		log.Fatal(err)
 	}
@@ -165,7 +303,31 @@ func main() {
 	log.WithFields(log.Fields{
 		"debug":                                 conf.Debug,
 		"adblock-lists":                         conf.AdblockLists,
+		"adblock-refresh-interval":              conf.AdblockRefreshInterval,
+		"adblock-startup-timeout":               conf.AdblockStartupTimeout,
+		"adblock-rules":                         conf.AdblockRules,
+		"adblock-allowlist":                     conf.AdblockAllowlist,
+		"adblock-response":                      conf.AdblockResponse,
+		"adblock-responses":                     len(conf.AdblockResponses),
 		"no-auto-sessions":                      conf.NoAutoSessions,
+		"sessions-per-client":                   conf.SessionsPerClient,
+		"session-balancing":                     conf.SessionBalancing,
+		"session-affinity":                      conf.SessionAffinity,
+		"session-create-timeout":                conf.SessionCreateTimeout,
+		"session-create-retry-timeout":          conf.SessionCreateRetryTimeout,
+		"session-api-timeout":                   conf.SessionAPITimeout,
+		"session-ttl":                           conf.SessionTTL,
+		"session-max-age":                       conf.SessionMaxAge,
+		"session-max-requests":                  conf.SessionMaxRequests,
+		"state-dir":                             conf.StateDir,
+		"shutdown-timeout":                      conf.ShutdownTimeout,
+		"client-id":                             conf.ClientID,
+		"client-id-port-range":                  conf.ClientIDPortRange,
+		"client-concurrent-connections":         conf.ClientConcurrentConnections,
+		"error-pages":                           conf.ErrorPages,
+		"auto-referer":                          conf.AutoReferer,
+		"referer-policy":                        conf.RefererPolicy,
+		"referer-ttl":                           conf.RefererTTL,
 		"apikey":                                conf.APIKey,
 		"bindip":                                conf.BindIP,
 		"bindport":                              conf.BindPort,
@@ -174,26 +336,119 @@ func main() {
 		"crawlera-host":                         conf.CrawleraHost,
 		"crawlera-port":                         conf.CrawleraPort,
 		"dont-verify-crawlera-cert":             conf.DoNotVerifyCrawleraCert,
+		"crawlera-tls":                          conf.CrawleraTLS,
+		"crawlera-ca-bundle":                    conf.CrawleraCABundle,
+		"upstreams":                             conf.CrawleraUpstreams(),
+		"upstream-balancing":                    conf.UpstreamBalancing,
+		"upstream-max-failures":                 conf.UpstreamMaxFailures,
+		"upstream-health-check-interval":        conf.UpstreamHealthCheckInterval,
+		"upstream-health-check-target":          conf.UpstreamHealthCheckTarget,
 		"concurrent-connections":                conf.ConcurrentConnections,
 		"xheaders":                              conf.XHeaders,
+		"tenants":                               len(conf.Tenants),
+		"listeners":                             len(conf.Listeners),
+		"inbound-auth-htpasswd":                 conf.InboundAuthHtpasswd,
+		"inbound-auth-tokens":                   len(conf.InboundAuthTokens),
+		"inbound-auth-cidrs":                    conf.InboundAuthCIDRs,
+		"proxy-api-tokens":                      len(conf.ProxyAPITokens),
+		"proxy-api-cidrs":                       conf.ProxyAPICIDRs,
 		"direct-access-hostpath-regexps":        conf.DirectAccessHostPathRegexps,
 		"direct-access-except-hostpath-regexps": conf.DirectAccessExceptHostPathRegexps,
 	}).Debugf("Listen on %s", listen)
 
 	statsContainer := stats.NewStats()
 
-	go stats.RunStats(statsContainer, conf)
-
 	appendClientHeader(conf)
 
-	if crawleraProxy, err := proxy.NewProxy(conf, statsContainer, &ctx); err == nil {
-		if ln, err2 := net.Listen("tcp", listen); err2 != nil {
-			log.Fatal(err2)
-		} else if err := crawleraProxy.Serve(ln); err != nil && err != http.ErrServerClosed {
+	crawleraProxy, err := proxy.NewProxy(conf, statsContainer, &ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reload := func() error {
+		return reloadConfig(crawleraProxy)
+	}
+
+	go func() {
+		for range reloadSignals {
+			if err := reload(); err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Cannot reload configuration")
+			}
+		}
+	}()
+
+	statsDone := make(chan struct{})
+
+	go func() {
+		defer close(statsDone)
+
+		if err := stats.RunStats(ctx, statsContainer, conf, reload, crawleraProxy.AuthenticateAPI,
+			crawleraProxy.Sessions(), crawleraProxy); err != nil {
 			log.Fatal(err)
 		}
-	} else {
-		log.Fatal(err)
+	}()
+
+	addresses := []string{listen}
+	for _, v := range conf.Listeners {
+		addresses = append(addresses, conf.ForListener(v).Bind())
+	}
+
+	listeners := make([]net.Listener, 0, len(addresses))
+
+	for _, addr := range addresses {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		listeners = append(listeners, ln)
+
+		go func() {
+			if err := crawleraProxy.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	<-signals
+	shutdown(crawleraProxy, listeners, signals, conf.ShutdownTimeout.Duration)
+	cancel()
+	<-statsDone
+}
+
+// shutdown stops accepting new connections and waits until requests in
+// flight are finished and sessions are deleted or saved. It gives up
+// after timeout or on the next signal.
+func shutdown(crawleraProxy *proxy.Proxy, listeners []net.Listener, signals <-chan os.Signal, timeout time.Duration) {
+	log.WithFields(log.Fields{
+		"timeout": timeout,
+	}).Info("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for _, ln := range listeners {
+		if err := ln.Close(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot close listener")
+		}
+	}
+
+	if err := crawleraProxy.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Cannot shutdown proxy gracefully")
 	}
 }
 
@@ -201,7 +456,15 @@ func getConfig() (*config.Config, error) {
 	conf := config.NewConfig()
 
 	if *configFileName != nil {
-		newConf, err := config.Parse(*configFileName)
+		// Config file is opened by name each time: it can be replaced
+		// before configuration is reloaded.
+		file, err := os.Open((*configFileName).Name())
+		if err != nil {
+			return nil, fmt.Errorf("cannot open config file: %w", err)
+		}
+		defer file.Close()
+
+		newConf, err := config.Parse(file)
 		if err != nil {
 			return nil, err
 		}
@@ -212,13 +475,47 @@ func getConfig() (*config.Config, error) {
 	conf.MaybeSetDebug(*debug)
 	conf.MaybeDoNotVerifyCrawleraCert(*doNotVerifyCrawleraCert)
 	conf.MaybeSetAdblockLists(*adblockLists)
+	conf.MaybeSetAdblockRefreshInterval(*adblockRefreshInterval)
+	conf.MaybeSetAdblockStartupTimeout(*adblockStartupTimeout)
+	conf.MaybeSetAdblockRules(*adblockRules)
+	conf.MaybeSetAdblockAllowlist(*adblockAllowlist)
+	conf.MaybeSetAdblockResponse(*adblockResponse)
 	conf.MaybeSetAPIKey(*apiKey)
 	conf.MaybeSetBindIP(*bindIP)
 	conf.MaybeSetBindPort(*bindPort)
 	conf.MaybeSetConcurrentConnections(*concurrentConnections)
 	conf.MaybeSetCrawleraHost(*crawleraHost)
 	conf.MaybeSetCrawleraPort(*crawleraPort)
+	conf.MaybeSetCrawleraTLS(*crawleraTLS)
+	conf.MaybeSetCrawleraCABundle(*crawleraCABundle)
+	conf.MaybeSetInboundAuthHtpasswd(*inboundAuthHtpasswd)
+	conf.MaybeSetInboundAuthTokens(*inboundAuthTokens)
+	conf.MaybeSetInboundAuthCIDRs(*inboundAuthCIDRs)
+	conf.MaybeSetProxyAPITokens(*proxyAPITokens)
+	conf.MaybeSetProxyAPICIDRs(*proxyAPICIDRs)
+	conf.MaybeSetUpstreamBalancing(*upstreamBalancing)
+	conf.MaybeSetUpstreamMaxFailures(*upstreamMaxFailures)
+	conf.MaybeSetUpstreamHealthCheckInterval(*upstreamHealthCheckInterval)
+	conf.MaybeSetUpstreamHealthCheckTarget(*upstreamHealthCheckTarget)
 	conf.MaybeSetNoAutoSessions(*noAutoSessions)
+	conf.MaybeSetSessionsPerClient(*sessionsPerClient)
+	conf.MaybeSetSessionBalancing(*sessionBalancing)
+	conf.MaybeSetSessionAffinity(*sessionAffinity)
+	conf.MaybeSetSessionCreateTimeout(*sessionCreateTimeout)
+	conf.MaybeSetSessionCreateRetryTimeout(*sessionCreateRetryTimeout)
+	conf.MaybeSetSessionAPITimeout(*sessionAPITimeout)
+	conf.MaybeSetSessionTTL(*sessionTTL)
+	conf.MaybeSetSessionMaxAge(*sessionMaxAge)
+	conf.MaybeSetSessionMaxRequests(*sessionMaxRequests)
+	conf.MaybeSetStateDir(*stateDir)
+	conf.MaybeSetShutdownTimeout(*shutdownTimeout)
+	conf.MaybeSetClientID(*clientID)
+	conf.MaybeSetClientIDPortRange(*clientIDPortRange)
+	conf.MaybeSetClientConcurrentConnections(*clientConcurrentConnections)
+	conf.MaybeSetErrorPages(*errorPages)
+	conf.MaybeSetAutoReferer(*autoReferer)
+	conf.MaybeSetRefererPolicy(*refererPolicy)
+	conf.MaybeSetRefererTTL(*refererTTL)
 	conf.MaybeSetTLSCaCertificate(*tlsCaCertificate)
 	conf.MaybeSetTLSPrivateKey(*tlsPrivateKey)
 	conf.MaybeSetProxyAPIIP(*proxyAPIIP)
@@ -226,6 +523,10 @@ func getConfig() (*config.Config, error) {
 	conf.MaybeSetDirectAccessHostPathRegexps(*directAccessHostPathRegexps)
 	conf.MaybeSetDirectAccessExceptHostPathRegexps(*directAccessExceptHostPathRegexps)
 
+	if err := conf.MaybeSetUpstreams(*upstreams); err != nil {
+		return nil, err
+	}
+
 	for k, v := range *xheaders {
 		conf.SetXHeader(k, v)
 	}
@@ -234,9 +535,47 @@ func getConfig() (*config.Config, error) {
 		conf.ProxyAPIIP = conf.BindIP
 	}
 
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	if conf.APIKey == "" && len(conf.Tenants) == 0 {
+		return nil, errors.New("API key is not set")
+	}
+
 	return conf, nil
 }
 
+// reloadConfig reads configuration again and applies it to the proxy.
+// Only settings of the layers are applied, the rest require a restart.
+// Certificates are read again to tell if they were changed.
+func reloadConfig(crawleraProxy *proxy.Proxy) error {
+	conf, err := getConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := initCertificates(conf); err != nil {
+		return err
+	}
+
+	appendClientHeader(conf)
+
+	if err := crawleraProxy.Reload(conf); err != nil {
+		return err
+	}
+
+	if conf.Debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.WarnLevel)
+	}
+
+	log.Info("Configuration was reloaded")
+
+	return nil
+}
+
 func appendClientHeader(conf *config.Config) {
 	clientVersion := "1"
 	clientHdr := fmt.Sprintf("zyte-smartproxy-headless-proxy/%s", clientVersion)
@@ -263,6 +602,7 @@ func initCertificates(conf *config.Config) (err error) {
 
 	conf.TLSCaCertificate = string(bytes.TrimSpace(caCertificate))
 	conf.TLSPrivateKey = string(bytes.TrimSpace(privateKey))
+	conf.CrawleraCA = string(bytes.TrimSpace(DefaultCrawleraCA))
 
 	log.WithFields(log.Fields{
 		"ca-cert":  fmt.Sprintf("%x", sha1.Sum([]byte(conf.TLSCaCertificate))), // nolint: gosec
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/9seconds/httransform/v2/dialers"
+	"github.com/9seconds/httransform/v2/errors"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/valyala/fasthttp"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	customs "github.com/scrapinghub/crawlera-headless-proxy/layers"
+)
+
+const crawleraDialerBufferSize = 5 * 1024
+
+// crawleraConnectError is an error of CONNECT request Crawlera has
+// responded to with other status code than 200.
+type crawleraConnectError struct {
+	statusCode int
+}
+
+func (c *crawleraConnectError) Error() string {
+	return fmt.Sprintf("crawlera has responded with %d status code", c.statusCode)
+}
+
+// crawleraDialer is a dialer which always connects to Crawlera. Unlike
+// the HTTP proxy dialer of httransform, it can talk to Crawlera over TLS
+// and verifies both Crawlera and tunneled certificates against a custom
+// pool of certificate authorities.
+type crawleraDialer struct {
+	netDialer   net.Dialer
+	address     string
+	upstreamTLS bool
+	tlsConfig   *tls.Config
+	user        string
+	password    string
+}
+
+func (c *crawleraDialer) Dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	conn, err := c.netDialer.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot dial to crawlera", "crawlera_dial", 0)
+	}
+
+	if !c.upstreamTLS {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(c.address)
+
+	tlsConn, err := c.handshake(ctx, conn, host)
+	if err != nil {
+		return nil, errors.Annotate(err, "cannot establish tls connection to crawlera", "crawlera_dial", 0)
+	}
+
+	return tlsConn, nil
+}
+
+func (c *crawleraDialer) UpgradeToTLS(ctx context.Context, conn net.Conn, host, port string) (net.Conn, error) {
+	started := time.Now()
+
+	if err := c.connect(ctx, conn, host, port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	getRoundTripTimings(ctx).addDial(time.Since(started))
+
+	return c.handshake(ctx, conn, host)
+}
+
+// connect establishes a tunnel to host:port through Crawlera. It uses
+// the same API key as plain requests (the key of the tenant or the one
+// of reloaded configuration). Requests which are not sent by clients
+// (like health checks) use API key the dialer was created with.
+func (c *crawleraDialer) connect(ctx context.Context, conn net.Conn, host, port string) error {
+	if err := conn.SetDeadline(time.Now().Add(c.netDialer.Timeout)); err != nil {
+		return errors.Annotate(err, "cannot set connection deadline", "crawlera_dial", 0)
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString("CONNECT ")
+	buf.WriteString(net.JoinHostPort(host, port))
+	buf.WriteString(" HTTP/1.1\r\n")
+
+	if user, password := c.credentials(ctx); user != "" {
+		buf.WriteString("Proxy-Authorization: Basic ")
+		buf.WriteString(base64.StdEncoding.EncodeToString([]byte(user + ":" + password)))
+		buf.WriteString("\r\n")
+	}
+
+	buf.WriteString("\r\n")
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return errors.Annotate(err, "cannot send a connect request", "crawlera_dial", 0)
+	}
+
+	response := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(response)
+
+	response.SkipBody = true
+
+	if err := response.Read(bufio.NewReaderSize(conn, crawleraDialerBufferSize)); err != nil {
+		return errors.Annotate(err, "cannot read connect response", "crawlera_dial", 0)
+	}
+
+	if response.StatusCode() != fasthttp.StatusOK {
+		return errors.Annotate(&crawleraConnectError{statusCode: response.StatusCode()},
+			"crawlera has rejected connect request", "crawlera_connect", 0)
+	}
+
+	return nil
+}
+
+// checkHealth dials to Crawlera and establishes a tunnel to the target.
+// If target is empty, only a connection to Crawlera is checked.
+func (c *crawleraDialer) checkHealth(ctx context.Context, target string) error {
+	conn, err := c.Dial(ctx, "", "")
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if target == "" {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return fmt.Errorf("incorrect health check target: %w", err)
+	}
+
+	return c.connect(ctx, conn, host, port)
+}
+
+func (c *crawleraDialer) credentials(ctx context.Context) (string, string) {
+	if layersCtx, ok := ctx.(*layers.Context); ok {
+		if apiKey := customs.APIKey(layersCtx); apiKey != "" {
+			return apiKey, ""
+		}
+	}
+
+	return c.user, c.password
+}
+
+func (c *crawleraDialer) PatchHTTPRequest(req *fasthttp.Request) {
+	if bytes.EqualFold(req.URI().Scheme(), []byte("http")) {
+		req.SetRequestURIBytes(req.Header.RequestURI())
+	}
+}
+
+func (c *crawleraDialer) handshake(ctx context.Context, conn net.Conn, host string) (net.Conn, error) {
+	started := time.Now()
+	defer func() {
+		getRoundTripTimings(ctx).addTLS(time.Since(started))
+	}()
+
+	conf := c.tlsConfig.Clone()
+	conf.ServerName = host
+
+	if err := conn.SetDeadline(time.Now().Add(c.netDialer.Timeout)); err != nil {
+		conn.Close()
+		return nil, errors.Annotate(err, "cannot set connection deadline", "tls_handshake", 0)
+	}
+
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, errors.Annotate(err, "cannot perform TLS handshake", "tls_handshake", 0)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, errors.Annotate(err, "cannot reset connection deadline", "tls_handshake", 0)
+	}
+
+	return tlsConn, nil
+}
+
+// makeCrawleraCertPool returns a pool of system CAs, Crawlera CA and
+// CAs of the optional bundle.
+func makeCrawleraCertPool(conf *config.Config) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	if conf.CrawleraCA != "" && !pool.AppendCertsFromPEM([]byte(conf.CrawleraCA)) {
+		return nil, errors.New("incorrect crawlera CA certificate")
+	}
+
+	if conf.CrawleraCABundle == "" {
+		return pool, nil
+	}
+
+	bundle, err := ioutil.ReadFile(conf.CrawleraCABundle)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read crawlera CA bundle: %w", err)
+	}
+
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates were found in crawlera CA bundle %s", conf.CrawleraCABundle)
+	}
+
+	return pool, nil
+}
+
+func newCrawleraDialer(conf *config.Config, upstream config.Upstream, pool *x509.CertPool) (*crawleraDialer, error) {
+	parsed, err := url.Parse(upstream.URL(conf.APIKey))
+	if err != nil {
+		return nil, fmt.Errorf("incorrect crawlera url: %w", err)
+	}
+
+	dialer := &crawleraDialer{
+		netDialer: net.Dialer{
+			Timeout: dialers.DefaultTimeout,
+		},
+		address:     parsed.Host,
+		upstreamTLS: parsed.Scheme == "https",
+		tlsConfig: &tls.Config{
+			RootCAs:            pool,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+			InsecureSkipVerify: conf.DoNotVerifyCrawleraCert, // nolint: gosec
+		},
+	}
+
+	if parsed.User != nil {
+		dialer.user = parsed.User.Username()
+		dialer.password, _ = parsed.User.Password()
+	}
+
+	return dialer, nil
+}
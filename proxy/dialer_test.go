@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/9seconds/httransform/v2/dialers"
+	"github.com/9seconds/httransform/v2/events"
+	"github.com/9seconds/httransform/v2/executor"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	customs "github.com/scrapinghub/crawlera-headless-proxy/layers"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+type CrawleraDialerTestSuite struct {
+	suite.Suite
+
+	upstream    *httptest.Server
+	target      *httptest.Server
+	connectAuth atomic.Value
+	bundle      string
+	conf        *config.Config
+}
+
+func (suite *CrawleraDialerTestSuite) SetupSuite() {
+	suite.target = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("target")) // nolint: errcheck
+	}))
+
+	suite.upstream = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.Write([]byte(r.URL.Path)) // nolint: errcheck
+			return
+		}
+
+		suite.connectAuth.Store(r.Header.Get("Proxy-Authorization"))
+
+		if r.Header.Get("Proxy-Authorization") != "Basic YXBpa2V5Og==" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		targetConn, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		clientConn, _, _ := w.(http.Hijacker).Hijack()
+		clientConn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n")) // nolint: errcheck
+
+		go func() {
+			io.Copy(targetConn, clientConn) // nolint: errcheck
+			targetConn.Close()
+		}()
+
+		io.Copy(clientConn, targetConn) // nolint: errcheck
+		clientConn.Close()
+	}))
+
+	bundle, _ := ioutil.TempFile("", "crawlera-ca-bundle")
+	pem.Encode(bundle, &pem.Block{ // nolint: errcheck
+		Type:  "CERTIFICATE",
+		Bytes: suite.upstream.Certificate().Raw,
+	})
+	bundle.Close()
+
+	suite.bundle = bundle.Name()
+}
+
+func (suite *CrawleraDialerTestSuite) TearDownSuite() {
+	suite.upstream.Close()
+	suite.target.Close()
+	os.Remove(suite.bundle)
+}
+
+func (suite *CrawleraDialerTestSuite) SetupTest() {
+	parsed, _ := url.Parse(suite.upstream.URL)
+	port, _ := strconv.Atoi(parsed.Port())
+
+	suite.conf = config.NewConfig()
+	suite.conf.APIKey = "apikey"
+	suite.conf.CrawleraHost = parsed.Hostname()
+	suite.conf.CrawleraPort = port
+	suite.conf.CrawleraTLS = true
+}
+
+func (suite *CrawleraDialerTestSuite) makeDialer() (dialers.Dialer, error) {
+	pool, err := makeCrawleraCertPool(suite.conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCrawleraDialer(suite.conf, suite.conf.CrawleraUpstream(), pool)
+}
+
+func (suite *CrawleraDialerTestSuite) TestPlainRequestOverTLS() {
+	suite.conf.CrawleraCABundle = suite.bundle
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	conn, err := dialer.Dial(context.Background(), "example.com", "80")
+	suite.NoError(err)
+
+	defer conn.Close()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI("http://example.com/path")
+	dialer.PatchHTTPRequest(req)
+
+	_, err = req.WriteTo(conn)
+	suite.NoError(err)
+	suite.NoError(resp.Read(bufio.NewReader(conn)))
+	suite.Equal(http.StatusOK, resp.StatusCode())
+	suite.Equal("/path", string(resp.Body()))
+}
+
+func (suite *CrawleraDialerTestSuite) TestTunnelOverTLS() {
+	suite.conf.CrawleraCABundle = suite.bundle
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	parsed, _ := url.Parse(suite.target.URL)
+
+	conn, err := dialer.Dial(context.Background(), parsed.Hostname(), parsed.Port())
+	suite.NoError(err)
+
+	defer conn.Close()
+
+	conn, err = dialer.UpgradeToTLS(context.Background(), conn, parsed.Hostname(), parsed.Port())
+	suite.NoError(err)
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(suite.target.URL + "/")
+	dialer.PatchHTTPRequest(req)
+
+	_, err = req.WriteTo(conn)
+	suite.NoError(err)
+	suite.NoError(resp.Read(bufio.NewReader(conn)))
+	suite.Equal("target", string(resp.Body()))
+}
+
+func (suite *CrawleraDialerTestSuite) TestUnknownAuthority() {
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	_, err = dialer.Dial(context.Background(), "example.com", "80")
+	suite.Error(err)
+}
+
+func (suite *CrawleraDialerTestSuite) TestEmbeddedCA() {
+	suite.conf.CrawleraCA = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: suite.upstream.Certificate().Raw,
+	}))
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	conn, err := dialer.Dial(context.Background(), "example.com", "80")
+	suite.NoError(err)
+	conn.Close()
+}
+
+func (suite *CrawleraDialerTestSuite) TestIncorrectEmbeddedCA() {
+	suite.conf.CrawleraCA = "not a certificate"
+
+	_, err := suite.makeDialer()
+	suite.Error(err)
+}
+
+func (suite *CrawleraDialerTestSuite) TestDoNotVerify() {
+	suite.conf.DoNotVerifyCrawleraCert = true
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	conn, err := dialer.Dial(context.Background(), "example.com", "80")
+	suite.NoError(err)
+	conn.Close()
+}
+
+func (suite *CrawleraDialerTestSuite) TestIncorrectBundle() {
+	bundle, _ := ioutil.TempFile("", "crawlera-ca-bundle")
+	bundle.WriteString("not a certificate") // nolint: errcheck
+	bundle.Close()
+
+	defer os.Remove(bundle.Name())
+
+	suite.conf.CrawleraCABundle = bundle.Name()
+
+	_, err := suite.makeDialer()
+	suite.Error(err)
+}
+
+func (suite *CrawleraDialerTestSuite) TestTimings() {
+	suite.conf.CrawleraCABundle = suite.bundle
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	fhttpCtx := &fasthttp.RequestCtx{}
+	fhttpCtx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 65342}, nil)
+
+	ctx := layers.AcquireContext()
+	defer layers.ReleaseContext(ctx)
+
+	ctx.Init(fhttpCtx, "", noopEventStream{}, "", 0) // nolint: errcheck
+
+	timings := &roundTripTimings{}
+	ctx.Set(roundTripTimingsContextType, timings)
+
+	timed := &timingDialer{Dialer: dialer}
+	parsed, _ := url.Parse(suite.target.URL)
+
+	conn, err := timed.Dial(ctx, parsed.Hostname(), parsed.Port())
+	suite.NoError(err)
+
+	defer conn.Close()
+
+	dial, tls := timings.dialTime(), timings.tlsTime()
+	suite.Greater(int64(dial), int64(0))
+	suite.Greater(int64(tls), int64(0))
+
+	_, err = timed.UpgradeToTLS(ctx, conn, parsed.Hostname(), parsed.Port())
+	suite.NoError(err)
+
+	suite.Greater(int64(timings.dialTime()), int64(dial))
+	suite.Greater(int64(timings.tlsTime()), int64(tls))
+}
+
+func (suite *CrawleraDialerTestSuite) TestTenantCredentials() {
+	suite.conf.APIKey = ""
+	suite.conf.CrawleraCABundle = suite.bundle
+	suite.conf.Tenants = []config.Tenant{
+		{
+			Name:        "users",
+			APIKey:      "apikey",
+			SourceCIDRs: []string{"127.0.0.0/8"},
+		},
+	}
+
+	dialer, err := suite.makeDialer()
+	suite.NoError(err)
+
+	parsed, _ := url.Parse(suite.target.URL)
+
+	fhttpCtx := &fasthttp.RequestCtx{}
+	fhttpCtx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 65342}, nil)
+	fhttpCtx.Request.SetRequestURI(suite.target.URL + "/")
+	fhttpCtx.Request.Header.SetHost(parsed.Host)
+
+	// The context is not released: httransform reads it from a goroutine
+	// which can outlive a round trip, so it is not safe to reuse.
+	ctx := layers.AcquireContext()
+	ctx.Init(fhttpCtx, parsed.Host, noopEventStream{}, "user", events.RequestTypeTLS) // nolint: errcheck
+
+	suite.NoError(customs.NewBaseLayer(suite.conf, stats.NewStats()).OnRequest(ctx))
+	suite.NoError(customs.NewTenantsLayer(suite.conf).OnRequest(ctx))
+	suite.NoError(customs.NewAuthLayer(suite.conf.APIKey).OnRequest(ctx))
+
+	suite.NoError(executor.MakeDefaultExecutor(dialer)(ctx))
+	suite.Equal("target", string(ctx.Response().Body()))
+	suite.Equal("Basic YXBpa2V5Og==", suite.connectAuth.Load())
+}
+
+func (suite *CrawleraDialerTestSuite) TestAPIRequest() {
+	suite.conf.CrawleraCABundle = suite.bundle
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool, err := newUpstreamPool(ctx, suite.conf, stats.NewStats())
+	suite.NoError(err)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, "http://proxy.zyte.com:8011/sessions/123", http.NoBody)
+
+	resp, err := (&http.Client{Transport: pool}).Do(req)
+	suite.NoError(err)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+	suite.Equal("/sessions/123", string(body))
+}
+
+func TestCrawleraDialer(t *testing.T) {
+	suite.Run(t, &CrawleraDialerTestSuite{})
+}
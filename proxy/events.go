@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/9seconds/httransform/v2/events"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+type eventsRequest struct {
+	method string
+	host   string
+}
+
+// eventsProcessor feeds stats with events of httransform: requests
+// per method and per host, generated TLS certificates and traffic.
+//
+// httransform routes all events of the same request to the same
+// processor and processes them sequentially so no locking is
+// required here.
+type eventsProcessor struct {
+	metrics  *stats.Stats
+	requests map[string]eventsRequest
+}
+
+func (e *eventsProcessor) Process(evt events.Event) {
+	switch evt.Type {
+	case events.EventTypeStartRequest:
+		e.onStartRequest(evt.Value.(*events.RequestMeta))
+	case events.EventTypeFinishRequest:
+		e.onFinishRequest(evt.Value.(*events.ResponseMeta))
+	case events.EventTypeTraffic:
+		e.onTraffic(evt.Value.(*events.TrafficMeta))
+	case events.EventTypeNewCertificate:
+		e.metrics.NewCertificate()
+	case events.EventTypeDropCertificate:
+		e.metrics.DropCertificate()
+	}
+}
+
+func (e *eventsProcessor) Shutdown() {}
+
+func (e *eventsProcessor) onStartRequest(meta *events.RequestMeta) {
+	request := eventsRequest{
+		method: meta.Method,
+		host:   string(meta.URI.Host()),
+	}
+	e.requests[meta.RequestID] = request
+
+	e.metrics.NewConnection()
+	e.metrics.NewHostRequest(request.host)
+
+	switch request.method {
+	case http.MethodGet:
+		e.metrics.NewGet()
+	case http.MethodHead:
+		e.metrics.NewHead()
+	case http.MethodPost:
+		e.metrics.NewPost()
+	case http.MethodPut:
+		e.metrics.NewPut()
+	case http.MethodDelete:
+		e.metrics.NewDelete()
+	case http.MethodConnect:
+		e.metrics.NewConnect()
+	case http.MethodOptions:
+		e.metrics.NewOptions()
+	case http.MethodTrace:
+		e.metrics.NewTrace()
+	case http.MethodPatch:
+		e.metrics.NewPatch()
+	default:
+		e.metrics.NewOther()
+	}
+}
+
+func (e *eventsProcessor) onFinishRequest(meta *events.ResponseMeta) {
+	request, ok := e.requests[meta.RequestID]
+	if !ok {
+		return
+	}
+
+	delete(e.requests, meta.RequestID)
+
+	e.metrics.DropConnection()
+
+	if meta.StatusCode == 0 || meta.StatusCode >= http.StatusBadRequest {
+		e.metrics.NewHostError(request.host)
+	}
+
+	switch request.method {
+	case http.MethodGet:
+		e.metrics.DropGet()
+	case http.MethodHead:
+		e.metrics.DropHead()
+	case http.MethodPost:
+		e.metrics.DropPost()
+	case http.MethodPut:
+		e.metrics.DropPut()
+	case http.MethodDelete:
+		e.metrics.DropDelete()
+	case http.MethodConnect:
+		e.metrics.DropConnect()
+	case http.MethodOptions:
+		e.metrics.DropOptions()
+	case http.MethodTrace:
+		e.metrics.DropTrace()
+	case http.MethodPatch:
+		e.metrics.DropPatch()
+	default:
+		e.metrics.DropOther()
+	}
+}
+
+// onTraffic accounts traffic of connections to upstream. Traffic
+// event is sent when connection is closed, so it usually comes before
+// request is finished. Late events are ignored.
+func (e *eventsProcessor) onTraffic(meta *events.TrafficMeta) {
+	if request, ok := e.requests[meta.ID]; ok {
+		e.metrics.NewHostTraffic(request.host, meta.ReadBytes, meta.WrittenBytes)
+	}
+}
+
+func makeEventsProcessorFactory(metrics *stats.Stats) events.ProcessorFactory {
+	return func() events.Processor {
+		return &eventsProcessor{
+			metrics:  metrics,
+			requests: map[string]eventsRequest{},
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/9seconds/httransform/v2/events"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+type EventsProcessorTestSuite struct {
+	suite.Suite
+
+	metrics   *stats.Stats
+	processor events.Processor
+}
+
+func (suite *EventsProcessorTestSuite) SetupTest() {
+	suite.metrics = stats.NewStats()
+	suite.processor = makeEventsProcessorFactory(suite.metrics)()
+}
+
+func (suite *EventsProcessorTestSuite) start(id, method, rawURL string) {
+	meta := &events.RequestMeta{
+		RequestID: id,
+		Method:    method,
+	}
+	meta.URI.Parse(nil, []byte(rawURL)) // nolint: errcheck
+
+	suite.processor.Process(events.Event{Type: events.EventTypeStartRequest, Value: meta})
+}
+
+func (suite *EventsProcessorTestSuite) finish(id string, statusCode int) {
+	suite.processor.Process(events.Event{
+		Type:  events.EventTypeFinishRequest,
+		Value: &events.ResponseMeta{RequestID: id, StatusCode: statusCode},
+	})
+}
+
+func (suite *EventsProcessorTestSuite) traffic(id string, read, written uint64) {
+	suite.processor.Process(events.Event{
+		Type:  events.EventTypeTraffic,
+		Value: &events.TrafficMeta{ID: id, ReadBytes: read, WrittenBytes: written},
+	})
+}
+
+func (suite *EventsProcessorTestSuite) stats() map[string]json.RawMessage {
+	marshalled, err := json.Marshal(suite.metrics)
+	suite.NoError(err)
+
+	decoded := map[string]json.RawMessage{}
+	suite.NoError(json.Unmarshal(marshalled, &decoded))
+
+	return decoded
+}
+
+func (suite *EventsProcessorTestSuite) TestMethods() {
+	suite.start("1", http.MethodGet, "http://example.com/")
+	suite.start("2", http.MethodGet, "http://example.com/")
+	suite.start("3", "PROPFIND", "http://example.com/")
+	suite.finish("1", http.StatusOK)
+	suite.finish("3", http.StatusOK)
+
+	methods := map[string]struct {
+		InFlight uint64 `json:"in_flight"`
+		Total    uint64 `json:"total"`
+	}{}
+	suite.NoError(json.Unmarshal(suite.stats()["methods"], &methods))
+
+	suite.EqualValues(1, methods["GET"].InFlight)
+	suite.EqualValues(2, methods["GET"].Total)
+	suite.EqualValues(0, methods["OTHER"].InFlight)
+	suite.EqualValues(1, methods["OTHER"].Total)
+	suite.EqualValues(0, methods["POST"].Total)
+
+	suite.EqualValues(3, suite.metrics.RequestsNumber)
+	suite.EqualValues(1, suite.metrics.ClientsConnected)
+}
+
+func (suite *EventsProcessorTestSuite) TestCertificates() {
+	suite.processor.Process(events.Event{Type: events.EventTypeNewCertificate, Value: "example.com"})
+	suite.processor.Process(events.Event{Type: events.EventTypeNewCertificate, Value: "example.org"})
+	suite.processor.Process(events.Event{Type: events.EventTypeDropCertificate, Value: "example.com"})
+
+	suite.EqualValues(2, suite.metrics.CertificatesGenerated)
+	suite.EqualValues(1, suite.metrics.CertificatesCached)
+}
+
+func (suite *EventsProcessorTestSuite) TestHosts() {
+	suite.start("1", http.MethodGet, "https://example.com/")
+	suite.traffic("1", 1000, 100)
+	suite.finish("1", http.StatusOK)
+
+	suite.start("2", http.MethodGet, "https://example.org/")
+	suite.traffic("2", 10, 10)
+	suite.finish("2", http.StatusForbidden)
+
+	suite.start("3", http.MethodGet, "https://example.org/")
+	suite.finish("3", http.StatusOK)
+	suite.traffic("3", 10000, 10000)
+
+	type hostStats struct {
+		Host          string `json:"host"`
+		Requests      uint64 `json:"requests"`
+		Errors        uint64 `json:"errors"`
+		BytesReceived uint64 `json:"bytes_received"`
+		BytesSent     uint64 `json:"bytes_sent"`
+	}
+
+	hosts := struct {
+		ByRequests []hostStats `json:"by_requests"`
+		ByBytes    []hostStats `json:"by_bytes"`
+		ByErrors   []hostStats `json:"by_errors"`
+	}{}
+	suite.NoError(json.Unmarshal(suite.stats()["hosts"], &hosts))
+
+	suite.Equal([]hostStats{
+		{Host: "example.org", Requests: 2, Errors: 1, BytesReceived: 10, BytesSent: 10},
+		{Host: "example.com", Requests: 1, BytesReceived: 1000, BytesSent: 100},
+	}, hosts.ByRequests)
+	suite.Equal("example.com", hosts.ByBytes[0].Host)
+	suite.Len(hosts.ByErrors, 1)
+	suite.Equal("example.org", hosts.ByErrors[0].Host)
+}
+
+func TestEventsProcessor(t *testing.T) {
+	suite.Run(t, &EventsProcessorTestSuite{})
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/9seconds/httransform/v2/dialers"
+	"github.com/9seconds/httransform/v2/executor"
+	"github.com/9seconds/httransform/v2/layers"
+
+	customs "github.com/scrapinghub/crawlera-headless-proxy/layers"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+const roundTripTimingsContextType = "round_trip_timings"
+
+// roundTripTimings collects durations of the phases of a single round
+// trip: establishing a connection (including tunnel through Crawlera),
+// TLS handshakes and time to the first byte of the response. Values are
+// in nanoseconds and accessed atomically because hijacked connections
+// can outlive a request.
+type roundTripTimings struct {
+	dial int64
+	tls  int64
+	ttfb int64
+}
+
+func (r *roundTripTimings) addDial(elapsed time.Duration) {
+	if r != nil {
+		atomic.AddInt64(&r.dial, int64(elapsed))
+	}
+}
+
+func (r *roundTripTimings) addTLS(elapsed time.Duration) {
+	if r != nil {
+		atomic.AddInt64(&r.tls, int64(elapsed))
+	}
+}
+
+func (r *roundTripTimings) setTTFB(elapsed time.Duration) {
+	if r != nil {
+		atomic.StoreInt64(&r.ttfb, int64(elapsed))
+	}
+}
+
+func (r *roundTripTimings) dialTime() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&r.dial))
+}
+
+func (r *roundTripTimings) tlsTime() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&r.tls))
+}
+
+func (r *roundTripTimings) ttfbTime() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	return time.Duration(atomic.LoadInt64(&r.ttfb))
+}
+
+// getRoundTripTimings returns timings of the current round trip. Dialers
+// get layers.Context as context.Context from the executor, other
+// contexts (for example, of health checks) have no timings.
+func getRoundTripTimings(ctx context.Context) *roundTripTimings {
+	if layersCtx, ok := ctx.(*layers.Context); ok {
+		if timings, ok := layersCtx.Get(roundTripTimingsContextType).(*roundTripTimings); ok {
+			return timings
+		}
+	}
+
+	return nil
+}
+
+// timingDialer measures how long it takes to dial and to upgrade a
+// connection to TLS. A wrapped dialer may attribute some parts of these
+// calls to the other phase on its own (for example, crawleraDialer
+// performs TLS handshake with Crawlera in Dial), so only the rest of the
+// time is attributed here.
+type timingDialer struct {
+	dialers.Dialer
+}
+
+func (t *timingDialer) Dial(ctx context.Context, host, port string) (net.Conn, error) {
+	timings := getRoundTripTimings(ctx)
+	started := time.Now()
+	tlsBefore := timings.tlsTime()
+
+	conn, err := t.Dialer.Dial(ctx, host, port)
+
+	timings.addDial(time.Since(started) - (timings.tlsTime() - tlsBefore))
+
+	if err != nil || timings == nil {
+		return conn, err
+	}
+
+	return &timingConn{Conn: conn, timings: timings}, nil
+}
+
+func (t *timingDialer) UpgradeToTLS(ctx context.Context, conn net.Conn, host, port string) (net.Conn, error) {
+	timings := getRoundTripTimings(ctx)
+	started := time.Now()
+	dialBefore := timings.dialTime()
+
+	tlsConn, err := t.Dialer.UpgradeToTLS(ctx, conn, host, port)
+
+	timings.addTLS(time.Since(started) - (timings.dialTime() - dialBefore))
+
+	return tlsConn, err
+}
+
+// timingConn measures time between sending a request and getting the
+// first byte of the response. Each time connection switches from
+// writing to reading, the measurement is overwritten, so the last one
+// belongs to the HTTP request, not to CONNECT or TLS handshake.
+type timingConn struct {
+	net.Conn
+
+	timings      *roundTripTimings
+	writeStarted int64
+}
+
+func (t *timingConn) Write(b []byte) (int, error) {
+	atomic.CompareAndSwapInt64(&t.writeStarted, 0, time.Now().UnixNano())
+
+	return t.Conn.Write(b)
+}
+
+func (t *timingConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+
+	if n > 0 {
+		if started := atomic.SwapInt64(&t.writeStarted, 0); started != 0 {
+			t.timings.setTTFB(time.Duration(time.Now().UnixNano() - started))
+		}
+	}
+
+	return n, err
+}
+
+// trafficDialer counts bytes which are sent and received by its
+// connections. Traffic is accounted on the fly because response bodies
+// are streamed to clients after executor has returned.
+type trafficDialer struct {
+	dialers.Dialer
+
+	route   string
+	metrics *stats.Stats
+}
+
+func (t *trafficDialer) Dial(ctx context.Context, host, port string) (net.Conn, error) {
+	conn, err := t.Dialer.Dial(ctx, host, port)
+	if err != nil {
+		return conn, err
+	}
+
+	clientID := ""
+	if layersCtx, ok := ctx.(*layers.Context); ok {
+		clientID = customs.ClientID(layersCtx)
+	}
+
+	return &trafficConn{
+		Conn:     conn,
+		route:    t.route,
+		clientID: clientID,
+		metrics:  t.metrics,
+	}, nil
+}
+
+type trafficConn struct {
+	net.Conn
+
+	route    string
+	clientID string
+	metrics  *stats.Stats
+}
+
+func (t *trafficConn) Write(b []byte) (int, error) {
+	n, err := t.Conn.Write(b)
+
+	if n > 0 {
+		t.metrics.NewTraffic(t.route, t.clientID, 0, uint64(n))
+	}
+
+	return n, err
+}
+
+func (t *trafficConn) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+
+	if n > 0 {
+		t.metrics.NewTraffic(t.route, t.clientID, uint64(n), 0)
+	}
+
+	return n, err
+}
+
+// makeInstrumentedExecutor returns an executor which sends requests
+// with the given dialer and records each round trip in stats: a number
+// of requests, overall time, times of its phases and traffic. route
+// defines if these are requests to Crawlera or direct ones.
+func makeInstrumentedExecutor(dialer dialers.Dialer, route string, metrics *stats.Stats) executor.Executor {
+	defaultExecutor := executor.MakeDefaultExecutor(&timingDialer{
+		Dialer: &trafficDialer{
+			Dialer:  dialer,
+			route:   route,
+			metrics: metrics,
+		},
+	})
+
+	return func(ctx *layers.Context) error {
+		timings := &roundTripTimings{}
+		started := time.Now()
+
+		ctx.Set(roundTripTimingsContextType, timings)
+		metrics.NewClientServing()
+
+		err := defaultExecutor(ctx)
+		elapsed := time.Since(started)
+
+		metrics.DropClientServing()
+		ctx.Delete(roundTripTimingsContextType)
+
+		if route == stats.RouteDirect {
+			metrics.NewDirectRequest()
+			metrics.NewDirectTime(elapsed)
+		} else {
+			metrics.NewCrawleraRequest()
+			metrics.NewCrawleraTime(elapsed)
+		}
+
+		metrics.NewRoundTripPhases(route, timings.dialTime(), timings.tlsTime(), timings.ttfbTime())
+
+		return err
+	}
+}
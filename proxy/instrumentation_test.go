@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/9seconds/httransform/v2/dialers"
+	"github.com/9seconds/httransform/v2/events"
+	"github.com/9seconds/httransform/v2/executor"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+const instrumentationTestDelay = 20 * time.Millisecond
+
+type InstrumentationTestSuite struct {
+	suite.Suite
+
+	plain   *httptest.Server
+	secure  *httptest.Server
+	dialer  dialers.Dialer
+	metrics *stats.Stats
+}
+
+func (suite *InstrumentationTestSuite) SetupSuite() {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(instrumentationTestDelay)
+		w.Write([]byte("ok")) // nolint: errcheck
+	})
+
+	suite.plain = httptest.NewServer(handler)
+	suite.secure = httptest.NewTLSServer(handler)
+	suite.dialer = dialers.NewBase(dialers.Opts{TLSSkipVerify: true})
+}
+
+func (suite *InstrumentationTestSuite) TearDownSuite() {
+	suite.plain.Close()
+	suite.secure.Close()
+}
+
+func (suite *InstrumentationTestSuite) SetupTest() {
+	suite.metrics = stats.NewStats()
+}
+
+func (suite *InstrumentationTestSuite) makeContext(rawURL string) *layers.Context {
+	fhttpCtx := &fasthttp.RequestCtx{}
+	fhttpCtx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 65342}, nil)
+	fhttpCtx.Request.SetRequestURI(rawURL)
+
+	connectTo := string(fhttpCtx.Request.URI().Host())
+	fhttpCtx.Request.Header.SetHost(connectTo)
+
+	requestType := events.RequestType(0)
+	if strings.HasPrefix(rawURL, "https://") {
+		requestType = events.RequestTypeTLS
+	}
+
+	// Contexts are not released: httransform reads them from a goroutine
+	// which can outlive a round trip, so they are not safe to reuse.
+	ctx := layers.AcquireContext()
+	ctx.Init(fhttpCtx, connectTo, noopEventStream{}, "", requestType) // nolint: errcheck
+
+	return ctx
+}
+
+func (suite *InstrumentationTestSuite) execute(exec executor.Executor, rawURL string) *roundTripTimings {
+	ctx := suite.makeContext(rawURL)
+
+	timings := &roundTripTimings{}
+	ctx.Set(roundTripTimingsContextType, timings)
+
+	suite.NoError(exec(ctx))
+	suite.Equal("ok", string(ctx.Response().Body()))
+
+	return timings
+}
+
+func (suite *InstrumentationTestSuite) TestPlainTimings() {
+	exec := executor.MakeDefaultExecutor(&timingDialer{Dialer: suite.dialer})
+	timings := suite.execute(exec, suite.plain.URL+"/")
+
+	suite.Greater(int64(timings.dialTime()), int64(0))
+	suite.EqualValues(0, timings.tlsTime())
+	suite.GreaterOrEqual(int64(timings.ttfbTime()), int64(instrumentationTestDelay))
+}
+
+func (suite *InstrumentationTestSuite) TestTLSTimings() {
+	exec := executor.MakeDefaultExecutor(&timingDialer{Dialer: suite.dialer})
+	timings := suite.execute(exec, suite.secure.URL+"/")
+
+	suite.Greater(int64(timings.dialTime()), int64(0))
+	suite.Greater(int64(timings.tlsTime()), int64(0))
+	suite.GreaterOrEqual(int64(timings.ttfbTime()), int64(instrumentationTestDelay))
+	suite.Less(int64(timings.ttfbTime()), int64(time.Second))
+}
+
+func (suite *InstrumentationTestSuite) TestStats() {
+	proxied := makeInstrumentedExecutor(suite.dialer, stats.RouteProxied, suite.metrics)
+	direct := makeInstrumentedExecutor(suite.dialer, stats.RouteDirect, suite.metrics)
+
+	for _, exec := range []executor.Executor{proxied, proxied, direct} {
+		ctx := suite.makeContext(suite.secure.URL + "/")
+
+		suite.NoError(exec(ctx))
+		suite.Nil(ctx.Get(roundTripTimingsContextType))
+	}
+
+	suite.EqualValues(2, suite.metrics.CrawleraRequests)
+	suite.EqualValues(1, suite.metrics.DirectRequests)
+	suite.EqualValues(0, suite.metrics.ClientsServing)
+
+	marshalled, err := json.Marshal(suite.metrics.Traffic)
+	suite.NoError(err)
+
+	traffic := struct {
+		BytesIn  uint64 `json:"bytes_in"`
+		BytesOut uint64 `json:"bytes_out"`
+		Routes   map[string]struct {
+			BytesIn  uint64 `json:"bytes_in"`
+			BytesOut uint64 `json:"bytes_out"`
+		} `json:"routes"`
+	}{}
+	suite.NoError(json.Unmarshal(marshalled, &traffic))
+	suite.Greater(traffic.Routes[stats.RouteProxied].BytesIn, traffic.Routes[stats.RouteDirect].BytesIn)
+	suite.Greater(traffic.Routes[stats.RouteDirect].BytesIn, uint64(0))
+	suite.Greater(traffic.Routes[stats.RouteDirect].BytesOut, uint64(0))
+	suite.Equal(traffic.Routes[stats.RouteProxied].BytesIn+traffic.Routes[stats.RouteDirect].BytesIn, traffic.BytesIn)
+	suite.EqualValues(0, traffic.Routes[stats.RouteAdblocked].BytesIn)
+
+	for _, series := range []json.Marshaler{
+		suite.metrics.CrawleraTimes,
+		suite.metrics.CrawleraDialTimes,
+		suite.metrics.CrawleraTLSTimes,
+		suite.metrics.CrawleraTTFBTimes,
+		suite.metrics.DirectTimes,
+	} {
+		marshalled, err := json.Marshal(series)
+		suite.NoError(err)
+
+		decoded := struct {
+			Average float64 `json:"average"`
+		}{}
+		suite.NoError(json.Unmarshal(marshalled, &decoded))
+		suite.Greater(decoded.Average, 0.0)
+	}
+}
+
+func TestInstrumentation(t *testing.T) {
+	suite.Run(t, &InstrumentationTestSuite{})
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/9seconds/httransform/v2/layers"
+)
+
+const (
+	layerChainContextType = "layer_chain"
+
+	layerChainWaitInterval = 100 * time.Millisecond
+)
+
+// layerChainState is a chain of layers a request has started with and
+// a number of layers it has passed through on its way to executor.
+type layerChainState struct {
+	layers []layers.Layer
+	passed int
+}
+
+// layerChains are chains of layers of all listeners. A chain is chosen
+// by the port a request was accepted on. Requests to other ports use
+// the default chain.
+type layerChains struct {
+	fallback   []layers.Layer
+	byBindPort map[int][]layers.Layer
+}
+
+func (l *layerChains) get(ctx *layers.Context) []layers.Layer {
+	if addr, ok := ctx.LocalAddr().(*net.TCPAddr); ok {
+		if chain, ok := l.byBindPort[addr.Port]; ok {
+			return chain
+		}
+	}
+
+	return l.fallback
+}
+
+// layerChain is a layer which passes requests through a chain of other
+// layers, the same way httransform does. Chains can be replaced at any
+// time: requests in flight finish with the chain they have started
+// with.
+type layerChain struct {
+	inFlight int64
+	chains   atomic.Value
+}
+
+func (l *layerChain) OnRequest(ctx *layers.Context) error {
+	atomic.AddInt64(&l.inFlight, 1)
+
+	state := &layerChainState{
+		layers: l.chains.Load().(*layerChains).get(ctx),
+	}
+	ctx.Set(layerChainContextType, state)
+
+	var err error
+
+	for ; err == nil && state.passed < len(state.layers); state.passed++ {
+		err = state.layers[state.passed].OnRequest(ctx)
+	}
+
+	return err
+}
+
+func (l *layerChain) OnResponse(ctx *layers.Context, err error) error {
+	state := ctx.Get(layerChainContextType).(*layerChainState)
+
+	for i := state.passed - 1; i >= 0; i-- {
+		err = state.layers[i].OnResponse(ctx, err)
+	}
+
+	atomic.AddInt64(&l.inFlight, -1)
+
+	return err
+}
+
+// wait blocks until there are no requests in flight or context is
+// closed.
+func (l *layerChain) wait(ctx context.Context) error {
+	ticker := time.NewTicker(layerChainWaitInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&l.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d requests are still in flight: %w", atomic.LoadInt64(&l.inFlight), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+func (l *layerChain) swap(chains *layerChains) {
+	l.chains.Store(chains)
+}
+
+func newLayerChain(chains *layerChains) *layerChain {
+	rv := &layerChain{}
+	rv.swap(chains)
+
+	return rv
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/9seconds/httransform/v2/events"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+)
+
+var errLayerChainTest = errors.New("test error")
+
+type recordingLayer struct {
+	name   string
+	fail   bool
+	record *[]string
+}
+
+func (r *recordingLayer) OnRequest(ctx *layers.Context) error {
+	*r.record = append(*r.record, r.name+":request")
+
+	if r.fail {
+		return errLayerChainTest
+	}
+
+	return nil
+}
+
+func (r *recordingLayer) OnResponse(ctx *layers.Context, err error) error {
+	*r.record = append(*r.record, r.name+":response")
+
+	return err
+}
+
+type LayerChainTestSuite struct {
+	suite.Suite
+
+	record []string
+	ctx    *layers.Context
+}
+
+func (suite *LayerChainTestSuite) SetupTest() {
+	suite.record = nil
+	suite.ctx = layers.AcquireContext()
+}
+
+func (suite *LayerChainTestSuite) TearDownTest() {
+	layers.ReleaseContext(suite.ctx)
+}
+
+func (suite *LayerChainTestSuite) layer(name string, fail bool) layers.Layer {
+	return &recordingLayer{name: name, fail: fail, record: &suite.record}
+}
+
+func (suite *LayerChainTestSuite) chain(chain ...layers.Layer) *layerChain {
+	return newLayerChain(&layerChains{fallback: chain})
+}
+
+func (suite *LayerChainTestSuite) TestOrder() {
+	chain := suite.chain(suite.layer("1", false), suite.layer("2", false))
+
+	suite.NoError(chain.OnRequest(suite.ctx))
+	suite.NoError(chain.OnResponse(suite.ctx, nil))
+
+	suite.Equal([]string{"1:request", "2:request", "2:response", "1:response"}, suite.record)
+}
+
+func (suite *LayerChainTestSuite) TestError() {
+	chain := suite.chain(
+		suite.layer("1", false),
+		suite.layer("2", true),
+		suite.layer("3", false),
+	)
+
+	err := chain.OnRequest(suite.ctx)
+	suite.Equal(errLayerChainTest, err)
+	suite.Equal(errLayerChainTest, chain.OnResponse(suite.ctx, err))
+
+	suite.Equal([]string{"1:request", "2:request", "2:response", "1:response"}, suite.record)
+}
+
+func (suite *LayerChainTestSuite) TestWait() {
+	chain := suite.chain(suite.layer("1", false))
+
+	suite.NoError(chain.wait(context.Background()))
+	suite.NoError(chain.OnRequest(suite.ctx))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	suite.Error(chain.wait(ctx))
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- chain.wait(context.Background())
+	}()
+
+	suite.NoError(chain.OnResponse(suite.ctx, nil))
+	suite.NoError(<-done)
+}
+
+func (suite *LayerChainTestSuite) TestSwap() {
+	chain := suite.chain(suite.layer("old", false))
+
+	suite.NoError(chain.OnRequest(suite.ctx))
+	chain.swap(&layerChains{fallback: []layers.Layer{suite.layer("new", false)}})
+	suite.NoError(chain.OnResponse(suite.ctx, nil))
+
+	newCtx := layers.AcquireContext()
+	defer layers.ReleaseContext(newCtx)
+
+	suite.NoError(chain.OnRequest(newCtx))
+	suite.NoError(chain.OnResponse(newCtx, nil))
+
+	suite.Equal([]string{"old:request", "old:response", "new:request", "new:response"}, suite.record)
+}
+
+func (suite *LayerChainTestSuite) TestBindPort() {
+	chain := newLayerChain(&layerChains{
+		fallback: []layers.Layer{suite.layer("default", false)},
+		byBindPort: map[int][]layers.Layer{
+			0: {suite.layer("listener", false)},
+		},
+	})
+
+	suite.NoError(chain.OnRequest(suite.ctx))
+	suite.NoError(chain.OnResponse(suite.ctx, nil))
+
+	listenerCtx := layers.AcquireContext()
+	defer layers.ReleaseContext(listenerCtx)
+
+	fasthttpCtx := &fasthttp.RequestCtx{}
+	fasthttpCtx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}, nil)
+	suite.NoError(listenerCtx.Init(fasthttpCtx, "example.com:443", nil, "", events.RequestTypeTLS))
+
+	suite.NoError(chain.OnRequest(listenerCtx))
+	suite.NoError(chain.OnResponse(listenerCtx, nil))
+
+	suite.Equal([]string{"default:request", "default:response", "listener:request", "listener:response"}, suite.record)
+}
+
+func TestLayerChain(t *testing.T) {
+	suite.Run(t, &LayerChainTestSuite{})
+}
@@ -3,36 +3,177 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
 
 	"github.com/9seconds/httransform/v2"
 	"github.com/9seconds/httransform/v2/dialers"
 	"github.com/9seconds/httransform/v2/executor"
 	"github.com/9seconds/httransform/v2/layers"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/scrapinghub/crawlera-headless-proxy/config"
 	customs "github.com/scrapinghub/crawlera-headless-proxy/layers"
 	"github.com/scrapinghub/crawlera-headless-proxy/stats"
 )
 
-func NewProxy(conf *config.Config, statsContainer *stats.Stats, ctx *context.Context) (*httransform.Server, error) {
-	_, err := url.Parse(conf.CrawleraURL())
+// Proxy is a headless proxy server. Its layers can be rebuilt from a
+// new configuration with Reload, session managers and stats are kept.
+//
+// Settings of the server itself (bind addresses, TLS certificates,
+// upstreams and inbound authentication) are not reloadable.
+type Proxy struct {
+	*httransform.Server
+
+	ctx              context.Context
+	conf             *config.Config
+	chain            *layerChain
+	adblock          *customs.AdblockLayer
+	crawleraExecutor executor.Executor
+	inboundAuth      *customs.InboundAuthLayer
+	sessions         *customs.SessionManagers
+	statsContainer   *stats.Stats
+	stopAdblock      context.CancelFunc
+	reloadLock       sync.Mutex
+}
+
+// Reload atomically replaces layers of the proxy with those built from
+// the given configuration. If configuration is invalid, proxy keeps
+// working with the current layers.
+func (p *Proxy) Reload(conf *config.Config) error {
+	if err := conf.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	p.reloadLock.Lock()
+	defer p.reloadLock.Unlock()
+
+	if changed := notReloadable(p.conf, conf); len(changed) > 0 {
+		log.WithFields(log.Fields{
+			"settings": changed,
+		}).Warn("Some settings were changed but are applied only on start, please restart proxy")
+	}
+
+	p.chain.swap(p.makeLayers(conf))
+
+	return nil
+}
+
+// Sessions returns session managers of proxy clients.
+func (p *Proxy) Sessions() *customs.SessionManagers {
+	return p.sessions
+}
+
+// AuthenticateAPI tells if a request to API of the proxy is sent by a
+// client which has passed inbound authentication.
+func (p *Proxy) AuthenticateAPI(r *http.Request) bool {
+	return p.inboundAuth.AuthenticateAPI(r)
+}
+
+// TestAdblock reports how the current adblock lists treat the request
+// to the URL with the referer.
+func (p *Proxy) TestAdblock(url, referer string) (stats.AdblockTestResult, error) {
+	p.reloadLock.Lock()
+	adblock := p.adblock
+	p.reloadLock.Unlock()
+
+	if adblock == nil {
+		return stats.AdblockTestResult{URL: url, Reason: stats.AdblockTestDisabled}, nil
+	}
+
+	return adblock.Test(url, referer)
+}
+
+// Shutdown waits until requests in flight are finished and deletes or
+// saves sessions of clients. Proxy has to stop accepting connections
+// before. Shutdown gives up when context is closed.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if err := p.chain.wait(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Not all requests were finished")
+	}
+
+	if err := p.sessions.Shutdown(ctx); err != nil {
+		return fmt.Errorf("cannot shutdown sessions: %w", err)
+	}
+
+	return nil
+}
+
+// makeLayers builds chains of layers of all listeners. Listeners share
+// the adblock matcher, so lists are downloaded and parsed once. Refresh
+// of adblock lists of the previous layers is stopped, new layers start
+// with lists the previous ones have loaded.
+func (p *Proxy) makeLayers(conf *config.Config) *layerChains {
+	var adblock layers.Layer
+
+	if p.stopAdblock != nil {
+		p.stopAdblock()
+	}
+
+	adblockCtx, stopAdblock := context.WithCancel(p.ctx)
+	p.stopAdblock = stopAdblock
+
+	previousAdblock := p.adblock
+	p.adblock = nil
+
+	if len(conf.AdblockLists) > 0 || len(conf.AdblockRules) > 0 {
+		adblock = customs.NewAdblockLayer(adblockCtx, conf, p.statsContainer, previousAdblock)
+		p.adblock = adblock.(*customs.AdblockLayer)
+	} else {
+		p.statsContainer.SetAdblockLists(nil)
+	}
+
+	chains := &layerChains{
+		fallback:   makeProxyLayers(conf, p.crawleraExecutor, p.statsContainer, p.inboundAuth, adblock, p.sessions),
+		byBindPort: make(map[int][]layers.Layer, len(conf.Listeners)),
+	}
+
+	for _, v := range conf.Listeners {
+		chains.byBindPort[v.BindPort] = makeProxyLayers(conf.ForListener(v),
+			p.crawleraExecutor, p.statsContainer, p.inboundAuth, adblock, p.sessions)
+	}
+
+	return chains
+}
+
+func NewProxy(conf *config.Config, statsContainer *stats.Stats, ctx *context.Context) (*Proxy, error) {
+	upstreams, err := newUpstreamPool(*ctx, conf, statsContainer)
 	if err != nil {
-		return nil, fmt.Errorf("incorrect crawlera url: %w", err)
+		return nil, fmt.Errorf("upstreams error: %w", err)
 	}
 
-	dialer, err := dialers.DialerFromURL(dialers.Opts{}, conf.CrawleraURL())
+	inboundAuth, err := customs.NewInboundAuthLayer(conf)
 	if err != nil {
-		return nil, fmt.Errorf("dialer error: %w", err)
+		return nil, fmt.Errorf("inbound auth error: %w", err)
+	}
+
+	crawleraProxy := &Proxy{
+		ctx:              *ctx,
+		conf:             conf,
+		crawleraExecutor: upstreams.Execute,
+		inboundAuth:      inboundAuth,
+		sessions:         customs.NewSessionManagers(conf.StateDir, upstreams),
+		statsContainer:   statsContainer,
+	}
+	crawleraProxy.chain = newLayerChain(crawleraProxy.makeLayers(conf))
+
+	if err := crawleraProxy.sessions.Restore(conf); err != nil {
+		return nil, fmt.Errorf("cannot restore sessions: %w", err)
 	}
 
-	crawleraExecutor := executor.MakeDefaultExecutor(dialer)
+	go crawleraProxy.sessions.Run(*ctx)
 
 	opts := httransform.ServerOpts{
-		Layers:        makeProxyLayers(conf, crawleraExecutor, statsContainer),
-		Executor:      crawleraExecutor,
-		TLSCertCA:     []byte(conf.TLSCaCertificate),
-		TLSPrivateKey: []byte(conf.TLSPrivateKey),
+		Layers:                []layers.Layer{crawleraProxy.chain},
+		Executor:              crawleraProxy.crawleraExecutor,
+		Authenticator:         inboundAuth,
+		EventProcessorFactory: makeEventsProcessorFactory(statsContainer),
+		TLSCertCA:             []byte(conf.TLSCaCertificate),
+		TLSPrivateKey:         []byte(conf.TLSPrivateKey),
 	}
 
 	srv, err := httransform.NewServer(*ctx, opts)
@@ -40,35 +181,121 @@ func NewProxy(conf *config.Config, statsContainer *stats.Stats, ctx *context.Con
 		return nil, fmt.Errorf("cannot create an instance of proxy: %w", err)
 	}
 
-	return srv, nil
+	crawleraProxy.Server = srv
+
+	return crawleraProxy, nil
 }
 
-func makeProxyLayers(conf *config.Config, crawleraExecutor executor.Executor, statsContainer *stats.Stats) []layers.Layer {
+func makeProxyLayers(conf *config.Config, crawleraExecutor executor.Executor, statsContainer *stats.Stats, inboundAuth, adblock layers.Layer, sessions *customs.SessionManagers) []layers.Layer {
 	proxyLayers := []layers.Layer{
-		customs.NewBaseLayer(statsContainer),
+		inboundAuth,
+		customs.NewBaseLayer(conf, statsContainer),
+		customs.NewErrorsLayer(conf),
+	}
+
+	if len(conf.Tenants) > 0 {
+		proxyLayers = append(proxyLayers, customs.NewTenantsLayer(conf))
 	}
 
-	if len(conf.AdblockLists) > 0 {
-		proxyLayers = append(proxyLayers, customs.NewAdblockLayer(conf.AdblockLists))
+	if adblock != nil {
+		proxyLayers = append(proxyLayers, adblock)
 	}
 
 	if len(conf.DirectAccessHostPathRegexps) > 0 {
-		proxyLayers = append(proxyLayers, customs.NewDirectAccessLayer(conf.DirectAccessHostPathRegexps, conf.DirectAccessExceptHostPathRegexps))
+		directExecutor := makeInstrumentedExecutor(dialers.NewBase(dialers.Opts{}), stats.RouteDirect, statsContainer)
+		proxyLayers = append(proxyLayers, customs.NewDirectAccessLayer(conf.DirectAccessHostPathRegexps,
+			conf.DirectAccessExceptHostPathRegexps,
+			directExecutor))
+	}
+
+	if conf.AutoReferer {
+		proxyLayers = append(proxyLayers, customs.NewRefererLayer(conf.RefererTTL.Duration, conf.RefererPolicy))
 	}
 
 	proxyLayers = append(proxyLayers, customs.NewAuthLayer(conf.APIKey))
 
+	if conf.ClientConcurrentConnections > 0 {
+		proxyLayers = append(proxyLayers, customs.NewClientRateLimiterLayer(conf.ClientConcurrentConnections))
+	}
+
 	if conf.ConcurrentConnections > 0 {
 		proxyLayers = append(proxyLayers, customs.NewRateLimiterLayer(conf.ConcurrentConnections))
 	}
 
+	if len(conf.Tenants) > 0 {
+		proxyLayers = append(proxyLayers, customs.NewTenantRateLimiterLayer())
+	}
+
 	if len(conf.XHeaders) > 0 {
 		proxyLayers = append(proxyLayers, customs.NewXHeadersLayer(conf.XHeaders))
 	}
 
 	if !conf.NoAutoSessions {
-		proxyLayers = append(proxyLayers, customs.NewSessionsLayer(conf, crawleraExecutor))
+		proxyLayers = append(proxyLayers, customs.NewSessionsLayer(conf, sessions))
+	}
+
+	// Retry layer goes last: failed requests have to be retried before
+	// other layers see their responses.
+	if !conf.NoAutoSessions || len(conf.Retries) > 0 {
+		proxyLayers = append(proxyLayers, customs.NewRetryLayer(conf, crawleraExecutor))
 	}
 
 	return proxyLayers
 }
+
+// notReloadable returns names of settings which differ in configurations
+// but are applied only on start.
+func notReloadable(current, next *config.Config) []string { // nolint: funlen
+	checks := []struct {
+		name    string
+		changed bool
+	}{
+		{"bind_ip", current.BindIP != next.BindIP},
+		{"bind_port", current.BindPort != next.BindPort},
+		{"listeners", !reflect.DeepEqual(listenerAddresses(current), listenerAddresses(next))},
+		{"proxy_api_ip", current.ProxyAPIIP != next.ProxyAPIIP},
+		{"proxy_api_port", current.ProxyAPIPort != next.ProxyAPIPort},
+		{"tls_ca_certificate", current.TLSCaCertificate != next.TLSCaCertificate},
+		{"tls_private_key", current.TLSPrivateKey != next.TLSPrivateKey},
+		{"crawlera_host", current.CrawleraHost != next.CrawleraHost},
+		{"crawlera_port", current.CrawleraPort != next.CrawleraPort},
+		{"crawlera_tls", current.CrawleraTLS != next.CrawleraTLS},
+		{"crawlera_ca_bundle", current.CrawleraCABundle != next.CrawleraCABundle},
+		{"dont_verify_crawlera_cert", current.DoNotVerifyCrawleraCert != next.DoNotVerifyCrawleraCert},
+		{"upstreams", !reflect.DeepEqual(current.Upstreams, next.Upstreams)},
+		{"upstream_balancing", current.UpstreamBalancing != next.UpstreamBalancing},
+		{"upstream_max_failures", current.UpstreamMaxFailures != next.UpstreamMaxFailures},
+		{"upstream_health_check_interval", current.UpstreamHealthCheckInterval != next.UpstreamHealthCheckInterval},
+		{"upstream_health_check_target", current.UpstreamHealthCheckTarget != next.UpstreamHealthCheckTarget},
+		{"inbound_auth_htpasswd", current.InboundAuthHtpasswd != next.InboundAuthHtpasswd},
+		{"inbound_auth_tokens", !reflect.DeepEqual(current.InboundAuthTokens, next.InboundAuthTokens)},
+		{"inbound_auth_cidrs", !reflect.DeepEqual(current.InboundAuthCIDRs, next.InboundAuthCIDRs)},
+		{"proxy_api_tokens", !reflect.DeepEqual(current.ProxyAPITokens, next.ProxyAPITokens)},
+		{"proxy_api_cidrs", !reflect.DeepEqual(current.ProxyAPICIDRs, next.ProxyAPICIDRs)},
+		{"state_dir", current.StateDir != next.StateDir},
+		{"shutdown_timeout", current.ShutdownTimeout != next.ShutdownTimeout},
+	}
+
+	changed := []string{}
+
+	for _, v := range checks {
+		if v.changed {
+			changed = append(changed, v.name)
+		}
+	}
+
+	return changed
+}
+
+// listenerAddresses returns sorted bind addresses of extra listeners.
+func listenerAddresses(conf *config.Config) []string {
+	addresses := make([]string, 0, len(conf.Listeners))
+
+	for _, v := range conf.Listeners {
+		addresses = append(addresses, conf.ForListener(v).Bind())
+	}
+
+	sort.Strings(addresses)
+
+	return addresses
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type ProxyTestSuite struct {
+	suite.Suite
+
+	conf *config.Config
+}
+
+func (suite *ProxyTestSuite) SetupTest() {
+	suite.conf = config.NewConfig()
+	suite.conf.APIKey = "apikey"
+	suite.conf.Listeners = []config.Listener{
+		{Name: "mobile", BindPort: 3129},
+	}
+}
+
+func (suite *ProxyTestSuite) TestNotReloadable() {
+	next := *suite.conf
+	next.APIKey = "newkey"
+	next.SessionsPerClient = 3
+	next.Listeners = []config.Listener{
+		{Name: "mobile", BindPort: 3129, SessionsPerClient: 2},
+	}
+
+	suite.Empty(notReloadable(suite.conf, &next))
+
+	next.BindPort = 3127
+	next.Listeners = append(next.Listeners, config.Listener{Name: "desktop", BindPort: 3131})
+	next.InboundAuthTokens = []string{"token"}
+	next.Upstreams = []config.Upstream{{Host: "eu.proxy.zyte.com", Port: 8014}}
+
+	suite.Equal([]string{"bind_port", "listeners", "upstreams", "inbound_auth_tokens"},
+		notReloadable(suite.conf, &next))
+}
+
+func TestProxy(t *testing.T) {
+	suite.Run(t, &ProxyTestSuite{})
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/9seconds/httransform/v2/errors"
+	"github.com/9seconds/httransform/v2/executor"
+	"github.com/9seconds/httransform/v2/layers"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+const upstreamBadStatusCode = 500
+
+type upstream struct {
+	address           string
+	dialer            *crawleraDialer
+	executor          executor.Executor
+	apiTransport      *http.Transport
+	activeConnections int64
+	failures          uint32
+	unhealthy         uint32
+}
+
+func (u *upstream) isHealthy() bool {
+	return atomic.LoadUint32(&u.unhealthy) == 0
+}
+
+// upstreamPool spreads requests over several Crawlera endpoints. If
+// upstream has failed consecutively for maxFailures times, it is marked
+// as unhealthy and is not used until background health check succeeds.
+// Healthy upstreams are not checked: requests prove they work.
+//
+// Requests which cannot reach upstream are retried with the next one.
+// Requests rejected by upstream are not: other upstreams most likely
+// reject them too (for example, if API key is incorrect).
+type upstreamPool struct {
+	upstreams         []*upstream
+	balancing         string
+	healthCheckTarget string
+	maxFailures       uint32
+	counter           uint32
+	metrics           *stats.Stats
+}
+
+func (p *upstreamPool) Execute(ctx *layers.Context) error {
+	tried := make([]bool, len(p.upstreams))
+
+	var err error
+
+	for range p.upstreams {
+		idx := p.pick(tried)
+		current := p.upstreams[idx]
+		tried[idx] = true
+
+		p.metrics.NewUpstreamConnection(current.address)
+		atomic.AddInt64(&current.activeConnections, 1)
+
+		err = current.executor(ctx)
+
+		atomic.AddInt64(&current.activeConnections, -1)
+		p.metrics.DropUpstreamConnection(current.address)
+
+		switch {
+		case isUpstreamDialError(err):
+			p.reportFailure(current, err)
+			continue
+		case isUpstreamConnectError(err):
+			p.reportFailure(current, err)
+		case err == nil && isUpstreamResponseError(ctx):
+			p.reportFailure(current, nil)
+		case err == nil:
+			p.reportSuccess(current)
+		}
+
+		return err
+	}
+
+	return err
+}
+
+// RoundTrip sends a request to Crawlera API (for example, to delete a
+// session) through one of upstreams, so it goes to the same endpoint
+// with the same TLS settings as proxied requests. It conforms
+// http.RoundTripper interface.
+func (p *upstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	current := p.upstreams[p.pick(make([]bool, len(p.upstreams)))]
+
+	return current.apiTransport.RoundTrip(req)
+}
+
+func (p *upstreamPool) pick(tried []bool) int {
+	start := int(atomic.AddUint32(&p.counter, 1))
+	chosen := -1
+
+	for _, onlyHealthy := range [2]bool{true, false} {
+		for i := range p.upstreams {
+			idx := (start + i) % len(p.upstreams)
+			current := p.upstreams[idx]
+
+			if tried[idx] || (onlyHealthy && !current.isHealthy()) {
+				continue
+			}
+
+			if p.balancing != config.UpstreamBalancingLeastConnections {
+				return idx
+			}
+
+			if chosen < 0 || atomic.LoadInt64(&current.activeConnections) < atomic.LoadInt64(&p.upstreams[chosen].activeConnections) {
+				chosen = idx
+			}
+		}
+
+		if chosen >= 0 {
+			return chosen
+		}
+	}
+
+	return start % len(p.upstreams)
+}
+
+func (p *upstreamPool) reportSuccess(current *upstream) {
+	atomic.StoreUint32(&current.failures, 0)
+
+	if atomic.CompareAndSwapUint32(&current.unhealthy, 1, 0) {
+		p.metrics.SetUpstreamHealth(current.address, true)
+		log.WithFields(log.Fields{
+			"upstream": current.address,
+		}).Info("Upstream is healthy again")
+	}
+}
+
+func (p *upstreamPool) reportFailure(current *upstream, err error) {
+	p.metrics.NewUpstreamFailure(current.address)
+
+	failures := atomic.AddUint32(&current.failures, 1)
+	logger := log.WithFields(log.Fields{
+		"upstream": current.address,
+		"failures": failures,
+		"error":    err,
+	})
+
+	logger.Debug("Upstream has failed")
+
+	if failures >= p.maxFailures && atomic.CompareAndSwapUint32(&current.unhealthy, 0, 1) {
+		p.metrics.SetUpstreamHealth(current.address, false)
+		logger.Warn("Upstream is marked as unhealthy")
+	}
+}
+
+func (p *upstreamPool) runHealthChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.checkUnhealthy(ctx)
+		}
+	}
+}
+
+func (p *upstreamPool) checkUnhealthy(ctx context.Context) {
+	for _, v := range p.upstreams {
+		if !v.isHealthy() {
+			p.checkHealth(ctx, v)
+		}
+	}
+}
+
+// checkHealth connects to upstream and, if health check target is set,
+// establishes a tunnel to it. Upstream is healthy if it is reachable
+// and does not reject CONNECT requests because of its own failure.
+func (p *upstreamPool) checkHealth(ctx context.Context, current *upstream) {
+	err := current.dialer.checkHealth(ctx, p.healthCheckTarget)
+	if isUpstreamDialError(err) || isUpstreamConnectError(err) {
+		p.reportFailure(current, err)
+		return
+	}
+
+	p.reportSuccess(current)
+}
+
+// isUpstreamDialError tells if upstream is unreachable: it is not
+// possible to connect to it, to perform TLS handshake or to send
+// CONNECT request.
+func isUpstreamDialError(err error) bool {
+	var customErr *errors.Error
+
+	return errors.As(err, &customErr) && customErr.GetChainCode() == "crawlera_dial"
+}
+
+// isUpstreamConnectError tells if upstream has rejected CONNECT request
+// because of its own failure (with 5xx status code). Other rejections
+// are caused by the request itself.
+func isUpstreamConnectError(err error) bool {
+	var connectErr *crawleraConnectError
+
+	return errors.As(err, &connectErr) && connectErr.statusCode >= upstreamBadStatusCode
+}
+
+func isUpstreamResponseError(ctx *layers.Context) bool {
+	response := ctx.Response()
+
+	return response.StatusCode() >= upstreamBadStatusCode && len(response.Header.Peek("X-Crawlera-Error")) > 0
+}
+
+func newUpstreamPool(ctx context.Context, conf *config.Config, statsContainer *stats.Stats) (*upstreamPool, error) {
+	certPool, err := makeCrawleraCertPool(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamsConf := conf.CrawleraUpstreams()
+	pool := &upstreamPool{
+		upstreams:         make([]*upstream, 0, len(upstreamsConf)),
+		balancing:         conf.UpstreamBalancing,
+		healthCheckTarget: conf.UpstreamHealthCheckTarget,
+		maxFailures:       uint32(conf.UpstreamMaxFailures),
+		metrics:           statsContainer,
+	}
+
+	for _, v := range upstreamsConf {
+		dialer, err := newCrawleraDialer(conf, v, certPool)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create dialer for %s: %w", v.Address(), err)
+		}
+
+		pool.upstreams = append(pool.upstreams, &upstream{
+			address:  v.Address(),
+			dialer:   dialer,
+			executor: makeInstrumentedExecutor(dialer, stats.RouteProxied, statsContainer),
+			apiTransport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.Dial(ctx, "", "")
+				},
+			},
+		})
+		statsContainer.SetUpstreamHealth(v.Address(), true)
+	}
+
+	if conf.UpstreamHealthCheckInterval.Duration > 0 {
+		go pool.runHealthChecks(ctx, conf.UpstreamHealthCheckInterval.Duration)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,252 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/9seconds/httransform/v2/events"
+	"github.com/9seconds/httransform/v2/layers"
+	"github.com/stretchr/testify/suite"
+	"github.com/valyala/fasthttp"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+	"github.com/scrapinghub/crawlera-headless-proxy/stats"
+)
+
+type noopEventStream struct{}
+
+type upstreamTestStats struct {
+	Requests uint64 `json:"requests"`
+	Failures uint64 `json:"failures"`
+	Healthy  bool   `json:"healthy"`
+}
+
+func (n noopEventStream) Send(_ context.Context, _ events.EventType, _ interface{}, _ string) {}
+
+type UpstreamPoolTestSuite struct {
+	suite.Suite
+
+	alive         *httptest.Server
+	rejecting     *httptest.Server
+	connectStatus int32
+	dead          config.Upstream
+	metrics       *stats.Stats
+	conf          *config.Config
+	ctx           context.Context
+	cancel        context.CancelFunc
+}
+
+func (suite *UpstreamPoolTestSuite) SetupSuite() {
+	suite.alive = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("alive")) // nolint: errcheck
+	}))
+
+	suite.rejecting = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&suite.connectStatus)))
+	}))
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln.Close()
+
+	suite.dead = suite.makeUpstream("http://" + ln.Addr().String())
+}
+
+func (suite *UpstreamPoolTestSuite) TearDownSuite() {
+	suite.alive.Close()
+	suite.rejecting.Close()
+}
+
+func (suite *UpstreamPoolTestSuite) SetupTest() {
+	suite.ctx, suite.cancel = context.WithCancel(context.Background())
+	suite.metrics = stats.NewStats()
+	suite.conf = config.NewConfig()
+	suite.conf.APIKey = "apikey"
+	suite.conf.UpstreamMaxFailures = 1
+	suite.conf.UpstreamHealthCheckInterval = config.Duration{}
+	suite.conf.Upstreams = []config.Upstream{
+		suite.dead,
+		suite.makeUpstream(suite.alive.URL),
+	}
+}
+
+func (suite *UpstreamPoolTestSuite) TearDownTest() {
+	suite.cancel()
+}
+
+func (suite *UpstreamPoolTestSuite) makeUpstream(rawURL string) config.Upstream {
+	parsed, _ := url.Parse(rawURL)
+	port, _ := strconv.Atoi(parsed.Port())
+
+	return config.Upstream{
+		Host: parsed.Hostname(),
+		Port: port,
+	}
+}
+
+// makeContext returns a context of the request to example.com. Contexts
+// are not released: httransform reads them from a goroutine which can
+// outlive a round trip, so they are not safe to reuse.
+func (suite *UpstreamPoolTestSuite) makeContext(requestType events.RequestType) *layers.Context {
+	fhttpCtx := &fasthttp.RequestCtx{}
+	fhttpCtx.Init(&fasthttp.Request{}, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 65342}, nil)
+	fhttpCtx.Request.SetRequestURI("http://example.com/")
+
+	ctx := layers.AcquireContext()
+	ctx.Init(fhttpCtx, "example.com:80", noopEventStream{}, "", requestType) // nolint: errcheck
+
+	return ctx
+}
+
+func (suite *UpstreamPoolTestSuite) getUpstreamsStats() map[string]upstreamTestStats {
+	marshalled, err := json.Marshal(suite.metrics.Upstreams)
+	suite.NoError(err)
+
+	upstreamsStats := map[string]upstreamTestStats{}
+	suite.NoError(json.Unmarshal(marshalled, &upstreamsStats))
+
+	return upstreamsStats
+}
+
+func (suite *UpstreamPoolTestSuite) TestFailover() {
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	for i := 0; i < 4; i++ {
+		ctx := suite.makeContext(0)
+
+		suite.NoError(pool.Execute(ctx))
+		suite.Equal("alive", string(ctx.Response().Body()))
+	}
+
+	suite.False(pool.upstreams[0].isHealthy())
+	suite.True(pool.upstreams[1].isHealthy())
+
+	upstreamsStats := suite.getUpstreamsStats()
+
+	suite.EqualValues(1, upstreamsStats[suite.dead.Address()].Failures)
+	suite.False(upstreamsStats[suite.dead.Address()].Healthy)
+	suite.EqualValues(4, upstreamsStats[suite.conf.Upstreams[1].Address()].Requests)
+}
+
+func (suite *UpstreamPoolTestSuite) TestRejectedConnect() {
+	suite.conf.Upstreams[0] = suite.makeUpstream(suite.alive.URL)
+	suite.conf.Upstreams[1] = suite.makeUpstream(suite.rejecting.URL)
+	atomic.StoreInt32(&suite.connectStatus, http.StatusProxyAuthRequired)
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	err = pool.Execute(suite.makeContext(events.RequestTypeTLS))
+	suite.Error(err)
+	suite.False(isUpstreamDialError(err))
+
+	suite.True(pool.upstreams[1].isHealthy())
+
+	upstreamsStats := suite.getUpstreamsStats()
+	suite.EqualValues(0, upstreamsStats[suite.conf.Upstreams[1].Address()].Failures)
+	suite.EqualValues(0, upstreamsStats[suite.conf.Upstreams[0].Address()].Requests)
+}
+
+func (suite *UpstreamPoolTestSuite) TestFailedConnect() {
+	suite.conf.Upstreams[0] = suite.makeUpstream(suite.alive.URL)
+	suite.conf.Upstreams[1] = suite.makeUpstream(suite.rejecting.URL)
+	atomic.StoreInt32(&suite.connectStatus, http.StatusServiceUnavailable)
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	suite.Error(pool.Execute(suite.makeContext(events.RequestTypeTLS)))
+	suite.False(pool.upstreams[1].isHealthy())
+
+	upstreamsStats := suite.getUpstreamsStats()
+	suite.EqualValues(1, upstreamsStats[suite.conf.Upstreams[1].Address()].Failures)
+	suite.EqualValues(0, upstreamsStats[suite.conf.Upstreams[0].Address()].Requests)
+}
+
+func (suite *UpstreamPoolTestSuite) TestHealthCheck() {
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	pool.checkHealth(suite.ctx, pool.upstreams[0])
+	pool.checkHealth(suite.ctx, pool.upstreams[1])
+
+	suite.False(pool.upstreams[0].isHealthy())
+	suite.True(pool.upstreams[1].isHealthy())
+}
+
+func (suite *UpstreamPoolTestSuite) TestHealthCheckConnect() {
+	suite.conf.Upstreams = []config.Upstream{suite.makeUpstream(suite.rejecting.URL)}
+	suite.conf.UpstreamHealthCheckTarget = "example.com:443"
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	atomic.StoreInt32(&suite.connectStatus, http.StatusServiceUnavailable)
+	pool.checkHealth(suite.ctx, pool.upstreams[0])
+	suite.False(pool.upstreams[0].isHealthy())
+
+	atomic.StoreInt32(&suite.connectStatus, http.StatusProxyAuthRequired)
+	pool.checkHealth(suite.ctx, pool.upstreams[0])
+	suite.True(pool.upstreams[0].isHealthy())
+}
+
+func (suite *UpstreamPoolTestSuite) TestHealthCheckWithoutTarget() {
+	suite.conf.Upstreams = []config.Upstream{suite.makeUpstream(suite.rejecting.URL)}
+	atomic.StoreInt32(&suite.connectStatus, http.StatusServiceUnavailable)
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	pool.reportFailure(pool.upstreams[0], nil)
+	pool.checkHealth(suite.ctx, pool.upstreams[0])
+	suite.True(pool.upstreams[0].isHealthy())
+}
+
+func (suite *UpstreamPoolTestSuite) TestHealthCheckOnlyUnhealthy() {
+	suite.conf.Upstreams = []config.Upstream{
+		suite.makeUpstream(suite.rejecting.URL),
+		suite.makeUpstream(suite.rejecting.URL),
+	}
+	suite.conf.UpstreamHealthCheckTarget = "example.com:443"
+	atomic.StoreInt32(&suite.connectStatus, http.StatusServiceUnavailable)
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	// A check of the healthy upstream would make it unhealthy: it gets
+	// 503 for CONNECT requests and fails once at most.
+	pool.reportFailure(pool.upstreams[1], nil)
+	pool.checkUnhealthy(suite.ctx)
+
+	suite.True(pool.upstreams[0].isHealthy())
+	suite.False(pool.upstreams[1].isHealthy())
+
+	atomic.StoreInt32(&suite.connectStatus, http.StatusProxyAuthRequired)
+	pool.checkUnhealthy(suite.ctx)
+	suite.True(pool.upstreams[1].isHealthy())
+}
+
+func (suite *UpstreamPoolTestSuite) TestLeastConnections() {
+	suite.conf.UpstreamBalancing = config.UpstreamBalancingLeastConnections
+	suite.conf.Upstreams[0] = suite.conf.Upstreams[1]
+
+	pool, err := newUpstreamPool(suite.ctx, suite.conf, suite.metrics)
+	suite.NoError(err)
+
+	pool.upstreams[0].activeConnections = 10
+
+	for i := 0; i < 3; i++ {
+		suite.Equal(1, pool.pick(make([]bool, 2)))
+	}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	suite.Run(t, &UpstreamPoolTestSuite{})
+}
@@ -11,7 +11,7 @@ import (
 )
 
 type data struct {
-	Time, CA, Key string
+	Time, CA, Key, CrawleraCA string
 }
 
 var fileTemplate = `package main
@@ -26,30 +26,33 @@ var DefaultCertCA = []byte(` + "`{{ .CA }}`" + `)
 // DefaultPrivateKey is hardcoded TLS private key
 // nolint: gochecknoglobals
 var DefaultPrivateKey = []byte(` + "`{{ .Key }}`" + `)
+
+// DefaultCrawleraCA is hardcoded CA certificate of Crawlera TLS
+// certificates
+// nolint: gochecknoglobals
+var DefaultCrawleraCA = []byte(` + "`{{ .CrawleraCA }}`" + `)
 `
 
-func main() {
-	caCertFile, err := filepath.Abs(os.Args[1])
+func readFile(name string) []byte {
+	path, err := filepath.Abs(name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	caCert, err := ioutil.ReadFile(caCertFile)
+	content, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	caKeyFile, err := filepath.Abs(os.Args[2])
-	if err != nil {
-		log.Fatal(err)
-	}
+	return bytes.TrimSpace(content)
+}
 
-	caKey, err := ioutil.ReadFile(caKeyFile)
-	if err != nil {
-		log.Fatal(err)
-	}
+func main() {
+	caCert := readFile(os.Args[1])
+	caKey := readFile(os.Args[2])
+	crawleraCA := readFile(os.Args[3])
 
-	outputFile, err := filepath.Abs(os.Args[3])
+	outputFile, err := filepath.Abs(os.Args[4])
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -62,8 +65,9 @@ func main() {
 
 	tpl := template.Must(template.New("tpl").Parse(fileTemplate))
 	tpl.Execute(fp, data{ // nolint: errcheck
-		Time: time.Now().Format(time.RFC1123Z),
-		CA:   string(bytes.TrimSpace(caCert)),
-		Key:  string(bytes.TrimSpace(caKey)),
+		Time:       time.Now().Format(time.RFC1123Z),
+		CA:         string(caCert),
+		Key:        string(caKey),
+		CrawleraCA: string(crawleraCA),
 	})
 }
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of adblock lists. A list is loading until the first attempt to
+// load it is finished. Stale lists have failed to refresh and use the
+// previous or cached version, failed lists have no rules at all.
+const (
+	AdblockListLoading = "loading"
+	AdblockListLoaded  = "loaded"
+	AdblockListStale   = "stale"
+	AdblockListFailed  = "failed"
+)
+
+// Results of adblock test. A request is not blocked by exception rule
+// if some rule matches it, but an exception rule allows it.
+const (
+	AdblockTestBlocked     = "blocked"
+	AdblockTestAllowlisted = "allowlisted"
+	AdblockTestException   = "exception"
+	AdblockTestNotMatched  = "not_matched"
+	AdblockTestNotLoaded   = "not_loaded"
+	AdblockTestDisabled    = "disabled"
+)
+
+// AdblockTestResult describes how adblock lists treat the request to
+// the URL. Rule and List are set if some rule has matched the request,
+// Exception is set to exception rule which has allowed it and Allowlist
+// is set to allowlist entry matching it. Response tells how headless
+// proxy responds to the blocked request.
+type AdblockTestResult struct {
+	URL          string `json:"url"`
+	ResourceType string `json:"resource_type,omitempty"`
+	Blocked      bool   `json:"blocked"`
+	Reason       string `json:"reason"`
+	Rule         string `json:"rule,omitempty"`
+	List         string `json:"list,omitempty"`
+	Exception    string `json:"exception,omitempty"`
+	Response     string `json:"response,omitempty"`
+	Allowlist    string `json:"allowlist,omitempty"`
+}
+
+// AdblockTester checks requests against adblock lists of the proxy.
+// It returns an error if URL is incorrect.
+type AdblockTester interface {
+	TestAdblock(url, referer string) (AdblockTestResult, error)
+}
+
+type adblockListStats struct {
+	State     string    `json:"state"`
+	Rules     int       `json:"rules"`
+	Errors    uint64    `json:"errors"`
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type adblockStatsSnapshot struct {
+	Rules              int                         `json:"rules"`
+	UnfilteredRequests uint64                      `json:"unfiltered_requests"`
+	Lists              map[string]adblockListStats `json:"lists"`
+}
+
+// adblockStats keeps load state of adblock lists and a number of
+// requests which were passed unfiltered because lists were not loaded
+// in time.
+type adblockStats struct {
+	unfilteredRequests uint64
+	lists              map[string]*adblockListStats
+	lock               *sync.Mutex
+}
+
+func (a *adblockStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.snapshot())
+}
+
+func (a *adblockStats) snapshot() adblockStatsSnapshot {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	value := adblockStatsSnapshot{
+		UnfilteredRequests: atomic.LoadUint64(&a.unfilteredRequests),
+		Lists:              make(map[string]adblockListStats, len(a.lists)),
+	}
+
+	for k, v := range a.lists {
+		value.Lists[k] = *v
+		value.Rules += v.Rules
+	}
+
+	return value
+}
+
+// reset sets lists to report. Lists which were reported before keep
+// their state, new ones are loading.
+func (a *adblockStats) reset(lists []string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	current := a.lists
+	a.lists = make(map[string]*adblockListStats, len(lists))
+
+	for _, v := range lists {
+		if value, ok := current[v]; ok {
+			a.lists[v] = value
+		} else {
+			a.lists[v] = &adblockListStats{State: AdblockListLoading}
+		}
+	}
+}
+
+func (a *adblockStats) set(list, state string, rules int, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	value, ok := a.lists[list]
+	if !ok {
+		return
+	}
+
+	value.State = state
+	value.Rules = rules
+	value.UpdatedAt = time.Now()
+
+	if err != nil {
+		value.Errors++
+		value.LastError = err.Error()
+	}
+}
+
+func newAdblockStats() *adblockStats {
+	return &adblockStats{
+		lists: map[string]*adblockListStats{},
+		lock:  &sync.Mutex{},
+	}
+}
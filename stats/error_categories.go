@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+// Categories of Crawlera errors. Values of X-Crawlera-Error header are
+// normalized into these categories so clients can tell a ban from a
+// timeout without knowing all the errors of Crawlera.
+const (
+	ErrorCategoryBanned     = "banned"
+	ErrorCategorySession    = "session"
+	ErrorCategoryAuth       = "auth"
+	ErrorCategoryRateLimit  = "rate_limit"
+	ErrorCategoryTimeout    = "timeout"
+	ErrorCategoryTarget     = "target"
+	ErrorCategoryBadRequest = "bad_request"
+	ErrorCategoryOther      = "other"
+)
+
+// errorCategoriesStats keeps a number of Crawlera errors per category.
+// A set of categories is fixed so no locking is required.
+type errorCategoriesStats struct {
+	data map[string]*uint64
+}
+
+func (e *errorCategoriesStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.snapshot())
+}
+
+func (e *errorCategoriesStats) snapshot() map[string]uint64 {
+	values := make(map[string]uint64, len(e.data))
+
+	for k, v := range e.data {
+		values[k] = atomic.LoadUint64(v)
+	}
+
+	return values
+}
+
+func (e *errorCategoriesStats) newError(category string) {
+	value, ok := e.data[category]
+	if !ok {
+		value = e.data[ErrorCategoryOther]
+	}
+
+	atomic.AddUint64(value, 1)
+}
+
+func newErrorCategoriesStats() *errorCategoriesStats {
+	stats := &errorCategoriesStats{
+		data: map[string]*uint64{},
+	}
+
+	for _, v := range []string{
+		ErrorCategoryBanned,
+		ErrorCategorySession,
+		ErrorCategoryAuth,
+		ErrorCategoryRateLimit,
+		ErrorCategoryTimeout,
+		ErrorCategoryTarget,
+		ErrorCategoryBadRequest,
+		ErrorCategoryOther,
+	} {
+		stats.data[v] = new(uint64)
+	}
+
+	return stats
+}
@@ -0,0 +1,131 @@
+package stats
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	hostsStatsTopLength = 10
+	hostsStatsLimit     = 10000
+
+	// hostsStatsOther is a name of the host which aggregates stats of
+	// all hosts seen after the limit was reached.
+	hostsStatsOther = "<other>"
+)
+
+type hostStats struct {
+	Host          string `json:"host"`
+	Requests      uint64 `json:"requests"`
+	Errors        uint64 `json:"errors"`
+	BytesReceived uint64 `json:"bytes_received"`
+	BytesSent     uint64 `json:"bytes_sent"`
+}
+
+type hostsStatsJSON struct {
+	ByRequests []hostStats `json:"by_requests"`
+	ByBytes    []hostStats `json:"by_bytes"`
+	ByErrors   []hostStats `json:"by_errors"`
+}
+
+// hostsStats keeps stats per target host. To limit memory usage, only
+// first hostsStatsLimit hosts are tracked separately, the rest are
+// aggregated into a single entry.
+type hostsStats struct {
+	data map[string]*hostStats
+	lock *sync.RWMutex
+}
+
+func (h *hostsStats) MarshalJSON() ([]byte, error) {
+	values := h.snapshot()
+	marshalled := hostsStatsJSON{
+		ByRequests: h.top(values, func(v hostStats) uint64 { return v.Requests }),
+		ByBytes:    h.top(values, func(v hostStats) uint64 { return v.BytesReceived + v.BytesSent }),
+		ByErrors:   h.top(values, func(v hostStats) uint64 { return v.Errors }),
+	}
+
+	return json.Marshal(marshalled)
+}
+
+func (h *hostsStats) snapshot() []hostStats {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	values := make([]hostStats, 0, len(h.data))
+
+	for k, v := range h.data {
+		values = append(values, hostStats{
+			Host:          k,
+			Requests:      atomic.LoadUint64(&v.Requests),
+			Errors:        atomic.LoadUint64(&v.Errors),
+			BytesReceived: atomic.LoadUint64(&v.BytesReceived),
+			BytesSent:     atomic.LoadUint64(&v.BytesSent),
+		})
+	}
+
+	return values
+}
+
+func (h *hostsStats) top(values []hostStats, key func(hostStats) uint64) []hostStats {
+	sorted := make([]hostStats, 0, len(values))
+
+	for _, v := range values {
+		if key(v) > 0 {
+			sorted = append(sorted, v)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		left, right := key(sorted[i]), key(sorted[j])
+		if left == right {
+			return sorted[i].Host < sorted[j].Host
+		}
+
+		return left > right
+	})
+
+	if len(sorted) > hostsStatsTopLength {
+		sorted = sorted[:hostsStatsTopLength]
+	}
+
+	return sorted
+}
+
+func (h *hostsStats) get(host string) *hostStats {
+	h.lock.RLock()
+	value, ok := h.data[host]
+	h.lock.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if value, ok = h.data[host]; ok {
+		return value
+	}
+
+	if len(h.data) >= hostsStatsLimit {
+		host = hostsStatsOther
+
+		if value, ok = h.data[host]; ok {
+			return value
+		}
+	}
+
+	value = &hostStats{}
+	h.data[host] = value
+
+	return value
+}
+
+func newHostsStats() *hostsStats {
+	return &hostsStats{
+		data: map[string]*hostStats{},
+		lock: &sync.RWMutex{},
+	}
+}
@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HostsStatsTestSuite struct {
+	suite.Suite
+
+	hosts *hostsStats
+}
+
+func (suite *HostsStatsTestSuite) SetupTest() {
+	suite.hosts = newHostsStats()
+}
+
+func (suite *HostsStatsTestSuite) TestTop() {
+	for i := 0; i < hostsStatsTopLength*2; i++ {
+		suite.hosts.get("host" + strconv.Itoa(i)).Requests = uint64(i)
+	}
+
+	top := suite.hosts.top(suite.hosts.snapshot(), func(v hostStats) uint64 { return v.Requests })
+
+	suite.Len(top, hostsStatsTopLength)
+	suite.Equal("host19", top[0].Host)
+	suite.Equal("host10", top[hostsStatsTopLength-1].Host)
+}
+
+func (suite *HostsStatsTestSuite) TestSkipZeroes() {
+	suite.hosts.get("host").Requests = 1
+
+	suite.Empty(suite.hosts.top(suite.hosts.snapshot(), func(v hostStats) uint64 { return v.Errors }))
+}
+
+func (suite *HostsStatsTestSuite) TestLimit() {
+	for i := 0; i < hostsStatsLimit; i++ {
+		suite.hosts.get("host" + strconv.Itoa(i))
+	}
+
+	suite.Equal(suite.hosts.get("new1"), suite.hosts.get("new2"))
+	suite.Len(suite.hosts.data, hostsStatsLimit+1)
+	suite.Contains(suite.hosts.data, hostsStatsOther)
+}
+
+func TestHostsStats(t *testing.T) {
+	suite.Run(t, &HostsStatsTestSuite{})
+}
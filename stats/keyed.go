@@ -0,0 +1,49 @@
+package stats
+
+import "sync"
+
+// keyedStats keeps stats values by key. Values are created by newValue
+// on the first use of their key and are never removed.
+type keyedStats struct {
+	data     map[string]interface{}
+	lock     *sync.RWMutex
+	newValue func() interface{}
+}
+
+func (k *keyedStats) get(key string) interface{} {
+	k.lock.RLock()
+	value, ok := k.data[key]
+	k.lock.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if value, ok = k.data[key]; !ok {
+		value = k.newValue()
+		k.data[key] = value
+	}
+
+	return value
+}
+
+// each calls fn for all values under read lock.
+func (k *keyedStats) each(fn func(key string, value interface{})) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	for key, value := range k.data {
+		fn(key, value)
+	}
+}
+
+func newKeyedStats(newValue func() interface{}) *keyedStats {
+	return &keyedStats{
+		data:     map[string]interface{}{},
+		lock:     &sync.RWMutex{},
+		newValue: newValue,
+	}
+}
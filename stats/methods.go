@@ -0,0 +1,59 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+type methodStats struct {
+	InFlight uint64 `json:"in_flight"`
+	Total    uint64 `json:"total"`
+}
+
+// methodsStats keeps a number of in-flight and all requests per HTTP
+// method. A set of methods is fixed so no locking is required.
+type methodsStats struct {
+	data map[string]*methodStats
+}
+
+func (m *methodsStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.snapshot())
+}
+
+func (m *methodsStats) snapshot() map[string]methodStats {
+	values := make(map[string]methodStats, len(m.data))
+
+	for k, v := range m.data {
+		values[k] = methodStats{
+			InFlight: atomic.LoadUint64(&v.InFlight),
+			Total:    atomic.LoadUint64(&v.Total),
+		}
+	}
+
+	return values
+}
+
+func (m *methodsStats) newRequest(method string) {
+	value := m.data[method]
+
+	atomic.AddUint64(&value.InFlight, 1)
+	atomic.AddUint64(&value.Total, 1)
+}
+
+func (m *methodsStats) dropRequest(method string) {
+	atomic.AddUint64(&m.data[method].InFlight, atomicDecrement)
+}
+
+func newMethodsStats() *methodsStats {
+	stats := &methodsStats{
+		data: map[string]*methodStats{
+			methodOther: {},
+		},
+	}
+
+	for method := range prometheusMethods {
+		stats.data[method] = &methodStats{}
+	}
+
+	return stats
+}
@@ -0,0 +1,491 @@
+package stats
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Routes of the requests. Proxied requests are sent to Crawlera, direct
+// requests are sent to the target bypassing Crawlera and adblocked ones
+// are not sent anywhere.
+const (
+	RouteProxied   = "proxied"
+	RouteDirect    = "direct"
+	RouteAdblocked = "adblocked"
+)
+
+const (
+	prometheusNamespace = "crawlera_headless_"
+
+	phaseDial = "dial"
+	phaseTLS  = "tls"
+	phaseTTFB = "ttfb"
+
+	methodOther = "OTHER"
+)
+
+// nolint: gochecknoglobals
+var (
+	prometheusBuckets = [...]float64{
+		0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+	}
+
+	prometheusRoutes = [...]string{RouteProxied, RouteDirect}
+	prometheusPhases = [...]string{phaseDial, phaseTLS, phaseTTFB}
+
+	prometheusMethods = map[string]bool{
+		"GET":     true,
+		"HEAD":    true,
+		"POST":    true,
+		"PUT":     true,
+		"DELETE":  true,
+		"CONNECT": true,
+		"OPTIONS": true,
+		"TRACE":   true,
+		"PATCH":   true,
+	}
+
+	prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// histogram is a cumulative histogram of durations in Prometheus
+// sense. Buckets are not cumulative here, they are summed up on
+// rendering.
+type histogram struct {
+	buckets []uint64
+	count   uint64
+	sum     uint64
+}
+
+func (h *histogram) add(elapsed time.Duration) {
+	idx := sort.SearchFloat64s(prometheusBuckets[:], elapsed.Seconds())
+
+	atomic.AddUint64(&h.buckets[idx], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(elapsed))
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		buckets: make([]uint64, len(prometheusBuckets)+1),
+	}
+}
+
+type phaseLabels struct {
+	route string
+	phase string
+}
+
+// newPhaseHistograms creates histograms for all phases of all routes
+// beforehand so they can be accessed without locking.
+func newPhaseHistograms() map[phaseLabels]*histogram {
+	histograms := map[phaseLabels]*histogram{}
+
+	for _, route := range prometheusRoutes {
+		for _, phase := range prometheusPhases {
+			histograms[phaseLabels{route: route, phase: phase}] = newHistogram()
+		}
+	}
+
+	return histograms
+}
+
+type responseLabels struct {
+	route         string
+	method        string
+	status        string
+	crawleraError string
+}
+
+type responsesStats struct {
+	data map[responseLabels]*uint64
+	lock *sync.RWMutex
+}
+
+func (r *responsesStats) get(labels responseLabels) *uint64 {
+	r.lock.RLock()
+	value, ok := r.data[labels]
+	r.lock.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if value, ok = r.data[labels]; !ok {
+		value = new(uint64)
+		r.data[labels] = value
+	}
+
+	return value
+}
+
+func (r *responsesStats) snapshot() map[responseLabels]uint64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	values := make(map[responseLabels]uint64, len(r.data))
+
+	for k, v := range r.data {
+		values[k] = atomic.LoadUint64(v)
+	}
+
+	return values
+}
+
+func newResponsesStats() *responsesStats {
+	return &responsesStats{
+		data: map[responseLabels]*uint64{},
+		lock: &sync.RWMutex{},
+	}
+}
+
+// prometheusWriter renders metrics in Prometheus text exposition
+// format.
+type prometheusWriter struct {
+	writer *bufio.Writer
+}
+
+func (p *prometheusWriter) header(name, kind, help string) {
+	p.writer.WriteString("# HELP " + prometheusNamespace + name + " " + help + "\n") // nolint: errcheck
+	p.writer.WriteString("# TYPE " + prometheusNamespace + name + " " + kind + "\n") // nolint: errcheck
+}
+
+// sample writes a single value. labels are pairs of label name and
+// label value.
+func (p *prometheusWriter) sample(name string, value float64, labels ...string) {
+	p.writer.WriteString(prometheusNamespace + name) // nolint: errcheck
+
+	if len(labels) > 0 {
+		p.writer.WriteByte('{') // nolint: errcheck
+
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				p.writer.WriteByte(',') // nolint: errcheck
+			}
+
+			p.writer.WriteString(labels[i] + `="` + prometheusLabelEscaper.Replace(labels[i+1]) + `"`) // nolint: errcheck
+		}
+
+		p.writer.WriteByte('}') // nolint: errcheck
+	}
+
+	p.writer.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n") // nolint: errcheck, gomnd
+}
+
+func (p *prometheusWriter) metric(name, kind, help string, value float64) {
+	p.header(name, kind, help)
+	p.sample(name, value)
+}
+
+func (p *prometheusWriter) histogram(name, help string, value *histogram) {
+	p.header(name, "histogram", help)
+	p.histogramSamples(name, value)
+}
+
+func (p *prometheusWriter) histogramSamples(name string, value *histogram, labels ...string) {
+	cumulative := uint64(0)
+
+	for i, bound := range prometheusBuckets {
+		cumulative += atomic.LoadUint64(&value.buckets[i])
+		p.sample(name+"_bucket", float64(cumulative),
+			append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...) // nolint: gomnd
+	}
+
+	count := atomic.LoadUint64(&value.count)
+
+	p.sample(name+"_bucket", float64(count), append(labels, "le", "+Inf")...)
+	p.sample(name+"_sum", time.Duration(atomic.LoadUint64(&value.sum)).Seconds(), labels...)
+	p.sample(name+"_count", float64(count), labels...)
+}
+
+func (s *Stats) writePrometheus(w io.Writer) error {
+	writer := &prometheusWriter{writer: bufio.NewWriter(w)}
+
+	writer.metric("requests_total", "counter", "A number of requests to the proxy.",
+		float64(atomic.LoadUint64(&s.RequestsNumber)))
+	writer.metric("crawlera_requests_total", "counter", "A number of requests sent to Crawlera.",
+		float64(atomic.LoadUint64(&s.CrawleraRequests)))
+	writer.metric("direct_requests_total", "counter", "A number of requests sent directly, bypassing Crawlera.",
+		float64(atomic.LoadUint64(&s.DirectRequests)))
+	writer.metric("sessions_created_total", "counter", "A number of created Crawlera sessions.",
+		float64(atomic.LoadUint64(&s.SessionsCreated)))
+	writer.metric("clients_connected", "gauge", "A number of connected clients.",
+		float64(atomic.LoadUint64(&s.ClientsConnected)))
+	writer.metric("clients_serving", "gauge", "A number of clients which are doing requests now.",
+		float64(atomic.LoadUint64(&s.ClientsServing)))
+	writer.metric("adblocked_requests_total", "counter", "A number of adblocked requests.",
+		float64(atomic.LoadUint64(&s.AdblockedRequests)))
+	writer.metric("crawlera_errors_total", "counter", "A number of responses with X-Crawlera-Error header.",
+		float64(atomic.LoadUint64(&s.CrawleraErrors)))
+	writer.metric("errors_total", "counter", "A number of failed requests.",
+		float64(atomic.LoadUint64(&s.AllErrors)))
+	writer.metric("certificates_generated_total", "counter", "A number of generated TLS certificates.",
+		float64(atomic.LoadUint64(&s.CertificatesGenerated)))
+	writer.metric("certificates_cached", "gauge", "A number of cached TLS certificates.",
+		float64(atomic.LoadUint64(&s.CertificatesCached)))
+	writer.metric("uptime_seconds", "gauge", "Uptime of the proxy.",
+		time.Since(time.Time(s.Uptime)).Seconds())
+
+	s.writePrometheusMethods(writer)
+
+	s.writePrometheusResponses(writer)
+
+	writer.histogram("overall_time_seconds", "Time of processing requests by the proxy.", s.overallHistogram)
+	writer.histogram("crawlera_time_seconds", "Time of requests to Crawlera.", s.crawleraHistogram)
+	writer.histogram("direct_time_seconds", "Time of direct requests.", s.directHistogram)
+
+	writer.header("round_trip_phase_seconds", "histogram",
+		"Time of round trip phases: dial (including tunnel), TLS handshakes and time to first byte.")
+
+	for _, route := range prometheusRoutes {
+		for _, phase := range prometheusPhases {
+			writer.histogramSamples("round_trip_phase_seconds",
+				s.phaseHistograms[phaseLabels{route: route, phase: phase}],
+				"route", route, "phase", phase)
+		}
+	}
+
+	s.writePrometheusTraffic(writer)
+	s.writePrometheusUpstreams(writer)
+	s.writePrometheusTenants(writer)
+	s.writePrometheusRetries(writer)
+	s.writePrometheusErrorCategories(writer)
+	s.writePrometheusAdblock(writer)
+
+	return writer.writer.Flush()
+}
+
+func (s *Stats) writePrometheusTraffic(writer *prometheusWriter) {
+	writer.header("traffic_bytes_total", "counter",
+		"Traffic per route and direction. Traffic of adblocked route is estimated traffic which was saved.")
+
+	for _, route := range [...]string{RouteProxied, RouteDirect, RouteAdblocked} {
+		counter := s.Traffic.routes[route]
+
+		writer.sample("traffic_bytes_total", float64(atomic.LoadUint64(&counter.bytesIn)),
+			"route", route, "direction", "in")
+		writer.sample("traffic_bytes_total", float64(atomic.LoadUint64(&counter.bytesOut)),
+			"route", route, "direction", "out")
+	}
+}
+
+func (s *Stats) writePrometheusResponses(writer *prometheusWriter) {
+	responses := s.responses.snapshot()
+	keys := make([]responseLabels, 0, len(responses))
+
+	for k := range responses {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		left := keys[i].route + keys[i].method + keys[i].status + keys[i].crawleraError
+		right := keys[j].route + keys[j].method + keys[j].status + keys[j].crawleraError
+
+		return left < right
+	})
+
+	writer.header("responses_total", "counter", "A number of responses.")
+
+	for _, k := range keys {
+		writer.sample("responses_total", float64(responses[k]),
+			"route", k.route,
+			"method", k.method,
+			"status", k.status,
+			"crawlera_error", k.crawleraError)
+	}
+}
+
+func (s *Stats) writePrometheusMethods(writer *prometheusWriter) {
+	methods := s.Methods.snapshot()
+	keys := make([]string, 0, len(methods))
+
+	for k := range methods {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.header("method_requests_total", "counter", "A number of requests per HTTP method.")
+
+	for _, k := range keys {
+		writer.sample("method_requests_total", float64(methods[k].Total), "method", k)
+	}
+
+	writer.header("method_requests_in_flight", "gauge", "A number of in-flight requests per HTTP method.")
+
+	for _, k := range keys {
+		writer.sample("method_requests_in_flight", float64(methods[k].InFlight), "method", k)
+	}
+}
+
+func (s *Stats) writePrometheusUpstreams(writer *prometheusWriter) {
+	upstreams := s.Upstreams.snapshot()
+	keys := make([]string, 0, len(upstreams))
+
+	for k := range upstreams {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.header("upstream_requests_total", "counter", "A number of requests to the upstream.")
+
+	for _, k := range keys {
+		writer.sample("upstream_requests_total", float64(upstreams[k].Requests), "upstream", k)
+	}
+
+	writer.header("upstream_failures_total", "counter", "A number of failures of the upstream.")
+
+	for _, k := range keys {
+		writer.sample("upstream_failures_total", float64(upstreams[k].Failures), "upstream", k)
+	}
+
+	writer.header("upstream_active_connections", "gauge", "A number of active connections to the upstream.")
+
+	for _, k := range keys {
+		writer.sample("upstream_active_connections", float64(upstreams[k].ActiveConnections), "upstream", k)
+	}
+
+	writer.header("upstream_healthy", "gauge", "Is upstream healthy (1) or not (0).")
+
+	for _, k := range keys {
+		healthy := 0.0
+		if upstreams[k].Healthy {
+			healthy = 1
+		}
+
+		writer.sample("upstream_healthy", healthy, "upstream", k)
+	}
+}
+
+func (s *Stats) writePrometheusTenants(writer *prometheusWriter) {
+	tenants := s.Tenants.snapshot()
+	keys := make([]string, 0, len(tenants))
+
+	for k := range tenants {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.header("tenant_requests_total", "counter", "A number of requests of the tenant.")
+
+	for _, k := range keys {
+		writer.sample("tenant_requests_total", float64(tenants[k].RequestsNumber), "tenant", k)
+	}
+
+	writer.header("tenant_sessions_created_total", "counter", "A number of created sessions of the tenant.")
+
+	for _, k := range keys {
+		writer.sample("tenant_sessions_created_total", float64(tenants[k].SessionsCreated), "tenant", k)
+	}
+
+	writer.header("tenant_crawlera_errors_total", "counter", "A number of Crawlera errors of the tenant.")
+
+	for _, k := range keys {
+		writer.sample("tenant_crawlera_errors_total", float64(tenants[k].CrawleraErrors), "tenant", k)
+	}
+
+	writer.header("tenant_errors_total", "counter", "A number of failed requests of the tenant.")
+
+	for _, k := range keys {
+		writer.sample("tenant_errors_total", float64(tenants[k].AllErrors), "tenant", k)
+	}
+}
+
+func (s *Stats) writePrometheusRetries(writer *prometheusWriter) {
+	retries := s.Retries.snapshot()
+	keys := make([]string, 0, len(retries))
+
+	for k := range retries {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.header("retries_total", "counter", "A number of retried requests sent upstream per error.")
+
+	for _, k := range keys {
+		writer.sample("retries_total", float64(retries[k].Attempts), "error", k)
+	}
+
+	writer.header("retried_requests_total", "counter", "A number of retried requests per error and result.")
+
+	for _, k := range keys {
+		writer.sample("retried_requests_total", float64(retries[k].Succeeded), "error", k, "result", "succeeded")
+		writer.sample("retried_requests_total", float64(retries[k].Failed), "error", k, "result", "failed")
+	}
+}
+
+func (s *Stats) writePrometheusErrorCategories(writer *prometheusWriter) {
+	categories := s.ErrorCategories.snapshot()
+	keys := make([]string, 0, len(categories))
+
+	for k := range categories {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.header("crawlera_error_categories_total", "counter", "A number of Crawlera errors per category.")
+
+	for _, k := range keys {
+		writer.sample("crawlera_error_categories_total", float64(categories[k]), "category", k)
+	}
+}
+
+func (s *Stats) writePrometheusAdblock(writer *prometheusWriter) {
+	adblock := s.Adblock.snapshot()
+	keys := make([]string, 0, len(adblock.Lists))
+
+	for k := range adblock.Lists {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	writer.metric("adblock_unfiltered_requests_total", "counter",
+		"A number of requests which were not filtered because adblock lists were not loaded in time.",
+		float64(adblock.UnfilteredRequests))
+
+	writer.header("adblock_rules", "gauge", "A number of rules of the adblock list.")
+
+	for _, k := range keys {
+		writer.sample("adblock_rules", float64(adblock.Lists[k].Rules), "list", k)
+	}
+
+	writer.header("adblock_list_errors_total", "counter", "A number of failures to load the adblock list.")
+
+	for _, k := range keys {
+		writer.sample("adblock_list_errors_total", float64(adblock.Lists[k].Errors), "list", k)
+	}
+
+	writer.header("adblock_list_loaded", "gauge", "Is the latest version of adblock list loaded (1) or not (0).")
+
+	for _, k := range keys {
+		loaded := 0.0
+		if adblock.Lists[k].State == AdblockListLoaded {
+			loaded = 1
+		}
+
+		writer.sample("adblock_list_loaded", loaded, "list", k)
+	}
+}
+
+func normalizeMethod(method string) string {
+	method = strings.ToUpper(method)
+	if prometheusMethods[method] {
+		return method
+	}
+
+	return methodOther
+}
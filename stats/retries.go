@@ -0,0 +1,70 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+// retryStats are counters of retries of requests failed with the same
+// error. Attempts is a number of retried requests sent upstream,
+// Succeeded and Failed are numbers of requests which have got a good
+// response after retries or have not got it.
+type retryStats struct {
+	Attempts  uint64 `json:"attempts"`
+	Succeeded uint64 `json:"succeeded"`
+	Failed    uint64 `json:"failed"`
+}
+
+type retriesStats struct {
+	data map[string]*retryStats
+	lock *sync.RWMutex
+}
+
+func (r *retriesStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.snapshot())
+}
+
+func (r *retriesStats) snapshot() map[string]retryStats {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	values := make(map[string]retryStats, len(r.data))
+
+	for k, v := range r.data {
+		values[k] = retryStats{
+			Attempts:  atomic.LoadUint64(&v.Attempts),
+			Succeeded: atomic.LoadUint64(&v.Succeeded),
+			Failed:    atomic.LoadUint64(&v.Failed),
+		}
+	}
+
+	return values
+}
+
+func (r *retriesStats) get(reason string) *retryStats {
+	r.lock.RLock()
+	value, ok := r.data[reason]
+	r.lock.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if value, ok = r.data[reason]; !ok {
+		value = &retryStats{}
+		r.data[reason] = value
+	}
+
+	return value
+}
+
+func newRetriesStats() *retriesStats {
+	return &retriesStats{
+		data: map[string]*retryStats{},
+		lock: &sync.RWMutex{},
+	}
+}
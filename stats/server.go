@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"net/http"
@@ -17,10 +18,59 @@ import (
 const (
 	statsServerTimeout      = 2 * time.Second
 	statsConcurrentRequests = 10
+
+	prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
 )
 
-// RunStats runs statistics collector and API service.
-func RunStats(statsContainer *Stats, conf *config.Config) {
+// ReloadFunc re-reads configuration and applies it to the proxy.
+type ReloadFunc func() error
+
+// AuthFunc tells if a request to API is sent by a client which is allowed
+// to change the state of the proxy.
+type AuthFunc func(r *http.Request) bool
+
+type apiResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type pinSessionRequest struct {
+	SessionID string `json:"session_id"`
+}
+
+// RunStats runs statistics collector and API service until context is
+// closed. Then it waits for the current API requests and returns.
+// Endpoints which change the state of the proxy are available only to
+// clients accepted by authenticate.
+func RunStats(ctx context.Context, statsContainer *Stats, conf *config.Config, reload ReloadFunc,
+	authenticate AuthFunc, sessions SessionsController, adblock AdblockTester) error {
+	srv := &http.Server{
+		Addr:    net.JoinHostPort(conf.ProxyAPIIP, strconv.Itoa(conf.ProxyAPIPort)),
+		Handler: newRouter(statsContainer, reload, authenticate, sessions, adblock),
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), statsServerTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot shutdown stats server")
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+func newRouter(statsContainer *Stats, reload ReloadFunc, authenticate AuthFunc, // nolint: funlen
+	sessions SessionsController, adblock AdblockTester) http.Handler {
 	router := chi.NewRouter()
 
 	router.Use(middleware.GetHead)
@@ -45,10 +95,99 @@ func RunStats(statsContainer *Stats, conf *config.Config) {
 		}
 	})
 
-	srv := &http.Server{
-		Addr:    net.JoinHostPort(conf.ProxyAPIIP, strconv.Itoa(conf.ProxyAPIPort)),
-		Handler: router,
+	router.Get("/metrics", func(w http.ResponseWriter, r *http.Request) { // nolint: unparam
+		w.Header().Set("Content-Type", prometheusContentType)
+
+		statsContainer.statsLock.Lock()
+		defer statsContainer.statsLock.Unlock()
+
+		if err := statsContainer.writePrometheus(w); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warn("Cannot return metrics to client")
+		}
+	})
+
+	protected := router.With(requireAuth(authenticate))
+
+	protected.Post("/config/reload", func(w http.ResponseWriter, r *http.Request) { // nolint: unparam
+		if err := reload(); err != nil {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Status: "ok"})
+	})
+
+	protected.Get("/sessions", func(w http.ResponseWriter, r *http.Request) { // nolint: unparam
+		writeJSON(w, http.StatusOK, sessions.ListSessions())
+	})
+
+	protected.Delete("/sessions/*", func(w http.ResponseWriter, r *http.Request) {
+		if !sessions.RotateSessions(chi.URLParam(r, "*")) {
+			writeJSON(w, http.StatusNotFound, apiResponse{Status: "error", Error: "unknown client"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Status: "ok"})
+	})
+
+	protected.Post("/sessions/*", func(w http.ResponseWriter, r *http.Request) {
+		request := pinSessionRequest{}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.SessionID == "" {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", Error: "session_id is required"})
+			return
+		}
+
+		if !sessions.PinSession(chi.URLParam(r, "*"), request.SessionID) {
+			writeJSON(w, http.StatusNotFound, apiResponse{Status: "error", Error: "unknown client"})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, apiResponse{Status: "ok"})
+	})
+
+	router.Get("/adblock/test", func(w http.ResponseWriter, r *http.Request) {
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", Error: "url is required"})
+			return
+		}
+
+		result, err := adblock.TestAdblock(url, r.URL.Query().Get("referer"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, apiResponse{Status: "error", Error: err.Error()})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	return router
+}
+
+func requireAuth(authenticate AuthFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !authenticate(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="crawlera-headless-proxy"`)
+				writeJSON(w, http.StatusUnauthorized, apiResponse{Status: "error", Error: "authentication required"})
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
 	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value interface{}) {
+	w.WriteHeader(statusCode)
 
-	log.Fatal(srv.ListenAndServe())
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Warn("Cannot return JSON to client")
+	}
 }
@@ -0,0 +1,301 @@
+package stats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/scrapinghub/crawlera-headless-proxy/config"
+)
+
+type sessionsControllerMock struct {
+	mock.Mock
+}
+
+func (s *sessionsControllerMock) ListSessions() []ClientSessions {
+	return s.Called().Get(0).([]ClientSessions)
+}
+
+func (s *sessionsControllerMock) RotateSessions(client string) bool {
+	return s.Called(client).Bool(0)
+}
+
+func (s *sessionsControllerMock) PinSession(client, sessionID string) bool {
+	return s.Called(client, sessionID).Bool(0)
+}
+
+type adblockTesterMock struct {
+	mock.Mock
+}
+
+func (a *adblockTesterMock) TestAdblock(url, referer string) (AdblockTestResult, error) {
+	args := a.Called(url, referer)
+
+	return args.Get(0).(AdblockTestResult), args.Error(1)
+}
+
+type ServerTestSuite struct {
+	suite.Suite
+
+	metrics    *Stats
+	sessions   *sessionsControllerMock
+	adblock    *adblockTesterMock
+	server     *httptest.Server
+	reloadErr  error
+	reloads    int
+	authorized bool
+}
+
+func (suite *ServerTestSuite) SetupTest() {
+	suite.metrics = NewStats()
+	suite.reloadErr = nil
+	suite.reloads = 0
+	suite.authorized = true
+	suite.sessions = &sessionsControllerMock{}
+	suite.adblock = &adblockTesterMock{}
+	suite.server = httptest.NewServer(newRouter(suite.metrics, func() error {
+		suite.reloads++
+
+		return suite.reloadErr
+	}, func(r *http.Request) bool {
+		return suite.authorized
+	}, suite.sessions, suite.adblock))
+}
+
+func (suite *ServerTestSuite) TearDownTest() {
+	suite.server.Close()
+	suite.sessions.AssertExpectations(suite.T())
+	suite.adblock.AssertExpectations(suite.T())
+}
+
+func (suite *ServerTestSuite) get(path string) (*http.Response, string) {
+	resp, err := http.Get(suite.server.URL + path) // nolint: noctx
+	suite.NoError(err)
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+
+	return resp, string(body)
+}
+
+func (suite *ServerTestSuite) do(method, path, body string) (*http.Response, string) {
+	req, err := http.NewRequest(method, suite.server.URL+path, strings.NewReader(body)) // nolint: noctx
+	suite.NoError(err)
+
+	resp, err := http.DefaultClient.Do(req)
+	suite.NoError(err)
+
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	suite.NoError(err)
+
+	return resp, string(respBody)
+}
+
+func (suite *ServerTestSuite) TestStats() {
+	suite.metrics.NewCrawleraRequest()
+
+	resp, body := suite.get("/stats")
+	suite.Equal("application/json", resp.Header.Get("Content-Type"))
+
+	decoded := map[string]interface{}{}
+	suite.NoError(json.Unmarshal([]byte(body), &decoded))
+	suite.EqualValues(1, decoded["crawlera_requests"])
+}
+
+func (suite *ServerTestSuite) TestMetrics() {
+	suite.metrics.NewCrawleraRequest()
+	suite.metrics.NewCrawleraError()
+	suite.metrics.NewResponse(RouteProxied, "GET", http.StatusServiceUnavailable, "banned")
+	suite.metrics.NewResponse(RouteProxied, "GET", http.StatusServiceUnavailable, "banned")
+	suite.metrics.NewResponse(RouteDirect, "get", http.StatusOK, "")
+	suite.metrics.NewResponse(RouteAdblocked, "PROPFIND", http.StatusForbidden, "")
+	suite.metrics.NewOverallTime(20 * time.Millisecond)
+	suite.metrics.NewOverallTime(3 * time.Second)
+	suite.metrics.NewCrawleraTime(time.Second)
+	suite.metrics.NewUpstreamConnection("proxy.zyte.com:8011")
+	suite.metrics.NewTenantRequest("project \"a\"")
+
+	resp, body := suite.get("/metrics")
+	suite.Equal(prometheusContentType, resp.Header.Get("Content-Type"))
+
+	suite.Contains(body, "# TYPE crawlera_headless_crawlera_requests_total counter\n")
+	suite.Contains(body, "crawlera_headless_crawlera_requests_total 1\n")
+	suite.Contains(body, "crawlera_headless_crawlera_errors_total 1\n")
+	suite.Contains(body, "crawlera_headless_errors_total 1\n")
+	suite.Contains(body, `crawlera_headless_responses_total{route="proxied",method="GET",status="503",crawlera_error="banned"} 2`+"\n")
+	suite.Contains(body, `crawlera_headless_responses_total{route="direct",method="GET",status="200",crawlera_error=""} 1`+"\n")
+	suite.Contains(body, `crawlera_headless_responses_total{route="adblocked",method="OTHER",status="403",crawlera_error=""} 1`+"\n")
+
+	suite.Contains(body, "# TYPE crawlera_headless_overall_time_seconds histogram\n")
+	suite.Contains(body, `crawlera_headless_overall_time_seconds_bucket{le="0.01"} 0`+"\n")
+	suite.Contains(body, `crawlera_headless_overall_time_seconds_bucket{le="0.025"} 1`+"\n")
+	suite.Contains(body, `crawlera_headless_overall_time_seconds_bucket{le="2.5"} 1`+"\n")
+	suite.Contains(body, `crawlera_headless_overall_time_seconds_bucket{le="5"} 2`+"\n")
+	suite.Contains(body, `crawlera_headless_overall_time_seconds_bucket{le="+Inf"} 2`+"\n")
+	suite.Contains(body, "crawlera_headless_overall_time_seconds_sum 3.02\n")
+	suite.Contains(body, "crawlera_headless_overall_time_seconds_count 2\n")
+	suite.Contains(body, `crawlera_headless_crawlera_time_seconds_bucket{le="1"} 1`+"\n")
+
+	suite.Contains(body, `crawlera_headless_upstream_requests_total{upstream="proxy.zyte.com:8011"} 1`+"\n")
+	suite.Contains(body, `crawlera_headless_upstream_healthy{upstream="proxy.zyte.com:8011"} 1`+"\n")
+	suite.Contains(body, `crawlera_headless_tenant_requests_total{tenant="project \"a\""} 1`+"\n")
+}
+
+func (suite *ServerTestSuite) TestReload() {
+	resp, body := suite.do(http.MethodPost, "/config/reload", "")
+
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.JSONEq(`{"status": "ok"}`, body)
+	suite.Equal(1, suite.reloads)
+}
+
+func (suite *ServerTestSuite) TestReloadError() {
+	suite.reloadErr = errors.New("unknown referer policy none")
+
+	resp, body := suite.do(http.MethodPost, "/config/reload", "")
+
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.JSONEq(`{"status": "error", "error": "unknown referer policy none"}`, body)
+}
+
+func (suite *ServerTestSuite) TestReloadMethod() {
+	resp, _ := suite.get("/config/reload")
+
+	suite.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+	suite.Equal(0, suite.reloads)
+}
+
+func (suite *ServerTestSuite) TestUnauthorized() {
+	suite.authorized = false
+
+	resp, body := suite.do(http.MethodPost, "/config/reload", "")
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+	suite.Equal(`Basic realm="crawlera-headless-proxy"`, resp.Header.Get("WWW-Authenticate"))
+	suite.JSONEq(`{"status": "error", "error": "authentication required"}`, body)
+	suite.Equal(0, suite.reloads)
+
+	resp, _ = suite.do(http.MethodDelete, "/sessions/1234", "")
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = suite.do(http.MethodPost, "/sessions/1234", `{"session_id": "111"}`)
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = suite.get("/sessions")
+	suite.Equal(http.StatusUnauthorized, resp.StatusCode)
+	suite.sessions.AssertNotCalled(suite.T(), "ListSessions")
+}
+
+func (suite *ServerTestSuite) TestListSessions() {
+	lastUsed := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	suite.sessions.On("ListSessions").Return([]ClientSessions{
+		{
+			Client:   "users/1234",
+			Sessions: []Session{{ID: "111", Age: 10, LastUsed: lastUsed, Requests: 5, Pinned: true}},
+			Errors:   2,
+		},
+	})
+
+	resp, body := suite.get("/sessions")
+
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.JSONEq(`[{
+		"client": "users/1234",
+		"sessions": [{"id": "111", "age": 10, "last_used": "2020-01-02T03:04:05Z", "requests": 5, "pinned": true}],
+		"errors": 2
+	}]`, body)
+}
+
+func (suite *ServerTestSuite) TestRotateSessions() {
+	suite.sessions.On("RotateSessions", "users/1234@example.com").Return(true)
+	suite.sessions.On("RotateSessions", "unknown").Return(false)
+
+	resp, body := suite.do(http.MethodDelete, "/sessions/users/1234@example.com", "")
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.JSONEq(`{"status": "ok"}`, body)
+
+	resp, _ = suite.do(http.MethodDelete, "/sessions/unknown", "")
+	suite.Equal(http.StatusNotFound, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestPinSession() {
+	suite.sessions.On("PinSession", "1234", "111").Return(true)
+	suite.sessions.On("PinSession", "unknown", "111").Return(false)
+
+	resp, body := suite.do(http.MethodPost, "/sessions/1234", `{"session_id": "111"}`)
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.JSONEq(`{"status": "ok"}`, body)
+
+	resp, _ = suite.do(http.MethodPost, "/sessions/unknown", `{"session_id": "111"}`)
+	suite.Equal(http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = suite.do(http.MethodPost, "/sessions/1234", `{}`)
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestAdblockTest() {
+	suite.adblock.On("TestAdblock", "http://ads.example.com/banner.js", "example.com").Return(AdblockTestResult{
+		URL:     "http://ads.example.com/banner.js",
+		Blocked: true,
+		Reason:  AdblockTestBlocked,
+		Rule:    "||ads.example.com^",
+		List:    "adblock_rules",
+	}, nil)
+	suite.adblock.On("TestAdblock", "incorrect", "").Return(AdblockTestResult{}, errors.New("incorrect URL"))
+
+	resp, body := suite.get("/adblock/test?url=http%3A%2F%2Fads.example.com%2Fbanner.js&referer=example.com")
+	suite.Equal(http.StatusOK, resp.StatusCode)
+	suite.JSONEq(`{
+		"url": "http://ads.example.com/banner.js",
+		"blocked": true,
+		"reason": "blocked",
+		"rule": "||ads.example.com^",
+		"list": "adblock_rules"
+	}`, body)
+
+	resp, body = suite.get("/adblock/test?url=incorrect")
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+	suite.JSONEq(`{"status": "error", "error": "incorrect URL"}`, body)
+
+	resp, _ = suite.get("/adblock/test")
+	suite.Equal(http.StatusBadRequest, resp.StatusCode)
+}
+
+func (suite *ServerTestSuite) TestRunStatsShutdown() {
+	conf := config.NewConfig()
+	conf.ProxyAPIIP = "127.0.0.1"
+	conf.ProxyAPIPort = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- RunStats(ctx, suite.metrics, conf, nil, nil, suite.sessions, suite.adblock)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		suite.NoError(err)
+	case <-time.After(time.Second):
+		suite.FailNow("stats server was not stopped")
+	}
+}
+
+func TestServer(t *testing.T) {
+	suite.Run(t, &ServerTestSuite{})
+}
@@ -0,0 +1,29 @@
+package stats
+
+import "time"
+
+// Session describes a single Crawlera session of a proxy client.
+type Session struct {
+	ID       string    `json:"id"`
+	Age      int       `json:"age"`
+	LastUsed time.Time `json:"last_used"`
+	Requests int       `json:"requests"`
+	Pinned   bool      `json:"pinned"`
+}
+
+// ClientSessions describes Crawlera sessions of a proxy client and
+// a number of sessions which were broken so far.
+type ClientSessions struct {
+	Client   string    `json:"client"`
+	Sessions []Session `json:"sessions"`
+	Errors   uint64    `json:"errors"`
+}
+
+// SessionsController gives access to Crawlera sessions of proxy
+// clients. RotateSessions and PinSession return false if client is
+// unknown.
+type SessionsController interface {
+	ListSessions() []ClientSessions
+	RotateSessions(client string) bool
+	PinSession(client, sessionID string) bool
+}
@@ -25,19 +25,43 @@ func (s statsUptime) MarshalJSON() ([]byte, error) {
 type Stats struct {
 	RequestsNumber    uint64 `json:"requests_number"`
 	CrawleraRequests  uint64 `json:"crawlera_requests"`
+	DirectRequests    uint64 `json:"direct_requests"`
 	SessionsCreated   uint64 `json:"sessions_created"`
 	ClientsConnected  uint64 `json:"clients_connected"`
+	ClientsServing    uint64 `json:"clients_serving"`
 	AdblockedRequests uint64 `json:"adblocked_requests"`
 	CrawleraErrors    uint64 `json:"crawlera_errors"`
 	AllErrors         uint64 `json:"all_errors"`
 
+	CertificatesGenerated uint64 `json:"certificates_generated"`
+	CertificatesCached    uint64 `json:"certificates_cached"`
+
 	// The owls are not what they seem
 	// do not believe RWMutex. We use it as shared/exclusive lock.
-	OverallTimes  *durationTimeSeries `json:"overall_times"`
-	CrawleraTimes *durationTimeSeries `json:"crawlera_times"`
+	OverallTimes      *durationTimeSeries `json:"overall_times"`
+	CrawleraTimes     *durationTimeSeries `json:"crawlera_times"`
+	CrawleraDialTimes *durationTimeSeries `json:"crawlera_dial_times"`
+	CrawleraTLSTimes  *durationTimeSeries `json:"crawlera_tls_times"`
+	CrawleraTTFBTimes *durationTimeSeries `json:"crawlera_ttfb_times"`
+	DirectTimes       *durationTimeSeries `json:"direct_times"`
+
+	Methods         *methodsStats         `json:"methods"`
+	Hosts           *hostsStats           `json:"hosts"`
+	Traffic         *trafficStats         `json:"traffic"`
+	Upstreams       *upstreamsStats       `json:"upstreams"`
+	Tenants         *tenantsStats         `json:"tenants"`
+	Retries         *retriesStats         `json:"retries"`
+	ErrorCategories *errorCategoriesStats `json:"error_categories"`
+	Adblock         *adblockStats         `json:"adblock"`
 
 	Uptime statsUptime `json:"uptime"`
 
+	responses         *responsesStats
+	overallHistogram  *histogram
+	crawleraHistogram *histogram
+	directHistogram   *histogram
+	phaseHistograms   map[phaseLabels]*histogram
+
 	statsLock *sync.RWMutex
 }
 
@@ -55,69 +79,159 @@ func (s *Stats) DropConnection() {
 }
 
 func (s *Stats) NewGet() {
+	s.newMethodRequest("GET")
 }
 
 func (s *Stats) NewHead() {
+	s.newMethodRequest("HEAD")
 }
 
 func (s *Stats) NewPost() {
+	s.newMethodRequest("POST")
 }
 
 func (s *Stats) NewPut() {
+	s.newMethodRequest("PUT")
 }
 
 func (s *Stats) NewDelete() {
+	s.newMethodRequest("DELETE")
 }
 
 func (s *Stats) NewConnect() {
+	s.newMethodRequest("CONNECT")
 }
 
 func (s *Stats) NewOptions() {
+	s.newMethodRequest("OPTIONS")
 }
 
 func (s *Stats) NewTrace() {
+	s.newMethodRequest("TRACE")
 }
 
 func (s *Stats) NewPatch() {
+	s.newMethodRequest("PATCH")
 }
 
 func (s *Stats) NewOther() {
+	s.newMethodRequest(methodOther)
 }
 
 func (s *Stats) DropGet() {
+	s.dropMethodRequest("GET")
 }
 
 func (s *Stats) DropHead() {
+	s.dropMethodRequest("HEAD")
 }
 
 func (s *Stats) DropPost() {
+	s.dropMethodRequest("POST")
 }
 
 func (s *Stats) DropPut() {
+	s.dropMethodRequest("PUT")
 }
 
 func (s *Stats) DropDelete() {
+	s.dropMethodRequest("DELETE")
 }
 
 func (s *Stats) DropConnect() {
+	s.dropMethodRequest("CONNECT")
 }
 
 func (s *Stats) DropOptions() {
+	s.dropMethodRequest("OPTIONS")
 }
 
 func (s *Stats) DropTrace() {
+	s.dropMethodRequest("TRACE")
 }
 
 func (s *Stats) DropPatch() {
+	s.dropMethodRequest("PATCH")
 }
 
 func (s *Stats) DropOther() {
+	s.dropMethodRequest(methodOther)
+}
+
+func (s *Stats) newMethodRequest(method string) {
+	s.statsLock.RLock()
+	s.Methods.newRequest(method)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) dropMethodRequest(method string) {
+	s.statsLock.RLock()
+	s.Methods.dropRequest(method)
+	s.statsLock.RUnlock()
 }
 
 func (s *Stats) NewCertificate() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.CertificatesGenerated, 1)
+	atomic.AddUint64(&s.CertificatesCached, 1)
+	s.statsLock.RUnlock()
 }
 
 func (s *Stats) DropCertificate() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.CertificatesCached, atomicDecrement)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewHostRequest(host string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Hosts.get(host).Requests, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewHostError(host string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Hosts.get(host).Errors, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewHostTraffic(host string, received, sent uint64) {
+	s.statsLock.RLock()
+	value := s.Hosts.get(host)
+	atomic.AddUint64(&value.BytesReceived, received)
+	atomic.AddUint64(&value.BytesSent, sent)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewClientServing() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.ClientsServing, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) DropClientServing() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.ClientsServing, atomicDecrement)
+	s.statsLock.RUnlock()
+}
+
+// NewTraffic accounts bytes received from and sent to Crawlera (route
+// RouteProxied) or target hosts (route RouteDirect) on behalf of the
+// given client.
+func (s *Stats) NewTraffic(route, clientID string, received, sent uint64) {
+	s.statsLock.RLock()
+	s.Traffic.add(route, clientID, received, sent)
+	s.statsLock.RUnlock()
+}
+
+// NewAdblockedTraffic accounts traffic which was saved by blocking a
+// request. sent is the size of the blocked request, received is
+// estimated as an average size of a response from Crawlera.
+func (s *Stats) NewAdblockedTraffic(sent uint64) {
+	s.statsLock.RLock()
+	received := s.Traffic.averageBytesIn(atomic.LoadUint64(&s.CrawleraRequests))
+	s.Traffic.add(RouteAdblocked, "", received, sent)
+	s.statsLock.RUnlock()
 }
 
 func (s *Stats) NewCrawleraRequest() {
@@ -126,6 +240,85 @@ func (s *Stats) NewCrawleraRequest() {
 	s.statsLock.RUnlock()
 }
 
+func (s *Stats) NewDirectRequest() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.DirectRequests, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewUpstreamConnection(address string) {
+	s.statsLock.RLock()
+	value := s.Upstreams.get(address)
+	atomic.AddUint64(&value.Requests, 1)
+	atomic.AddUint64(&value.ActiveConnections, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) DropUpstreamConnection(address string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Upstreams.get(address).ActiveConnections, atomicDecrement)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewUpstreamFailure(address string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Upstreams.get(address).Failures, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) SetUpstreamHealth(address string, healthy bool) {
+	s.statsLock.RLock()
+	s.Upstreams.setHealthy(address, healthy)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewTenantRequest(name string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Tenants.get(name).RequestsNumber, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewTenantSessionCreated(name string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Tenants.get(name).SessionsCreated, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewTenantCrawleraError(name string) {
+	s.statsLock.RLock()
+	value := s.Tenants.get(name)
+	atomic.AddUint64(&value.CrawleraErrors, 1)
+	atomic.AddUint64(&value.AllErrors, 1)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewTenantOtherError(name string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Tenants.get(name).AllErrors, 1)
+	s.statsLock.RUnlock()
+}
+
+// NewRetry counts a request retried because of the error.
+func (s *Stats) NewRetry(reason string) {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Retries.get(reason).Attempts, 1)
+	s.statsLock.RUnlock()
+}
+
+// NewRetryResult counts a request which was retried because of the
+// error and has finally succeeded or failed.
+func (s *Stats) NewRetryResult(reason string, succeeded bool) {
+	s.statsLock.RLock()
+
+	if value := s.Retries.get(reason); succeeded {
+		atomic.AddUint64(&value.Succeeded, 1)
+	} else {
+		atomic.AddUint64(&value.Failed, 1)
+	}
+
+	s.statsLock.RUnlock()
+}
+
 func (s *Stats) NewSessionCreated() {
 	s.statsLock.RLock()
 	atomic.AddUint64(&s.SessionsCreated, 1)
@@ -138,6 +331,31 @@ func (s *Stats) NewAdblockedRequest() {
 	s.statsLock.RUnlock()
 }
 
+// SetAdblockLists sets adblock lists to report. Lists which were set
+// before keep their load state.
+func (s *Stats) SetAdblockLists(lists []string) {
+	s.statsLock.RLock()
+	s.Adblock.reset(lists)
+	s.statsLock.RUnlock()
+}
+
+// SetAdblockListState sets load state of the adblock list and a number
+// of its rules. If err is not nil, it is counted as a failure to load
+// the list.
+func (s *Stats) SetAdblockListState(list, state string, rules int, err error) {
+	s.statsLock.RLock()
+	s.Adblock.set(list, state, rules, err)
+	s.statsLock.RUnlock()
+}
+
+// NewAdblockUnfilteredRequest counts a request which was not filtered
+// because adblock lists were not loaded in time.
+func (s *Stats) NewAdblockUnfilteredRequest() {
+	s.statsLock.RLock()
+	atomic.AddUint64(&s.Adblock.unfilteredRequests, 1)
+	s.statsLock.RUnlock()
+}
+
 func (s *Stats) NewCrawleraError() {
 	s.statsLock.RLock()
 	atomic.AddUint64(&s.CrawleraErrors, 1)
@@ -145,30 +363,113 @@ func (s *Stats) NewCrawleraError() {
 	s.statsLock.RUnlock()
 }
 
+// NewErrorCategory counts a Crawlera error of the category.
+func (s *Stats) NewErrorCategory(category string) {
+	s.statsLock.RLock()
+	s.ErrorCategories.newError(category)
+	s.statsLock.RUnlock()
+}
+
 func (s *Stats) NewOtherError() {
 	s.statsLock.RLock()
 	atomic.AddUint64(&s.AllErrors, 1)
 	s.statsLock.RUnlock()
 }
 
+func (s *Stats) NewResponse(route, method string, statusCode int, crawleraError string) {
+	labels := responseLabels{
+		route:         route,
+		method:        normalizeMethod(method),
+		status:        strconv.Itoa(statusCode),
+		crawleraError: crawleraError,
+	}
+
+	s.statsLock.RLock()
+	atomic.AddUint64(s.responses.get(labels), 1)
+	s.statsLock.RUnlock()
+}
+
 func (s *Stats) NewCrawleraTime(elapsed time.Duration) {
 	s.statsLock.RLock()
 	s.CrawleraTimes.add(elapsed)
+	s.crawleraHistogram.add(elapsed)
+	s.statsLock.RUnlock()
+}
+
+func (s *Stats) NewDirectTime(elapsed time.Duration) {
+	s.statsLock.RLock()
+	s.DirectTimes.add(elapsed)
+	s.directHistogram.add(elapsed)
 	s.statsLock.RUnlock()
 }
 
+// NewRoundTripPhases records durations of phases of a single round trip
+// of the given route. Phases which have not happened (for example, TLS
+// handshake of plain HTTP requests) have zero duration and are skipped.
+func (s *Stats) NewRoundTripPhases(route string, dial, tls, ttfb time.Duration) {
+	s.statsLock.RLock()
+	defer s.statsLock.RUnlock()
+
+	for phase, elapsed := range map[string]time.Duration{
+		phaseDial: dial,
+		phaseTLS:  tls,
+		phaseTTFB: ttfb,
+	} {
+		if elapsed <= 0 {
+			continue
+		}
+
+		if value, ok := s.phaseHistograms[phaseLabels{route: route, phase: phase}]; ok {
+			value.add(elapsed)
+		}
+
+		if route != RouteProxied {
+			continue
+		}
+
+		switch phase {
+		case phaseDial:
+			s.CrawleraDialTimes.add(elapsed)
+		case phaseTLS:
+			s.CrawleraTLSTimes.add(elapsed)
+		case phaseTTFB:
+			s.CrawleraTTFBTimes.add(elapsed)
+		}
+	}
+}
+
 func (s *Stats) NewOverallTime(elapsed time.Duration) {
 	s.statsLock.RLock()
 	s.OverallTimes.add(elapsed)
+	s.overallHistogram.add(elapsed)
 	s.statsLock.RUnlock()
 }
 
 // NewStats creates new initialized Stats instance.
 func NewStats() *Stats {
 	return &Stats{
-		OverallTimes:  newDurationTimeSeries(statsRingLength),
-		CrawleraTimes: newDurationTimeSeries(statsRingLength),
-		Uptime:        statsUptime(time.Now()),
-		statsLock:     &sync.RWMutex{},
+		OverallTimes:      newDurationTimeSeries(statsRingLength),
+		CrawleraTimes:     newDurationTimeSeries(statsRingLength),
+		CrawleraDialTimes: newDurationTimeSeries(statsRingLength),
+		CrawleraTLSTimes:  newDurationTimeSeries(statsRingLength),
+		CrawleraTTFBTimes: newDurationTimeSeries(statsRingLength),
+		DirectTimes:       newDurationTimeSeries(statsRingLength),
+		Methods:           newMethodsStats(),
+		Hosts:             newHostsStats(),
+		Traffic:           newTrafficStats(),
+		Upstreams:         newUpstreamsStats(),
+		Tenants:           newTenantsStats(),
+		Retries:           newRetriesStats(),
+		ErrorCategories:   newErrorCategoriesStats(),
+		Adblock:           newAdblockStats(),
+		Uptime:            statsUptime(time.Now()),
+
+		responses:         newResponsesStats(),
+		overallHistogram:  newHistogram(),
+		crawleraHistogram: newHistogram(),
+		directHistogram:   newHistogram(),
+		phaseHistograms:   newPhaseHistograms(),
+
+		statsLock: &sync.RWMutex{},
 	}
 }
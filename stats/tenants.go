@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+type tenantStats struct {
+	RequestsNumber  uint64 `json:"requests_number"`
+	SessionsCreated uint64 `json:"sessions_created"`
+	CrawleraErrors  uint64 `json:"crawlera_errors"`
+	AllErrors       uint64 `json:"all_errors"`
+}
+
+type tenantsStats struct {
+	*keyedStats
+}
+
+func (t *tenantsStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.snapshot())
+}
+
+func (t *tenantsStats) snapshot() map[string]tenantStats {
+	values := map[string]tenantStats{}
+
+	t.each(func(key string, value interface{}) {
+		v := value.(*tenantStats)
+		values[key] = tenantStats{
+			RequestsNumber:  atomic.LoadUint64(&v.RequestsNumber),
+			SessionsCreated: atomic.LoadUint64(&v.SessionsCreated),
+			CrawleraErrors:  atomic.LoadUint64(&v.CrawleraErrors),
+			AllErrors:       atomic.LoadUint64(&v.AllErrors),
+		}
+	})
+
+	return values
+}
+
+func (t *tenantsStats) get(name string) *tenantStats {
+	return t.keyedStats.get(name).(*tenantStats)
+}
+
+func newTenantsStats() *tenantsStats {
+	return &tenantsStats{
+		keyedStats: newKeyedStats(func() interface{} {
+			return &tenantStats{}
+		}),
+	}
+}
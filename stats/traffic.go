@@ -0,0 +1,205 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// trafficRateWindow is a number of latest complete seconds which
+	// are used to calculate per-second rates.
+	trafficRateWindow = 10
+
+	trafficClientsLimit = 1000
+	trafficClientsOther = "<other>"
+)
+
+// rateMeter counts values per second for the latest trafficRateWindow
+// seconds.
+type rateMeter struct {
+	buckets [trafficRateWindow]uint64
+	seconds [trafficRateWindow]int64
+	lock    sync.Mutex
+}
+
+func (r *rateMeter) add(now time.Time, value uint64) {
+	second := now.Unix()
+	idx := second % trafficRateWindow
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.seconds[idx] != second {
+		r.seconds[idx] = second
+		r.buckets[idx] = 0
+	}
+
+	r.buckets[idx] += value
+}
+
+func (r *rateMeter) rate(now time.Time) float64 {
+	second := now.Unix()
+	sum := uint64(0)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for i, bucketSecond := range r.seconds {
+		if bucketSecond < second && bucketSecond >= second-trafficRateWindow {
+			sum += r.buckets[i]
+		}
+	}
+
+	return float64(sum) / trafficRateWindow
+}
+
+type trafficCounterJSON struct {
+	BytesIn           uint64  `json:"bytes_in"`
+	BytesOut          uint64  `json:"bytes_out"`
+	BytesInPerSecond  float64 `json:"bytes_in_per_second"`
+	BytesOutPerSecond float64 `json:"bytes_out_per_second"`
+}
+
+// trafficCounter counts bytes received from (in) and sent to (out)
+// Crawlera or target hosts.
+type trafficCounter struct {
+	bytesIn  uint64
+	bytesOut uint64
+	rateIn   rateMeter
+	rateOut  rateMeter
+}
+
+func (t *trafficCounter) add(now time.Time, received, sent uint64) {
+	if received > 0 {
+		atomic.AddUint64(&t.bytesIn, received)
+		t.rateIn.add(now, received)
+	}
+
+	if sent > 0 {
+		atomic.AddUint64(&t.bytesOut, sent)
+		t.rateOut.add(now, sent)
+	}
+}
+
+func (t *trafficCounter) snapshot(now time.Time) trafficCounterJSON {
+	return trafficCounterJSON{
+		BytesIn:           atomic.LoadUint64(&t.bytesIn),
+		BytesOut:          atomic.LoadUint64(&t.bytesOut),
+		BytesInPerSecond:  t.rateIn.rate(now),
+		BytesOutPerSecond: t.rateOut.rate(now),
+	}
+}
+
+type trafficStatsJSON struct {
+	trafficCounterJSON
+
+	Routes  map[string]trafficCounterJSON `json:"routes"`
+	Clients map[string]trafficCounterJSON `json:"clients"`
+}
+
+// trafficStats keeps traffic per route and per client ID. Traffic of
+// adblocked route is an estimation of traffic which was saved. Total
+// values do not include it.
+//
+// To limit memory usage, only first trafficClientsLimit clients are
+// tracked separately, the rest are aggregated into a single entry.
+type trafficStats struct {
+	total   *trafficCounter
+	routes  map[string]*trafficCounter
+	clients map[string]*trafficCounter
+	lock    *sync.RWMutex
+}
+
+func (t *trafficStats) MarshalJSON() ([]byte, error) {
+	now := time.Now()
+	marshalled := trafficStatsJSON{
+		trafficCounterJSON: t.total.snapshot(now),
+		Routes:             make(map[string]trafficCounterJSON, len(t.routes)),
+	}
+
+	for k, v := range t.routes {
+		marshalled.Routes[k] = v.snapshot(now)
+	}
+
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	marshalled.Clients = make(map[string]trafficCounterJSON, len(t.clients))
+
+	for k, v := range t.clients {
+		marshalled.Clients[k] = v.snapshot(now)
+	}
+
+	return json.Marshal(marshalled)
+}
+
+func (t *trafficStats) add(route, clientID string, received, sent uint64) {
+	now := time.Now()
+
+	t.routes[route].add(now, received, sent)
+
+	if route == RouteAdblocked {
+		return
+	}
+
+	t.total.add(now, received, sent)
+
+	if clientID != "" {
+		t.getClient(clientID).add(now, received, sent)
+	}
+}
+
+// averageBytesIn returns an average number of bytes received per
+// request to Crawlera.
+func (t *trafficStats) averageBytesIn(requests uint64) uint64 {
+	if requests == 0 {
+		return 0
+	}
+
+	return atomic.LoadUint64(&t.routes[RouteProxied].bytesIn) / requests
+}
+
+func (t *trafficStats) getClient(clientID string) *trafficCounter {
+	t.lock.RLock()
+	value, ok := t.clients[clientID]
+	t.lock.RUnlock()
+
+	if ok {
+		return value
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if value, ok = t.clients[clientID]; ok {
+		return value
+	}
+
+	if len(t.clients) >= trafficClientsLimit {
+		clientID = trafficClientsOther
+
+		if value, ok = t.clients[clientID]; ok {
+			return value
+		}
+	}
+
+	value = &trafficCounter{}
+	t.clients[clientID] = value
+
+	return value
+}
+
+func newTrafficStats() *trafficStats {
+	return &trafficStats{
+		total: &trafficCounter{},
+		routes: map[string]*trafficCounter{
+			RouteProxied:   {},
+			RouteDirect:    {},
+			RouteAdblocked: {},
+		},
+		clients: map[string]*trafficCounter{},
+		lock:    &sync.RWMutex{},
+	}
+}
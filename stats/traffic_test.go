@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type TrafficStatsTestSuite struct {
+	suite.Suite
+
+	traffic *trafficStats
+}
+
+func (suite *TrafficStatsTestSuite) SetupTest() {
+	suite.traffic = newTrafficStats()
+}
+
+func (suite *TrafficStatsTestSuite) TestRate() {
+	meter := &rateMeter{}
+	now := time.Unix(1000, 0)
+
+	meter.add(now.Add(-trafficRateWindow*time.Second-time.Second), 1000)
+	meter.add(now.Add(-2*time.Second), 10)
+	meter.add(now.Add(-time.Second), 20)
+	meter.add(now.Add(-time.Second), 30)
+	meter.add(now, 40)
+
+	suite.InDelta(6.0, meter.rate(now), 0.001)
+	suite.InDelta(0.0, meter.rate(now.Add(time.Hour)), 0.001)
+}
+
+func (suite *TrafficStatsTestSuite) TestTotals() {
+	suite.traffic.add(RouteProxied, "client", 100, 10)
+	suite.traffic.add(RouteDirect, "client", 50, 5)
+	suite.traffic.add(RouteDirect, "", 1, 1)
+	suite.traffic.add(RouteAdblocked, "client", 1000, 1000)
+
+	now := time.Now()
+
+	suite.Equal(trafficCounterJSON{BytesIn: 151, BytesOut: 16},
+		suite.withoutRates(suite.traffic.total.snapshot(now)))
+	suite.Equal(trafficCounterJSON{BytesIn: 150, BytesOut: 15},
+		suite.withoutRates(suite.traffic.clients["client"].snapshot(now)))
+	suite.Equal(trafficCounterJSON{BytesIn: 1000, BytesOut: 1000},
+		suite.withoutRates(suite.traffic.routes[RouteAdblocked].snapshot(now)))
+	suite.Len(suite.traffic.clients, 1)
+}
+
+func (suite *TrafficStatsTestSuite) TestAverageBytesIn() {
+	suite.EqualValues(0, suite.traffic.averageBytesIn(0))
+
+	suite.traffic.add(RouteProxied, "client", 300, 10)
+	suite.traffic.add(RouteDirect, "client", 1000, 10)
+
+	suite.EqualValues(100, suite.traffic.averageBytesIn(3))
+}
+
+func (suite *TrafficStatsTestSuite) TestClientsLimit() {
+	for i := 0; i < trafficClientsLimit; i++ {
+		suite.traffic.getClient("client" + strconv.Itoa(i))
+	}
+
+	suite.Equal(suite.traffic.getClient("new1"), suite.traffic.getClient("new2"))
+	suite.Len(suite.traffic.clients, trafficClientsLimit+1)
+	suite.Contains(suite.traffic.clients, trafficClientsOther)
+}
+
+func (suite *TrafficStatsTestSuite) withoutRates(value trafficCounterJSON) trafficCounterJSON {
+	value.BytesInPerSecond = 0
+	value.BytesOutPerSecond = 0
+
+	return value
+}
+
+func TestTrafficStats(t *testing.T) {
+	suite.Run(t, &TrafficStatsTestSuite{})
+}
@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync/atomic"
+)
+
+type upstreamStats struct {
+	Requests          uint64 `json:"requests"`
+	Failures          uint64 `json:"failures"`
+	ActiveConnections uint64 `json:"active_connections"`
+	Healthy           bool   `json:"healthy"`
+}
+
+type upstreamsStats struct {
+	*keyedStats
+}
+
+func (u *upstreamsStats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(u.snapshot())
+}
+
+func (u *upstreamsStats) snapshot() map[string]upstreamStats {
+	values := map[string]upstreamStats{}
+
+	u.each(func(key string, value interface{}) {
+		v := value.(*upstreamStats)
+		values[key] = upstreamStats{
+			Requests:          atomic.LoadUint64(&v.Requests),
+			Failures:          atomic.LoadUint64(&v.Failures),
+			ActiveConnections: atomic.LoadUint64(&v.ActiveConnections),
+			Healthy:           v.Healthy,
+		}
+	})
+
+	return values
+}
+
+func (u *upstreamsStats) get(address string) *upstreamStats {
+	return u.keyedStats.get(address).(*upstreamStats)
+}
+
+func (u *upstreamsStats) setHealthy(address string, healthy bool) {
+	value := u.get(address)
+
+	u.lock.Lock()
+	value.Healthy = healthy
+	u.lock.Unlock()
+}
+
+func newUpstreamsStats() *upstreamsStats {
+	return &upstreamsStats{
+		keyedStats: newKeyedStats(func() interface{} {
+			return &upstreamStats{Healthy: true}
+		}),
+	}
+}